@@ -1,28 +1,64 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
 	emailService "carrier.microservices.go/src/lib/email"
+	"carrier.microservices.go/src/lib/pagination"
 	"carrier.microservices.go/src/lib/store"
 	"carrier.microservices.go/src/lib/validation"
+	"github.com/go-chi/chi/v5"
 )
 
 // GetEmails retrieves a list of emails
 func GetEmails(w http.ResponseWriter, r *http.Request) {
-	var page, limit int64
-	var err error
 
 	logger.Debugw("GetEmails called")
 
-	// get page from query string
-	page, err = GetQueryParamInt64(r, "page", 1)
-	if err != nil || page < 1 {
-		userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: page")
+	// get filters from query string
+	filter, param := emailFilter(r)
+	if param != "" {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: "+param)
+		return
+	}
+
+	listEmails(w, r, filter)
+}
+
+// GetFailedEmails lists the emails that failed for good, with the reason and class of each failure
+func GetFailedEmails(w http.ResponseWriter, r *http.Request) {
+
+	logger.Debugw("GetFailedEmails called")
+
+	// get filters from query string; only failed emails are listed
+	filter, param := emailFilter(r)
+	if param == "" && r.URL.Query().Has("send_status") && filter.SendStatus != EmailStatusFailed {
+		param = "send_status"
+	}
+	if param != "" {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: "+param)
 		return
 	}
+	filter.SendStatus = EmailStatusFailed
+
+	listEmails(w, r, filter)
+}
+
+// listEmails responds with a page of the emails that match a filter
+func listEmails(w http.ResponseWriter, r *http.Request, filter EmailFilter) {
+	var limit int64
+	var err error
+
+	// get cursor from query string
+	cursor := GetQueryParamString(r, "cursor", "")
 
 	// get limit from query string
 	limit, err = GetQueryParamInt64(r, "limit", 25)
@@ -32,15 +68,25 @@ func GetEmails(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// get email repository from context
-	emailRepository := r.Context().Value(keyEmailRepository).(func() *EmailRepository)()
+	ctx := r.Context()
+	emailRepository := ctx.Value(keyEmailRepository).(func() *EmailRepository)()
 
 	// retrieve a list of emails
-	emails, err := emailRepository.List(page, limit)
+	emails, nextCursor, plan, err := emailRepository.Find(ctx, filter, limit, cursor)
 	if err != nil {
+		if errors.Is(err, pagination.ErrInvalidCursor) {
+			userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: cursor")
+			return
+		}
+		if errors.Is(err, ErrUnsorted) {
+			userErrorResponse(w, http.StatusBadRequest, "Query parameter sort requires send_status or template")
+			return
+		}
 		logger.Errorf("List emails error: %v", err)
 		serverErrorResponse(w)
 		return
 	}
+	logger.Debugw("Listed emails", "Index", plan.Index, "Query", plan.Query, "Filters", len(plan.Filters))
 
 	// map results to response payload
 	emailsPayload := []EmailSchema{}
@@ -52,19 +98,132 @@ func GetEmails(w http.ResponseWriter, r *http.Request) {
 
 	// response
 	successResponse(w, 200, EmailListResponseSchema{
-		Emails: emailsPayload,
-		Page:   page,
-		Limit:  limit,
+		Emails:     emailsPayload,
+		Limit:      limit,
+		NextCursor: nextCursor,
+		HasMore:    nextCursor != "",
+		Source:     listSource(plan),
 	})
 }
 
-// PostEmails creates a new email record
+// emailFilter parses the email filters of a GET /emails query string; returns the name of the first invalid
+// parameter, if any
+func emailFilter(r *http.Request) (EmailFilter, string) {
+	var filter EmailFilter
+	var err error
+
+	status, err := GetQueryParamInt64(r, "send_status", 0)
+	if err != nil || (r.URL.Query().Has("send_status") && (status < EmailStatusQueued || status > EmailStatusFailed)) {
+		return filter, "send_status"
+	}
+	filter.SendStatus = int(status)
+
+	filter.Template = GetQueryParamString(r, "template", "")
+
+	if r.URL.Query().Has("priority") {
+		priority, err := GetQueryParamInt64(r, "priority", 0)
+		if err != nil || priority < 0 || priority > 3 {
+			return filter, "priority"
+		}
+		p := int(priority)
+		filter.Priority = &p
+	}
+
+	filter.Recipient = GetQueryParamString(r, "recipient", "")
+
+	if filter.CreatedAfter, err = GetQueryParamTime(r, "created_after"); err != nil {
+		return filter, "created_after"
+	}
+	if filter.CreatedBefore, err = GetQueryParamTime(r, "created_before"); err != nil {
+		return filter, "created_before"
+	}
+
+	filter.FailureClass = GetQueryParamString(r, "failure_class", "")
+	switch filter.FailureClass {
+	case "", FailureClassPermanent, FailureClassRetriesExhausted, FailureClassExpired, FailureClassSuppressed:
+	default:
+		return filter, "failure_class"
+	}
+
+	filter.Sort = GetQueryParamString(r, "sort", "")
+	if filter.Sort != "" && filter.Sort != SortAscending && filter.Sort != SortDescending {
+		return filter, "sort"
+	}
+
+	return filter, ""
+}
+
+// listSource describes how a list was read, for clients tuning their filters
+func listSource(plan store.ListPlan) string {
+	if plan.Query {
+		return ListSourceQuery
+	}
+	return ListSourceScan
+}
+
+// GetRecipientEmails lists the emails sent to an address, newest first
+func GetRecipientEmails(w http.ResponseWriter, r *http.Request) {
+	var limit int64
+	var err error
+
+	logger.Debugw("GetRecipientEmails called")
+
+	// get address from path, which may be escaped
+	address, err := url.PathUnescape(chi.URLParam(r, "address"))
+	address = normalizeAddress(address)
+	if err != nil || address == "" {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid address")
+		return
+	}
+
+	// get cursor from query string
+	cursor := GetQueryParamString(r, "cursor", "")
+
+	// get limit from query string
+	limit, err = GetQueryParamInt64(r, "limit", 25)
+	if err != nil || limit < 1 || limit > 200 {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: limit")
+		return
+	}
+
+	// get email repository from context
+	ctx := r.Context()
+	emailRepository := ctx.Value(keyEmailRepository).(func() *EmailRepository)()
+
+	// retrieve a list of the address's emails
+	emails, nextCursor, err := emailRepository.FindByRecipient(ctx, address, limit, cursor)
+	if err != nil {
+		if errors.Is(err, pagination.ErrInvalidCursor) {
+			userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: cursor")
+			return
+		}
+		logger.Errorf("List recipient emails error: %v", err)
+		serverErrorResponse(w)
+		return
+	}
+
+	// map results to response payload
+	emailsPayload := []EmailSchema{}
+	for _, email := range emails {
+		emailPayload := EmailSchema{}
+		emailPayload.load(email)
+		emailsPayload = append(emailsPayload, emailPayload)
+	}
+
+	// response
+	successResponse(w, 200, RecipientEmailListResponseSchema{
+		Address:    address,
+		Emails:     emailsPayload,
+		Limit:      limit,
+		NextCursor: nextCursor,
+		HasMore:    nextCursor != "",
+	})
+}
+
+// PostEmails creates a batch of email records; each email gets its own result, so emails that can't be created
+// don't prevent the others unless the batch is atomic
 func PostEmails(w http.ResponseWriter, r *http.Request) {
 	var payload BatchEmailRequestSchema
-	var emails []EmailSchema
-	var emailExchange emailService.EmailExchange
-	var exchangeInitialized bool
-	var sent, queued int64
 	var err error
 
 	logger.Debugw("PostEmails called")
@@ -80,88 +239,345 @@ func PostEmails(w http.ResponseWriter, r *http.Request) {
 	logger.Debugf("Request payload: %+v", payload)
 
 	// validate payload
-	if ok, errorMap := validation.Check(payload); !ok {
-		output, _ := json.Marshal(errorMap)
-		generateResponse(w, http.StatusBadRequest, output)
+	if errs := validation.Validate(payload); errs != nil {
+		validationErrorResponse(w, errs)
+		return
+	}
+	if payload.Atomic && len(payload.Emails) > store.MaxTransactionItems {
+		userErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Atomic batches are limited to %d emails", store.MaxTransactionItems))
 		return
 	}
 
-	// get email repository from context
-	emailRepository := r.Context().Value(keyEmailRepository).(func() *EmailRepository)()
+	// get email, suppression and idempotency repositories from context
+	ctx := r.Context()
+	emailRepository := ctx.Value(keyEmailRepository).(func() *EmailRepository)()
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+	idempotencyRepository := ctx.Value(keyIdempotencyRepository).(func() *IdempotencyRepository)()
+
+	// a retried request gets the original response
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		if len(key) > 255 {
+			userErrorResponse(w, http.StatusBadRequest, "Invalid header: Idempotency-Key")
+			return
+		}
+		hash := requestHash(payload)
+		record, reserved, err := idempotencyRepository.Reserve(ctx, IdempotencyScopeRequest, key, hash)
+		if err != nil {
+			logger.Errorf("Unable to reserve idempotency key: %v", err)
+			serverErrorResponse(w)
+			return
+		}
+		if !reserved {
+			if conflict := idempotencyConflict(record, hash); conflict != "" {
+				userErrorResponse(w, http.StatusConflict, conflict)
+				return
+			}
+			logger.Infow("Replaying idempotent request", "Key", key)
+			w.Header().Set("Idempotent-Replayed", "true")
+			generateResponse(w, record.StatusCode, []byte(record.Response))
+			return
+		}
 
-	// loop over emails defined in payload
-	for _, emailPayload := range payload.Emails {
+		// save the response once it's written, even if the client gave up waiting for it; server errors release the
+		// key so the request can be retried
+		recorder := &responseRecorder{ResponseWriter: w}
+		w = recorder
+		defer func() {
+			var err error
+			saveCtx, cancel := outcomeContext()
+			defer cancel()
+			if recorder.statusCode >= 500 {
+				err = idempotencyRepository.Release(saveCtx, record)
+			} else {
+				err = idempotencyRepository.Update(saveCtx, record, store.ChangeSet{
+					"status_code": recorder.statusCode,
+					"response":    recorder.body.String(),
+				})
+			}
+			if err != nil {
+				logger.Errorf("Unable to save idempotent response: %v", err)
+			}
+		}()
+	}
 
-		sendSuccess := false
+	// validate each email on its own, so errors only reject that email, and check that its idempotency key isn't
+	// used twice in the batch
+	entries := make([]*batchEntry, len(payload.Emails))
+	emailKeys := map[string]string{}
+	for i, emailPayload := range payload.Emails {
+		entry := &batchEntry{payload: emailPayload, hash: requestHash(emailPayload)}
+		entry.result.Index = i
+		entries[i] = entry
 
-		// create email
-		email := Email{
-			Recipients:    emailPayload.Recipients,
-			Template:      emailPayload.Template,
-			Substitutions: emailPayload.Substitutions,
-			Priority:      emailPayload.Priority,
-			Queued:        time.Now(),
+		if errs := validation.Validate(emailPayload); errs != nil {
+			errs = errs.Prefix(fmt.Sprintf("emails[%d]", i))
+			entry.result.Errors = errs.Map()
+			entry.result.Details = errs
+			entry.reject(http.StatusBadRequest, BatchStatusInvalid, "Invalid email")
+			continue
 		}
+		if key := emailPayload.IdempotencyKey; key != "" {
+			if seen, ok := emailKeys[key]; ok && seen != entry.hash {
+				entry.reject(http.StatusConflict, BatchStatusConflict, "Idempotency key was used with a different request")
+				continue
+			}
+			emailKeys[key] = entry.hash
+		}
+	}
 
-		// set status differently if sending email now or later
-		if emailPayload.Priority == 0 {
-			email.SendStatus = EmailStatusProcessing
-		} else {
-			email.SendStatus = EmailStatusQueued
+	// send email now; the exchange is only initialized if needed
+	sender := &emailSender{emailRepository: emailRepository, suppressionRepository: suppressionRepository}
+	send := func(email *Email) bool {
+		return sender.send(ctx, email)
+	}
+
+	// create emails one at a time, or all at once for atomic batches
+	if payload.Atomic {
+		for _, entry := range entries {
+			if !entry.done() {
+				entry.prepare(ctx, emailRepository, suppressionRepository, idempotencyRepository)
+			}
 		}
 
-		// save email
-		err = emailRepository.Store(&email)
-		if err != nil {
-			logger.Errorf("Unable to save email: %v", err)
-			serverErrorResponse(w)
+		// nothing is created if any email can't be
+		if code := batchFailureCode(entries); code != 0 {
+			for _, entry := range entries {
+				entry.abort(ctx, idempotencyRepository)
+			}
+			if code >= 500 {
+				serverErrorResponse(w)
+			} else {
+				successResponse(w, code, batchResponse(entries))
+			}
 			return
 		}
 
-		// send email now
-		if emailPayload.Priority == 0 {
-
-			logger.Debugw("Sending email synchronously")
-
-			// get exchange from context if not initialized
-			if emailExchange == nil {
-				emailExchange = r.Context().Value(keyEmailExchange).(func() emailService.EmailExchange)()
-				err = emailExchange.Init()
-				if err != nil {
-					logger.Errorf("Cannot create email exchange: %s\n", err)
-				} else {
-					logger.Debugw("Initialized email exchange")
-					exchangeInitialized = true
+		// save emails
+		emails := []*Email{}
+		for _, entry := range entries {
+			if entry.email != nil {
+				emails = append(emails, entry.email)
+			}
+		}
+		if len(emails) > 0 {
+			if err = emailRepository.StoreAll(ctx, emails); err != nil {
+				logger.Errorf("Unable to save emails: %v", err)
+				for _, entry := range entries {
+					entry.release(ctx, idempotencyRepository)
 				}
+				serverErrorResponse(w)
+				return
+			}
+		}
+		for _, entry := range entries {
+			if entry.email != nil {
+				entry.complete(ctx, idempotencyRepository, send)
+			}
+		}
+	} else {
+		for _, entry := range entries {
+			if entry.done() {
+				continue
+			}
+			entry.prepare(ctx, emailRepository, suppressionRepository, idempotencyRepository)
+			if entry.email == nil {
+				continue
 			}
 
-			// send email
-			if exchangeInitialized == true {
-				sendSuccess = SendEmail(emailExchange, &email, emailRepository)
+			// save email
+			err = emailRepository.Store(ctx, entry.email)
+			if err != nil {
+				logger.Errorf("Unable to save email: %v", err)
+				entry.release(ctx, idempotencyRepository)
+				entry.reject(http.StatusInternalServerError, BatchStatusError, "Server error")
+				continue
 			}
+			entry.complete(ctx, idempotencyRepository, send)
 		}
+	}
 
-		// update tallys
-		if sendSuccess == true {
-			sent++
-		} else {
-			queued++
+	// response; multi-status if any email wasn't created
+	response := batchResponse(entries)
+	code := http.StatusCreated
+	if response.Unprocessed > 0 {
+		code = http.StatusMultiStatus
+	}
+	successResponse(w, code, response)
+}
+
+// batchEntry tracks one email of a POST /emails batch from validation to its result
+type batchEntry struct {
+	payload NewEmailRequestSchema
+	hash    string
+	record  *IdempotencyRecord
+	email   *Email
+	result  BatchEmailResultSchema
+}
+
+// done reports whether the entry already has its result
+func (e *batchEntry) done() bool {
+	return e.result.Status != ""
+}
+
+// reject sets the result of an entry whose email was not created
+func (e *batchEntry) reject(code int, status, message string) {
+	e.result.Code = code
+	e.result.Status = status
+	e.result.Error = message
+}
+
+// succeed sets the result of an entry whose email was created or already existed
+func (e *batchEntry) succeed(code int, status string, email *Email) {
+	emailPayload := EmailSchema{}
+	emailPayload.load(email)
+	e.result.Code = code
+	e.result.Status = status
+	e.result.Email = &emailPayload
+}
+
+// prepare reserves the entry's idempotency key and creates its email, ready to be saved; an entry whose key was
+// already used gets the original email as its result instead
+func (e *batchEntry) prepare(ctx context.Context, emailRepository *EmailRepository, suppressionRepository *SuppressionRepository, idempotencyRepository *IdempotencyRepository) {
+	if key := e.payload.IdempotencyKey; key != "" {
+		record, reserved, err := idempotencyRepository.Reserve(ctx, IdempotencyScopeEmail, key, e.hash)
+		if err != nil {
+			logger.Errorf("Unable to reserve idempotency key: %v", err)
+			e.reject(http.StatusInternalServerError, BatchStatusError, "Server error")
+			return
 		}
+		if !reserved {
+			if conflict := idempotencyConflict(record, e.hash); conflict != "" {
+				e.reject(http.StatusConflict, BatchStatusConflict, conflict)
+				return
+			}
+			original, err := emailRepository.Get(ctx, record.EmailID)
+			if err != nil {
+				switch err.(type) {
+				case *store.NotFoundError:
+					e.reject(http.StatusConflict, BatchStatusConflict, "Idempotency key belongs to a deleted email")
+				default:
+					logger.Errorf("Unable to retrieve email: %v", err)
+					e.reject(http.StatusInternalServerError, BatchStatusError, "Server error")
+				}
+				return
+			}
+			logger.Infow("Replaying idempotent email", "Key", key, "ID", original.ID)
+			e.succeed(http.StatusOK, BatchStatusReplayed, original)
+			return
+		}
+		e.record = record
+	}
 
-		// map result to response payload
-		emailPayload := EmailSchema{}
-		emailPayload.load(&email)
+	// find suppressed recipients
+	suppressed, err := suppressionRepository.Suppressed(ctx, e.payload.Recipients)
+	if err != nil {
+		logger.Errorf("Unable to check suppression list: %v", err)
+		e.release(ctx, idempotencyRepository)
+		e.reject(http.StatusInternalServerError, BatchStatusError, "Server error")
+		return
+	}
 
-		// add email to list for output
-		emails = append(emails, emailPayload)
+	// create email, to be sent now or later, or never if every recipient is suppressed
+	e.email = &Email{
+		Recipients:    e.payload.Recipients,
+		Template:      e.payload.Template,
+		Substitutions: e.payload.Substitutions,
+		Priority:      e.payload.Priority,
+		CallbackURL:   e.payload.CallbackURL,
 	}
+	enqueue(e.email, suppressed)
+}
 
-	// response
-	successResponse(w, 201, BatchEmailResponseSchema{
-		Emails: emails,
-		Sent:   sent,
-		Queued: queued,
-	})
+// complete records a saved email against its idempotency key and sends it if it's due now
+func (e *batchEntry) complete(ctx context.Context, idempotencyRepository *IdempotencyRepository, send func(*Email) bool) {
+
+	// remember the email for retries, before a slow send can make the caller give up
+	if e.record != nil {
+		saveCtx, cancel := outcomeContext()
+		defer cancel()
+		err := idempotencyRepository.Update(saveCtx, e.record, store.ChangeSet{"email_id": e.email.ID})
+		if err != nil {
+			logger.Errorf("Unable to save idempotency key: %v", err)
+		}
+	}
+
+	status := BatchStatusQueued
+	if e.email.SendStatus == EmailStatusFailed {
+		status = BatchStatusFailed
+	} else if e.email.SendStatus == EmailStatusProcessing && send(e.email) {
+		status = BatchStatusSent
+	}
+	e.succeed(http.StatusCreated, status, e.email)
+}
+
+// release frees the entry's idempotency key after its email could not be saved
+func (e *batchEntry) release(ctx context.Context, idempotencyRepository *IdempotencyRepository) {
+	if e.record == nil {
+		return
+	}
+	saveCtx, cancel := outcomeContext()
+	defer cancel()
+	if err := idempotencyRepository.Release(saveCtx, e.record); err != nil {
+		logger.Errorf("Unable to release idempotency key: %v", err)
+	}
+	e.record = nil
+}
+
+// abort releases the entry of an atomic batch that can't be saved; entries that were fine are marked as aborted
+func (e *batchEntry) abort(ctx context.Context, idempotencyRepository *IdempotencyRepository) {
+	e.release(ctx, idempotencyRepository)
+	if !e.done() || e.result.Status == BatchStatusReplayed {
+		e.result.Email = nil
+		e.reject(http.StatusFailedDependency, BatchStatusAborted, "Another email in the batch could not be created")
+	}
+}
+
+// batchFailureCode returns the status code explaining why an atomic batch can't be saved, or 0 if it can; server
+// errors take precedence over conflicts, and conflicts over invalid emails
+func batchFailureCode(entries []*batchEntry) int {
+	code := 0
+	for _, entry := range entries {
+		if entry.result.Code >= 400 && entry.result.Code > code {
+			code = entry.result.Code
+		}
+	}
+	return code
+}
+
+// batchResponse summarizes the results of a batch's entries
+func batchResponse(entries []*batchEntry) BatchEmailResponseSchema {
+	response := BatchEmailResponseSchema{
+		Results: []BatchEmailResultSchema{},
+		Emails:  []EmailSchema{},
+	}
+	for _, entry := range entries {
+		response.Results = append(response.Results, entry.result)
+		if entry.result.Details != nil {
+			if response.Errors == nil {
+				response.Errors = map[string]map[string]string{}
+			}
+			for path, rules := range entry.result.Errors {
+				response.Errors[path] = rules
+			}
+			response.Details = append(response.Details, entry.result.Details...)
+		}
+		if entry.result.Email != nil {
+			response.Emails = append(response.Emails, *entry.result.Email)
+		}
+		switch entry.result.Status {
+		case BatchStatusSent:
+			response.Sent++
+		case BatchStatusQueued:
+			response.Queued++
+		case BatchStatusFailed:
+			response.Failed++
+		case BatchStatusReplayed:
+			response.Replayed++
+		default:
+			response.Unprocessed++
+		}
+	}
+	return response
 }
 
 // GetEmail retrieves a single email
@@ -179,11 +595,35 @@ func GetEmail(w http.ResponseWriter, r *http.Request) {
 	emailPayload.load(email)
 
 	// response
+	w.Header().Set("ETag", email.ETag())
 	successResponse(w, 200, EmailResponseSchema{
 		Email: emailPayload,
 	})
 }
 
+// GetEmailAttempts retrieves the send attempts of a single email, oldest first
+func GetEmailAttempts(w http.ResponseWriter, r *http.Request) {
+
+	logger.Debugw("GetEmailAttempts called")
+
+	// get email from context
+	email := r.Context().Value(keyEmail).(*Email)
+
+	// map results to response payload
+	attemptsPayload := []AttemptSchema{}
+	for _, attempt := range email.AttemptHistory {
+		attemptPayload := AttemptSchema{}
+		attemptPayload.load(&attempt)
+		attemptsPayload = append(attemptsPayload, attemptPayload)
+	}
+
+	// response
+	successResponse(w, 200, AttemptListResponseSchema{
+		Attempts: attemptsPayload,
+		Total:    email.Attempts,
+	})
+}
+
 // UpdateEmail updates a single email
 func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 	var payload EmailRequestSchema
@@ -197,6 +637,18 @@ func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 
 	logger.Debugf("Email (before): %+v", email)
 
+	// client must have the current version of the email if it says which version it has
+	if r.Header.Get("If-Match") != "" && !ifMatch(r.Header.Values("If-Match"), email.ETag()) {
+		userErrorResponse(w, http.StatusPreconditionFailed, "Precondition failed")
+		return
+	}
+
+	// emails being sent by the queue job cannot be changed until the attempt is over
+	if email.SendStatus == EmailStatusProcessing {
+		userErrorResponse(w, http.StatusConflict, "Email is being processed")
+		return
+	}
+
 	// get payload from request body
 	defer r.Body.Close()
 	decoder := json.NewDecoder(r.Body)
@@ -206,9 +658,8 @@ func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// validate payload
-	if ok, errorMap := validation.Check(payload); !ok {
-		output, _ := json.Marshal(errorMap)
-		generateResponse(w, http.StatusBadRequest, output)
+	if errs := validation.Validate(payload); errs != nil {
+		validationErrorResponse(w, errs)
 		return
 	}
 
@@ -224,13 +675,29 @@ func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 		"send_status":   payload.SendStatus,
 		"priority":      payload.Priority,
 		"queued":        time.Time(payload.Queued),
+		"callback_url":  payload.CallbackURL,
+	}
+
+	// only failed emails have a failure class
+	if payload.SendStatus != EmailStatusFailed {
+		changeSet["failure_class"] = ""
+	}
+
+	// sending now claims the email
+	if payload.Priority == 0 {
+		changeSet["send_status"] = EmailStatusProcessing
 	}
 
-	// save email
-	err = emailRepository.Update(email, changeSet)
+	// save email; fails if the email changed since it was read
+	err = emailRepository.Update(ctx, email, changeSet)
 	if err != nil {
-		logger.Errorf("Unable to update email: %+v", err)
-		serverErrorResponse(w)
+		switch err.(type) {
+		case *store.ConflictError:
+			userErrorResponse(w, http.StatusPreconditionFailed, "Precondition failed")
+		default:
+			logger.Errorf("Unable to update email: %+v", err)
+			serverErrorResponse(w)
+		}
 		return
 	}
 
@@ -238,6 +705,9 @@ func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 	if time.Time(payload.Queued).IsZero() {
 		email.Queued = time.Time{}
 	}
+	if payload.SendStatus != EmailStatusFailed {
+		email.FailureClass = ""
+	}
 
 	// send email now
 	if payload.Priority == 0 {
@@ -245,7 +715,7 @@ func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 		logger.Debugw("Sending email synchronously")
 
 		// get exchange from context
-		emailExchange := r.Context().Value(keyEmailExchange).(func() emailService.EmailExchange)()
+		emailExchange := ctx.Value(keyEmailExchange).(func() emailService.EmailExchange)()
 		err = emailExchange.Init()
 		if err != nil {
 			logger.Errorf("Cannot create email exchange: %s\n", err)
@@ -253,7 +723,8 @@ func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 			logger.Debugw("Initialized email exchange")
 
 			// send email
-			SendEmail(emailExchange, email, emailRepository)
+			suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+			SendEmail(ctx, emailExchange, email, emailRepository, suppressionRepository, retryPolicies(), retryLimit())
 		}
 	}
 
@@ -264,11 +735,169 @@ func UpdateEmail(w http.ResponseWriter, r *http.Request) {
 	emailPayload.load(email)
 
 	// response
+	w.Header().Set("ETag", email.ETag())
 	successResponse(w, 200, EmailResponseSchema{
 		Email: emailPayload,
 	})
 }
 
+// RetryEmail puts a single failed email back in the queue, or sends it now if its priority is 0
+func RetryEmail(w http.ResponseWriter, r *http.Request) {
+	var payload RetryEmailRequestSchema
+	var err error
+
+	logger.Debugw("RetryEmail called")
+
+	// get email from context
+	ctx := r.Context()
+	email := ctx.Value(keyEmail).(*Email)
+
+	// get payload from request body, which is optional
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// validate payload
+	if errs := validation.Validate(payload); errs != nil {
+		validationErrorResponse(w, errs)
+		return
+	}
+
+	// get email and suppression repositories from context
+	emailRepository := ctx.Value(keyEmailRepository).(func() *EmailRepository)()
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+	sender := &emailSender{emailRepository: emailRepository, suppressionRepository: suppressionRepository}
+
+	// retry email
+	var conflictErr *store.ConflictError
+	status, err := retryEmail(ctx, email, payload, sender, true)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotFailed):
+		userErrorResponse(w, http.StatusConflict, "Only failed emails can be retried")
+		return
+	case errors.Is(err, ErrAllSuppressed):
+		userErrorResponse(w, http.StatusConflict, "All recipients are suppressed")
+		return
+	case errors.As(err, &conflictErr):
+		userErrorResponse(w, http.StatusConflict, "Email changed while it was being retried")
+		return
+	default:
+		logger.Errorf("Unable to retry email: %v", err)
+		serverErrorResponse(w)
+		return
+	}
+	logger.Infow("Retried email", "ID", email.ID, "Status", status)
+
+	// map result to response payload
+	emailPayload := EmailSchema{}
+	emailPayload.load(email)
+
+	// response
+	w.Header().Set("ETag", email.ETag())
+	successResponse(w, 200, RetryEmailResponseSchema{
+		Status: status,
+		Email:  emailPayload,
+	})
+}
+
+// RetryEmails puts the failed emails that match a filter back in the queue, up to a limit, for the scheduled job
+// to send; emails that can't be retried are skipped
+func RetryEmails(w http.ResponseWriter, r *http.Request) {
+	var payload RetryEmailsRequestSchema
+	var err error
+
+	logger.Debugw("RetryEmails called")
+
+	// get payload from request body
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&payload); err != nil {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	logger.Debugf("Request payload: %+v", payload)
+
+	// validate payload
+	if errs := validation.Validate(payload); errs != nil {
+		validationErrorResponse(w, errs)
+		return
+	}
+	limit := payload.Limit
+	if limit == 0 {
+		limit = 100
+	}
+
+	// get email and suppression repositories from context
+	ctx := r.Context()
+	emailRepository := ctx.Value(keyEmailRepository).(func() *EmailRepository)()
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+	sender := &emailSender{emailRepository: emailRepository, suppressionRepository: suppressionRepository}
+
+	filter := EmailFilter{
+		SendStatus:    EmailStatusFailed,
+		Template:      payload.Template,
+		FailureClass:  payload.FailureClass,
+		CreatedAfter:  time.Time(payload.CreatedAfter),
+		CreatedBefore: time.Time(payload.CreatedBefore),
+	}
+	retryPayload := RetryEmailRequestSchema{
+		Attempts: payload.Attempts,
+		Priority: payload.Priority,
+		Note:     payload.Note,
+	}
+
+	// retry matching emails a page at a time, until the limit is reached
+	response := RetryEmailsResponseSchema{Emails: []EmailSchema{}}
+	var seen int64
+	cursor := ""
+	for {
+		emails, nextCursor, _, err := emailRepository.Find(ctx, filter, limit-seen, cursor)
+		if err != nil {
+			logger.Errorf("List emails error: %v", err)
+			if seen == 0 {
+				serverErrorResponse(w)
+				return
+			}
+			break // report the emails already retried
+		}
+
+		for _, email := range emails {
+			seen++
+			_, err := retryEmail(ctx, email, retryPayload, sender, false)
+			if err != nil {
+				var conflictErr *store.ConflictError
+				if errors.Is(err, ErrNotFailed) || errors.Is(err, ErrAllSuppressed) || errors.As(err, &conflictErr) {
+					logger.Infow("Skipped email retry", "ID", email.ID, "Reason", err)
+				} else {
+					logger.Errorf("Unable to retry email: %v", err)
+				}
+				response.Skipped++
+				continue
+			}
+
+			emailPayload := EmailSchema{}
+			emailPayload.load(email)
+			response.Emails = append(response.Emails, emailPayload)
+			response.Queued++
+		}
+
+		cursor = nextCursor
+		if cursor == "" || seen >= limit {
+			break
+		}
+	}
+	response.HasMore = cursor != ""
+	logger.Infow("Retried emails", "Queued", response.Queued, "Skipped", response.Skipped)
+
+	// response
+	successResponse(w, 200, response)
+}
+
 // DeleteEmail deletes a single email
 func DeleteEmail(w http.ResponseWriter, r *http.Request) {
 	var err error
@@ -285,7 +914,7 @@ func DeleteEmail(w http.ResponseWriter, r *http.Request) {
 	emailRepository := ctx.Value(keyEmailRepository).(func() *EmailRepository)()
 
 	// delete email
-	err = emailRepository.Delete(email.ID)
+	err = emailRepository.Delete(ctx, email)
 	if err != nil {
 		logger.Errorf("Unable to delete email: %v", err)
 		serverErrorResponse(w)
@@ -295,3 +924,293 @@ func DeleteEmail(w http.ResponseWriter, r *http.Request) {
 	// response
 	successResponse(w, 204, nil)
 }
+
+// PostSparkPostWebhook records a batch of SparkPost delivery events on the emails they belong to
+func PostSparkPostWebhook(w http.ResponseWriter, r *http.Request) {
+
+	logger.Debugw("PostSparkPostWebhook called")
+
+	// parse event batch
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		userErrorResponse(w, 400, "Invalid request body")
+		return
+	}
+	events, err := emailService.ParseSparkPostEvents(body)
+	if err != nil {
+		logger.Infow("Invalid webhook payload", "Error", err)
+		userErrorResponse(w, 400, "Invalid JSON payload")
+		return
+	}
+
+	// get email and suppression repositories from context
+	ctx := r.Context()
+	emailRepository := ctx.Value(keyEmailRepository).(func() *EmailRepository)()
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+
+	// suppress recipients that hard bounced, complained or unsubscribed; existing suppressions, e.g. manual ones,
+	// are kept as they are
+	for _, event := range events {
+		if reason := suppressionReason(event); reason != "" {
+			err = suppressionRepository.Insert(ctx, &Suppression{
+				Address:     event.Recipient,
+				Reason:      reason,
+				Description: event.Reason,
+			})
+			switch err.(type) {
+			case nil:
+				logger.Infow("Recipient suppressed", "Address", event.Recipient, "Reason", reason)
+			case *store.ConflictError:
+				logger.Infow("Recipient already suppressed", "Address", event.Recipient, "Reason", reason)
+			default:
+				logger.Errorf("Unable to save suppression: %v", err)
+				serverErrorResponse(w)
+				return
+			}
+		}
+	}
+
+	// group events by the transmission they belong to, in the order received
+	var serviceIDs []string
+	eventsByServiceID := map[string][]DeliveryEvent{}
+	for _, event := range events {
+		if _, ok := eventsByServiceID[event.ServiceID]; !ok {
+			serviceIDs = append(serviceIDs, event.ServiceID)
+		}
+		eventsByServiceID[event.ServiceID] = append(eventsByServiceID[event.ServiceID], DeliveryEvent{
+			ID:          event.ID,
+			Type:        event.Type,
+			Recipient:   event.Recipient,
+			Timestamp:   event.Timestamp,
+			Reason:      event.Reason,
+			BounceClass: event.BounceClass,
+			URL:         event.URL,
+		})
+	}
+
+	// record events; on failure SparkPost retries the whole batch, and events already recorded are skipped
+	recorded := 0
+	for _, serviceID := range serviceIDs {
+		email, err := emailRepository.GetByServiceID(ctx, serviceID)
+		if err != nil {
+			switch err.(type) {
+			case *store.NotFoundError:
+				logger.Infow("Webhook events for unknown email", "ServiceID", serviceID)
+				continue
+			default:
+				logger.Errorf("Unable to retrieve email from datastore: %v", err)
+				serverErrorResponse(w)
+				return
+			}
+		}
+
+		added, err := emailRepository.AddEvents(ctx, email, eventsByServiceID[serviceID])
+		if err != nil {
+			logger.Errorf("Unable to record webhook events: %v", err)
+			serverErrorResponse(w)
+			return
+		}
+		recorded += added
+	}
+
+	// response
+	successResponse(w, 200, WebhookResponseSchema{
+		Received: len(events),
+		Recorded: recorded,
+	})
+}
+
+// GetSuppressions retrieves a list of suppressions
+func GetSuppressions(w http.ResponseWriter, r *http.Request) {
+	var limit int64
+	var err error
+
+	logger.Debugw("GetSuppressions called")
+
+	// get cursor from query string
+	cursor := GetQueryParamString(r, "cursor", "")
+
+	// get limit from query string
+	limit, err = GetQueryParamInt64(r, "limit", 25)
+	if err != nil || limit < 1 || limit > 200 {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: limit")
+		return
+	}
+
+	// get suppression repository from context
+	ctx := r.Context()
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+
+	// retrieve a list of suppressions
+	suppressions, nextCursor, err := suppressionRepository.List(ctx, limit, cursor)
+	if err != nil {
+		if errors.Is(err, pagination.ErrInvalidCursor) {
+			userErrorResponse(w, http.StatusBadRequest, "Invalid value for query parameter: cursor")
+			return
+		}
+		logger.Errorf("Unable to retrieve suppressions from datastore: %v", err)
+		serverErrorResponse(w)
+		return
+	}
+
+	// map results to response payload
+	suppressionsPayload := []SuppressionSchema{}
+	for _, suppression := range suppressions {
+		suppressionPayload := SuppressionSchema{}
+		suppressionPayload.load(suppression)
+		suppressionsPayload = append(suppressionsPayload, suppressionPayload)
+	}
+
+	// response
+	successResponse(w, 200, SuppressionListResponseSchema{
+		Suppressions: suppressionsPayload,
+		Limit:        limit,
+		NextCursor:   nextCursor,
+		HasMore:      nextCursor != "",
+	})
+}
+
+// GetSuppression retrieves the suppression of an address
+func GetSuppression(w http.ResponseWriter, r *http.Request) {
+
+	logger.Debugw("GetSuppression called")
+
+	// get suppression from context
+	suppression := r.Context().Value(keySuppression).(*Suppression)
+
+	// map result to response payload
+	suppressionPayload := SuppressionSchema{}
+	suppressionPayload.load(suppression)
+
+	// response
+	successResponse(w, 200, SuppressionResponseSchema{
+		Suppression: suppressionPayload,
+	})
+}
+
+// PostSuppression suppresses an address
+func PostSuppression(w http.ResponseWriter, r *http.Request) {
+	var payload SuppressionRequestSchema
+	var err error
+
+	logger.Debugw("PostSuppression called")
+
+	// get payload from request body
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&payload); err != nil {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// validate payload
+	if errs := validation.Validate(payload); errs != nil {
+		validationErrorResponse(w, errs)
+		return
+	}
+
+	// get suppression repository from context
+	ctx := r.Context()
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+
+	// save suppression; an address can only be suppressed once
+	suppression := Suppression{
+		Address:     payload.Address,
+		Reason:      payload.Reason,
+		Description: payload.Description,
+	}
+	err = suppressionRepository.Insert(ctx, &suppression)
+	switch err.(type) {
+	case nil:
+	case *store.ConflictError:
+		userErrorResponse(w, http.StatusConflict, "Address is already suppressed")
+		return
+	default:
+		logger.Errorf("Unable to save suppression: %v", err)
+		serverErrorResponse(w)
+		return
+	}
+
+	// map result to response payload
+	suppressionPayload := SuppressionSchema{}
+	suppressionPayload.load(&suppression)
+
+	// response
+	successResponse(w, 201, SuppressionResponseSchema{
+		Suppression: suppressionPayload,
+	})
+}
+
+// UpdateSuppression updates the suppression of an address
+func UpdateSuppression(w http.ResponseWriter, r *http.Request) {
+	var payload SuppressionUpdateRequestSchema
+	var err error
+
+	logger.Debugw("UpdateSuppression called")
+
+	// get suppression from context
+	ctx := r.Context()
+	suppression := ctx.Value(keySuppression).(*Suppression)
+
+	// get payload from request body
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&payload); err != nil {
+		userErrorResponse(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// validate payload
+	if errs := validation.Validate(payload); errs != nil {
+		validationErrorResponse(w, errs)
+		return
+	}
+
+	// get suppression repository from context
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+
+	// save suppression
+	err = suppressionRepository.Update(ctx, suppression, store.ChangeSet{
+		"reason":      payload.Reason,
+		"description": payload.Description,
+	})
+	if err != nil {
+		logger.Errorf("Unable to update suppression: %v", err)
+		serverErrorResponse(w)
+		return
+	}
+
+	// map result to response payload
+	suppressionPayload := SuppressionSchema{}
+	suppressionPayload.load(suppression)
+
+	// response
+	successResponse(w, 200, SuppressionResponseSchema{
+		Suppression: suppressionPayload,
+	})
+}
+
+// DeleteSuppression removes the suppression of an address so it can be sent to again
+func DeleteSuppression(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	logger.Debugw("DeleteSuppression called")
+
+	// get suppression from context
+	ctx := r.Context()
+	suppression := ctx.Value(keySuppression).(*Suppression)
+
+	// get suppression repository from context
+	suppressionRepository := ctx.Value(keySuppressionRepository).(func() *SuppressionRepository)()
+
+	// delete suppression
+	err = suppressionRepository.Delete(ctx, suppression.Address)
+	if err != nil {
+		logger.Errorf("Unable to delete suppression: %v", err)
+		serverErrorResponse(w)
+		return
+	}
+
+	// response
+	successResponse(w, 204, nil)
+}
@@ -0,0 +1,1480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"carrier.microservices.go/src/lib/datetime"
+	emailService "carrier.microservices.go/src/lib/email"
+	"carrier.microservices.go/src/lib/store"
+	"carrier.microservices.go/src/lib/validation"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// mockExchange is an EmailExchange that records transmissions instead of sending them
+type mockExchange struct {
+	mu          sync.Mutex
+	sent        []emailService.Email
+	err         error
+	delay       time.Duration
+	inFlight    int
+	maxInFlight int
+}
+
+func (ex *mockExchange) Init() error {
+	return nil
+}
+
+func (ex *mockExchange) Send(ctx context.Context, email *emailService.Email) error {
+	ex.mu.Lock()
+	ex.inFlight++
+	if ex.inFlight > ex.maxInFlight {
+		ex.maxInFlight = ex.inFlight
+	}
+	delay := ex.delay
+	ex.mu.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.inFlight--
+	if ctx.Err() != nil {
+		return &emailService.DeadlineError{Reason: "Send interrupted", Err: ctx.Err()}
+	}
+
+	email.LastAttemptAt = time.Now()
+	email.Provider = "mock"
+	if ex.err != nil {
+		return ex.err
+	}
+	email.ID = uuid.New().String()
+	email.Accepted = len(email.Recipients)
+	ex.sent = append(ex.sent, *email)
+	return nil
+}
+
+// sentCount returns the number of successful transmissions
+func (ex *mockExchange) sentCount() int {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return len(ex.sent)
+}
+
+// useMockServices swaps the datastore and email exchange for in-memory versions for the duration of a test
+func useMockServices(t *testing.T) (*store.MemoryTable, *mockExchange) {
+	t.Setenv("EMAIL_QUEUE_INDEX", "emails-queue-idx")
+	t.Setenv("EMAIL_SERVICE_INDEX", "emails-service-idx")
+	t.Setenv("CALLBACK_QUEUE_INDEX", "callbacks-queue-idx")
+	t.Setenv("JOB_SEND_RATE", "0")
+	t.Setenv("CURSOR_SECRET", "test-secret")
+
+	table := store.NewMemoryTable(
+		store.Index{
+			Name:     "emails-queue-idx",
+			HashKey:  "send_status",
+			RangeKey: "priority_queued",
+		},
+		store.Index{
+			Name:    "emails-service-idx",
+			HashKey: "service_id",
+		},
+		store.Index{
+			Name:     "emails-status-idx",
+			HashKey:  "send_status",
+			RangeKey: "created_at",
+		},
+		store.Index{
+			Name:     "emails-template-idx",
+			HashKey:  "template",
+			RangeKey: "created_at",
+		},
+	)
+	suppressionTable := store.NewMemoryTable()
+	callbackTable := store.NewMemoryTable(store.Index{
+		Name:     "callbacks-queue-idx",
+		HashKey:  "delivery_status",
+		RangeKey: "due",
+	})
+
+	recipientTable := store.NewMemoryTable(store.Index{
+		Name:     "recipients-address-idx",
+		HashKey:  "address",
+		RangeKey: "created_at",
+	})
+	idempotencyTable := store.NewMemoryTable()
+	exchange := &mockExchange{}
+
+	origDatastore, origSuppressionDatastore, origCallbackDatastore, origRecipientDatastore, origIdempotencyDatastore, origExchange := newEmailDatastore, newSuppressionDatastore, newCallbackDatastore, newRecipientDatastore, newIdempotencyDatastore, newEmailExchange
+	newEmailDatastore = func() store.Datastore { return table }
+	newSuppressionDatastore = func() store.Datastore { return suppressionTable }
+	newCallbackDatastore = func() store.Datastore { return callbackTable }
+	newRecipientDatastore = func() store.Datastore { return recipientTable }
+	newIdempotencyDatastore = func() store.Datastore { return idempotencyTable }
+	newEmailExchange = func() emailService.EmailExchange { return exchange }
+	t.Cleanup(func() {
+		newEmailDatastore, newSuppressionDatastore, newCallbackDatastore, newRecipientDatastore, newIdempotencyDatastore, newEmailExchange = origDatastore, origSuppressionDatastore, origCallbackDatastore, origRecipientDatastore, origIdempotencyDatastore, origExchange
+	})
+
+	return table, exchange
+}
+
+// serveRequest sends a request with an optional JSON body through the router
+func serveRequest(method, target string, body interface{}) *httptest.ResponseRecorder {
+	return serveRequestWithHeaders(method, target, body, nil)
+}
+
+// serveRequestWithHeaders sends a request with an optional JSON body and headers through the router
+func serveRequestWithHeaders(method, target string, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		reader = bytes.NewReader(createMockBodyJSON(body))
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+// storeMockEmail saves an email directly through the repository
+func storeMockEmail(t *testing.T, table store.Datastore, email *Email) *Email {
+	if err := NewEmailRepository(table).Store(context.Background(), email); err != nil {
+		t.Fatalf("Store() returned an error: %v", err)
+	}
+	return email
+}
+
+func TestPostEmailsQueued(t *testing.T) {
+	table, exchange := useMockServices(t)
+
+	w := serveRequest("POST", "/emails", map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"test@example.com"}, "template": "welcome", "priority": 2},
+			{"recipients": []string{"test2@example.com"}, "template": "welcome", "priority": 3},
+		},
+	})
+
+	if w.Code != 201 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", w.Code, 201, w.Body.String())
+	}
+
+	var response BatchEmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Queued != 2 || response.Sent != 0 {
+		t.Errorf("PostEmails tallies: got queued=%d sent=%d, want queued=2 sent=0", response.Queued, response.Sent)
+	}
+	if exchange.sentCount() != 0 {
+		t.Errorf("PostEmails sent %d emails, want 0", exchange.sentCount())
+	}
+
+	// emails should be retrievable from the datastore in the queued state
+	for _, emailPayload := range response.Emails {
+		email, err := NewEmailRepository(table).Get(context.Background(), emailPayload.ID)
+		if err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		if email.SendStatus != EmailStatusQueued {
+			t.Errorf("SendStatus: got %d, want %d", email.SendStatus, EmailStatusQueued)
+		}
+		if email.PriorityQueued == "" {
+			t.Errorf("PriorityQueued was empty")
+		}
+	}
+}
+
+func TestPostEmailsInvalid(t *testing.T) {
+	useMockServices(t)
+
+	tests := []interface{}{
+		map[string]interface{}{},
+		map[string]interface{}{"emails": []map[string]interface{}{}},
+		"not an object",
+	}
+
+	for _, tc := range tests {
+		w := serveRequest("POST", "/emails", tc)
+		if w.Code != 400 {
+			t.Errorf("PostEmails StatusCode: got %v, want %v", w.Code, 400)
+		}
+	}
+
+	// validation errors are reported by path, with a message
+	w := serveRequest("POST", "/emails", map[string]interface{}{"emails": []map[string]interface{}{}})
+	var response struct {
+		Errors  map[string]map[string]string `json:"errors"`
+		Details validation.Errors            `json:"details"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if _, ok := response.Errors["emails"]["min"]; !ok || len(response.Details) != 1 || response.Details[0].Message != "emails must have at least 1 item" {
+		t.Errorf("PostEmails errors: got %v %+v, want emails min", response.Errors, response.Details)
+	}
+}
+
+func TestGetEmail(t *testing.T) {
+	table, _ := useMockServices(t)
+	email := storeMockEmail(t, table, &Email{
+		Recipients: []string{"test@example.com"},
+		Template:   "welcome",
+		SendStatus: EmailStatusQueued,
+		Priority:   1,
+		Queued:     time.Now(),
+	})
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/email/" + email.ID.String(), 200},
+		{"/email/" + uuid.New().String(), 404},
+	}
+
+	for _, tc := range tests {
+		w := serveRequest("GET", tc.target, nil)
+		if w.Code != tc.want {
+			t.Errorf("GetEmail StatusCode: got %v, want %v", w.Code, tc.want)
+		}
+	}
+
+	var response EmailResponseSchema
+	w := serveRequest("GET", "/email/"+email.ID.String(), nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Email.ID != email.ID || response.Email.Template != "welcome" {
+		t.Errorf("GetEmail Body: got %+v, want %+v", response.Email, email)
+	}
+	if got := time.Time(response.Email.NextAttemptAt); !got.Equal(email.Queued.Truncate(time.Second)) {
+		t.Errorf("GetEmail NextAttemptAt: got %v, want %v", got, email.Queued.Truncate(time.Second))
+	}
+}
+
+func TestUpdateEmail(t *testing.T) {
+	table, exchange := useMockServices(t)
+	email := storeMockEmail(t, table, &Email{
+		Recipients: []string{"test@example.com"},
+		Template:   "welcome",
+		SendStatus: EmailStatusQueued,
+		Priority:   1,
+		Queued:     time.Now(),
+	})
+
+	w := serveRequest("PUT", "/email/"+email.ID.String(), map[string]interface{}{
+		"recipients":  []string{"other@example.com"},
+		"template":    "reset",
+		"send_status": EmailStatusQueued,
+		"priority":    3,
+		"queued":      "2030-01-01T00:00:00+0000",
+	})
+	if w.Code != 200 {
+		t.Fatalf("UpdateEmail StatusCode: got %v, want %v (%s)", w.Code, 200, w.Body.String())
+	}
+
+	updated, err := NewEmailRepository(table).Get(context.Background(), email.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if updated.Template != "reset" || updated.Priority != 3 || updated.Recipients[0] != "other@example.com" {
+		t.Errorf("UpdateEmail result: got %+v", updated)
+	}
+	if updated.PriorityQueued != "3#2030-01-01T00:00:00+0000" {
+		t.Errorf("PriorityQueued: got %v, want %v", updated.PriorityQueued, "3#2030-01-01T00:00:00+0000")
+	}
+	if exchange.sentCount() != 0 {
+		t.Errorf("UpdateEmail sent %d emails, want 0", exchange.sentCount())
+	}
+}
+
+func TestUpdateEmailPreconditions(t *testing.T) {
+	table, _ := useMockServices(t)
+	email := storeMockEmail(t, table, &Email{
+		Recipients: []string{"test@example.com"},
+		Template:   "welcome",
+		SendStatus: EmailStatusQueued,
+		Priority:   1,
+		Queued:     time.Now(),
+	})
+	processing := storeMockEmail(t, table, &Email{
+		Recipients: []string{"test@example.com"},
+		Template:   "welcome",
+		SendStatus: EmailStatusProcessing,
+		Priority:   1,
+		Queued:     time.Now(),
+	})
+	payload := map[string]interface{}{
+		"recipients":  []string{"test@example.com"},
+		"template":    "reset",
+		"send_status": EmailStatusQueued,
+		"priority":    2,
+		"queued":      "2030-01-01T00:00:00+0000",
+	}
+
+	// GET reports the current version as an ETag
+	w := serveRequest("GET", "/email/"+email.ID.String(), nil)
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Fatalf("GetEmail ETag: got %v, want %v", etag, `"1"`)
+	}
+
+	tests := []struct {
+		id      uuid.UUID
+		ifMatch string
+		code    int
+		etag    string
+	}{
+		{email.ID, `"2"`, 412, ""},
+		{email.ID, `"1"`, 200, `"2"`},
+		{email.ID, `"1"`, 412, ""},
+		{email.ID, "", 200, `"3"`},
+		{email.ID, "*", 200, `"4"`},
+		{email.ID, `"1", "3", "5"`, 412, ""},
+		{email.ID, `"1", "4", "5"`, 200, `"5"`},
+		{email.ID, `W/"5"`, 412, ""},
+		{email.ID, `W/"5", "5"`, 200, `"6"`},
+		{email.ID, `"6",`, 200, `"7"`},
+		{email.ID, `7`, 412, ""},
+		{processing.ID, "", 409, ""},
+	}
+
+	for i, tc := range tests {
+		w := serveRequestWithHeaders("PUT", "/email/"+tc.id.String(), payload, map[string]string{"If-Match": tc.ifMatch})
+		if w.Code != tc.code {
+			t.Errorf("UpdateEmail case %d StatusCode: got %v, want %v", i, w.Code, tc.code)
+		}
+		if tc.etag != "" && w.Header().Get("ETag") != tc.etag {
+			t.Errorf("UpdateEmail case %d ETag: got %v, want %v", i, w.Header().Get("ETag"), tc.etag)
+		}
+	}
+
+	// a stale copy of the email cannot overwrite newer changes
+	stale := *email
+	err := NewEmailRepository(table).Update(context.Background(), &stale, store.ChangeSet{"template": "stale"})
+	var conflict *store.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("Update() with stale version: got %v, want ConflictError", err)
+	}
+}
+
+func TestDeleteEmail(t *testing.T) {
+	table, _ := useMockServices(t)
+	email := storeMockEmail(t, table, &Email{
+		Recipients: []string{"test@example.com"},
+		Template:   "welcome",
+		SendStatus: EmailStatusQueued,
+		Priority:   1,
+		Queued:     time.Now(),
+	})
+
+	w := serveRequest("DELETE", "/email/"+email.ID.String(), nil)
+	if w.Code != 204 {
+		t.Fatalf("DeleteEmail StatusCode: got %v, want %v", w.Code, 204)
+	}
+
+	_, err := NewEmailRepository(table).Get(context.Background(), email.ID)
+	var notFound *store.NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("Get() after delete: got %v, want NotFoundError", err)
+	}
+}
+
+func TestGetEmails(t *testing.T) {
+	table, _ := useMockServices(t)
+	for i := 0; i < 5; i++ {
+		storeMockEmail(t, table, &Email{
+			Recipients: []string{"test@example.com"},
+			Template:   "welcome",
+			SendStatus: EmailStatusQueued,
+			Priority:   1,
+			Queued:     time.Now(),
+		})
+	}
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/emails?limit=0", 400},
+		{"/emails?limit=201", 400},
+		{"/emails?cursor=bogus", 400},
+	}
+
+	for _, tc := range tests {
+		w := serveRequest("GET", tc.target, nil)
+		if w.Code != tc.code {
+			t.Errorf("GetEmails %s StatusCode: got %v, want %v", tc.target, w.Code, tc.code)
+		}
+	}
+
+	// follow cursors until every email has been seen exactly once
+	seen := map[uuid.UUID]bool{}
+	pages := 0
+	target := "/emails?limit=2"
+	for {
+		w := serveRequest("GET", target, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GetEmails %s StatusCode: got %v, want %v", target, w.Code, http.StatusOK)
+		}
+		var response EmailListResponseSchema
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unmarshalling error: %v", err)
+		}
+		pages++
+		for _, email := range response.Emails {
+			if seen[email.ID] {
+				t.Errorf("GetEmails returned %v more than once", email.ID)
+			}
+			seen[email.ID] = true
+		}
+		if response.HasMore != (response.NextCursor != "") {
+			t.Errorf("GetEmails has_more=%v inconsistent with next_cursor=%q", response.HasMore, response.NextCursor)
+		}
+		if !response.HasMore {
+			break
+		}
+		target = "/emails?limit=2&cursor=" + url.QueryEscape(response.NextCursor)
+	}
+	if len(seen) != 5 || pages != 3 {
+		t.Errorf("GetEmails paging: got %d emails over %d pages, want 5 emails over 3 pages", len(seen), pages)
+	}
+}
+
+func TestGetRecipientEmails(t *testing.T) {
+	useMockServices(t)
+
+	// create emails one at a time so each is newer than the last
+	ids := []uuid.UUID{}
+	for _, recipients := range [][]string{
+		{"Jane@Example.com", "other@example.com"},
+		{"other@example.com"},
+		{"jane@example.com"},
+		{"jane@example.com", "JANE@example.com"},
+	} {
+		w := serveRequest("POST", "/emails", map[string]interface{}{
+			"emails": []map[string]interface{}{{"recipients": recipients, "template": "welcome", "priority": 2}},
+		})
+		var response BatchEmailResponseSchema
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unmarshalling error: %v", err)
+		}
+		ids = append(ids, response.Emails[0].ID)
+		time.Sleep(time.Millisecond)
+	}
+
+	// moving an email to another address and deleting one update the mapping
+	w := serveRequest("PUT", "/email/"+ids[1].String(), map[string]interface{}{
+		"recipients": []string{"jane@example.com"}, "template": "welcome", "priority": 2, "send_status": EmailStatusQueued,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("UpdateEmail StatusCode: got %v, want %v (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+	if w := serveRequest("DELETE", "/email/"+ids[2].String(), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DeleteEmail StatusCode: got %v, want %v", w.Code, http.StatusNoContent)
+	}
+
+	tests := []struct {
+		address string
+		want    []uuid.UUID
+	}{
+		{"jane@example.com", []uuid.UUID{ids[3], ids[1], ids[0]}},
+		{"JANE%40example.com", []uuid.UUID{ids[3], ids[1], ids[0]}},
+		{"other@example.com", []uuid.UUID{ids[0]}},
+		{"nobody@example.com", []uuid.UUID{}},
+	}
+	for _, tc := range tests {
+
+		// follow cursors one email at a time
+		got := []uuid.UUID{}
+		target := "/recipients/" + tc.address + "/emails?limit=1"
+		for target != "" {
+			w := serveRequest("GET", target, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GetRecipientEmails %s StatusCode: got %v, want %v (%s)", target, w.Code, http.StatusOK, w.Body.String())
+			}
+			var response RecipientEmailListResponseSchema
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Unmarshalling error: %v", err)
+			}
+			for _, email := range response.Emails {
+				got = append(got, email.ID)
+			}
+			target = ""
+			if response.HasMore {
+				target = "/recipients/" + tc.address + "/emails?limit=1&cursor=" + url.QueryEscape(response.NextCursor)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("GetRecipientEmails %s: got %v, want %v", tc.address, got, tc.want)
+		}
+	}
+
+	if w := serveRequest("GET", "/recipients/jane@example.com/emails?limit=0", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("GetRecipientEmails StatusCode: got %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGetEmailsFilters(t *testing.T) {
+	table, _ := useMockServices(t)
+	now := time.Now()
+
+	// emails with distinct creation times, named for the test cases
+	names := map[uuid.UUID]string{}
+	for _, tc := range []struct {
+		name       string
+		status     int
+		template   string
+		priority   int
+		recipients []string
+		age        time.Duration
+	}{
+		{"e1", EmailStatusFailed, "welcome", 1, []string{"a@example.com"}, 72 * time.Hour},
+		{"e2", EmailStatusFailed, "reset", 2, []string{"b@example.com"}, 24 * time.Hour},
+		{"e3", EmailStatusComplete, "welcome", 0, []string{"a@example.com", "c@example.com"}, 2 * time.Hour},
+		{"e4", EmailStatusFailed, "welcome", 1, []string{"c@example.com"}, time.Hour},
+	} {
+		email := storeMockEmail(t, table, &Email{Recipients: tc.recipients, Template: tc.template, SendStatus: tc.status, Priority: tc.priority})
+		var updated Email
+		if err := table.Update(context.Background(), email.ID, &updated, store.ChangeSet{"created_at": now.Add(-tc.age)}); err != nil {
+			t.Fatalf("Update() returned an error: %v", err)
+		}
+		names[email.ID] = tc.name
+	}
+	since := url.QueryEscape(now.Add(-30 * time.Hour).Format(datetime.ISO8601Datetime))
+
+	tests := []struct {
+		query  string
+		source string
+		sorted bool
+		want   []string
+	}{
+		{"send_status=4&template=welcome&created_after=" + since, ListSourceQuery, false, []string{"e4"}},
+		{"send_status=4&sort=asc", ListSourceQuery, true, []string{"e1", "e2", "e4"}},
+		{"send_status=4&sort=desc", ListSourceQuery, true, []string{"e4", "e2", "e1"}},
+		{"template=welcome&created_before=" + since + "&sort=desc", ListSourceQuery, true, []string{"e1"}},
+		{"recipient=a@example.com", ListSourceScan, false, []string{"e1", "e3"}},
+		{"priority=0", ListSourceScan, false, []string{"e3"}},
+		{"priority=1&created_after=" + since, ListSourceScan, false, []string{"e4"}},
+	}
+	for _, tc := range tests {
+		w := serveRequest("GET", "/emails?"+tc.query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GetEmails %s StatusCode: got %v, want %v (%s)", tc.query, w.Code, http.StatusOK, w.Body.String())
+		}
+		var response EmailListResponseSchema
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unmarshalling error: %v", err)
+		}
+		got := []string{}
+		for _, email := range response.Emails {
+			got = append(got, names[email.ID])
+		}
+		if !tc.sorted {
+			sort.Strings(got)
+		}
+		if !reflect.DeepEqual(got, tc.want) || response.Source != tc.source {
+			t.Errorf("GetEmails %s: got %v from %s, want %v from %s", tc.query, got, response.Source, tc.want, tc.source)
+		}
+	}
+
+	// sorted pages continue in order
+	got := []string{}
+	target := "/emails?template=welcome&sort=desc&limit=1"
+	for target != "" {
+		var response EmailListResponseSchema
+		if err := json.Unmarshal(serveRequest("GET", target, nil).Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unmarshalling error: %v", err)
+		}
+		for _, email := range response.Emails {
+			got = append(got, names[email.ID])
+		}
+		target = ""
+		if response.HasMore {
+			target = "/emails?template=welcome&sort=desc&limit=1&cursor=" + url.QueryEscape(response.NextCursor)
+		}
+	}
+	if want := []string{"e4", "e3", "e1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetEmails paging: got %v, want %v", got, want)
+	}
+
+	// cursors only continue the listing they came from
+	var page EmailListResponseSchema
+	if err := json.Unmarshal(serveRequest("GET", "/emails?template=welcome&sort=desc&limit=1", nil).Body.Bytes(), &page); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	for _, query := range []string{"template=welcome&sort=asc", "template=other&sort=desc", "send_status=1"} {
+		target := "/emails?" + query + "&limit=1&cursor=" + url.QueryEscape(page.NextCursor)
+		if w := serveRequest("GET", target, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GetEmails %s with another listing's cursor StatusCode: got %v, want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// invalid filters, and sorting without an index
+	for _, query := range []string{"send_status=9", "priority=x", "created_after=yesterday", "sort=up", "sort=desc", "recipient=a@example.com&sort=asc"} {
+		if w := serveRequest("GET", "/emails?"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GetEmails %s StatusCode: got %v, want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// createMockSparkPostEvent creates a SparkPost webhook event of the category for a transmission
+func createMockSparkPostEvent(category, eventType, eventID, transmissionID, recipient string) map[string]interface{} {
+	return map[string]interface{}{
+		"msys": map[string]interface{}{
+			category: map[string]interface{}{
+				"type":            eventType,
+				"event_id":        eventID,
+				"transmission_id": transmissionID,
+				"rcpt_to":         recipient,
+				"timestamp":       "1460989507",
+				"bounce_class":    "10",
+				"reason":          "550 5.1.1 unknown user",
+			},
+		},
+	}
+}
+
+func TestPostSparkPostWebhook(t *testing.T) {
+	table, _ := useMockServices(t)
+	t.Setenv("SPARKPOST_WEBHOOK_USERNAME", "sparkpost")
+	t.Setenv("SPARKPOST_WEBHOOK_PASSWORD", "secret")
+	t.Setenv("SPARKPOST_WEBHOOK_TOKEN", "")
+
+	email := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com", "b@example.com"}, Template: "welcome", SendStatus: EmailStatusComplete, ServiceID: "84320004920659"})
+	other := storeMockEmail(t, table, &Email{Recipients: []string{"c@example.com"}, Template: "welcome", SendStatus: EmailStatusComplete, ServiceID: "84320004920660"})
+
+	batch := []interface{}{
+		createMockSparkPostEvent("message_event", "delivery", "1001", email.ServiceID, "a@example.com"),
+		createMockSparkPostEvent("message_event", "bounce", "1002", email.ServiceID, "b@example.com"),
+		createMockSparkPostEvent("track_event", "click", "1003", other.ServiceID, "c@example.com"),
+		createMockSparkPostEvent("message_event", "delivery", "1004", "99999999", "d@example.com"),
+		map[string]interface{}{"msys": map[string]interface{}{}},
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("sparkpost:secret"))
+
+	// test authentication
+	tests := []struct {
+		headers map[string]string
+		want    int
+	}{
+		{nil, 401},
+		{map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("sparkpost:wrong"))}, 401},
+		{map[string]string{"Authorization": auth}, 200},
+	}
+	for _, tc := range tests {
+		w := serveRequestWithHeaders("POST", "/webhooks/sparkpost", batch, tc.headers)
+		if w.Code != tc.want {
+			t.Errorf("PostSparkPostWebhook StatusCode: got %v, want %v (%s)", w.Code, tc.want, w.Body.String())
+		}
+	}
+
+	// redelivered batches are not recorded twice
+	w := serveRequestWithHeaders("POST", "/webhooks/sparkpost", batch, map[string]string{"Authorization": auth})
+	var response WebhookResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Received != 4 || response.Recorded != 0 {
+		t.Errorf("PostSparkPostWebhook redelivery: got received=%d recorded=%d, want received=4 recorded=0", response.Received, response.Recorded)
+	}
+
+	// events are exposed on the email
+	w = serveRequest("GET", "/email/"+email.ID.String(), nil)
+	var emailResponse EmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &emailResponse); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	events := emailResponse.Email.Events
+	if len(events) != 2 {
+		t.Fatalf("GetEmail events: got %d, want 2", len(events))
+	}
+	if events[0].Type != "delivery" || events[1].Type != "bounce" || events[1].Recipient != "b@example.com" || events[1].BounceClass != "10" {
+		t.Errorf("GetEmail events were incorrect: got %+v", events)
+	}
+	if time.Time(events[0].Timestamp).Unix() != 1460989507 {
+		t.Errorf("GetEmail event timestamp: got %v, want %v", time.Time(events[0].Timestamp), time.Unix(1460989507, 0))
+	}
+
+	// hard bounces are suppressed
+	suppressionRepository := NewSuppressionRepository(newSuppressionDatastore())
+	suppressed, err := suppressionRepository.Suppressed(context.Background(), []string{"a@example.com", "B@example.com"})
+	if err != nil {
+		t.Fatalf("Suppressed() returned an error: %v", err)
+	}
+	if len(suppressed) != 1 || suppressed[0] != "B@example.com" {
+		t.Errorf("Suppressed() after bounce: got %v, want [B@example.com]", suppressed)
+	}
+
+	// manual suppressions aren't overwritten by later events
+	if err := suppressionRepository.Store(context.Background(), &Suppression{Address: "e@example.com", Reason: SuppressionReasonManual, Description: "Customer request"}); err != nil {
+		t.Fatalf("Store() returned an error: %v", err)
+	}
+	bounce := []interface{}{createMockSparkPostEvent("message_event", "bounce", "1005", email.ServiceID, "e@example.com")}
+	if w := serveRequestWithHeaders("POST", "/webhooks/sparkpost", bounce, map[string]string{"Authorization": auth}); w.Code != 200 {
+		t.Errorf("PostSparkPostWebhook StatusCode: got %v, want %v (%s)", w.Code, 200, w.Body.String())
+	}
+	manual, err := suppressionRepository.Get(context.Background(), "e@example.com")
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if manual.Reason != SuppressionReasonManual || manual.Description != "Customer request" {
+		t.Errorf("manual suppression after bounce: got %s (%s), want %s (Customer request)", manual.Reason, manual.Description, SuppressionReasonManual)
+	}
+
+	result, err := NewEmailRepository(table).Get(context.Background(), other.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if len(result.Events) != 1 || result.Events[0].Type != "click" {
+		t.Errorf("other email events were incorrect: got %+v", result.Events)
+	}
+}
+
+func TestPostSparkPostWebhookToken(t *testing.T) {
+	useMockServices(t)
+	t.Setenv("SPARKPOST_WEBHOOK_USERNAME", "")
+	t.Setenv("SPARKPOST_WEBHOOK_PASSWORD", "")
+	t.Setenv("SPARKPOST_WEBHOOK_TOKEN", "token")
+
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{"", 401},
+		{"wrong", 401},
+		{"token", 200},
+	}
+	for _, tc := range tests {
+		w := serveRequestWithHeaders("POST", "/webhooks/sparkpost", []interface{}{}, map[string]string{"X-MessageSystems-Webhook-Token": tc.token})
+		if w.Code != tc.want {
+			t.Errorf("PostSparkPostWebhook with token %q StatusCode: got %v, want %v", tc.token, w.Code, tc.want)
+		}
+	}
+}
+
+// storeMockSuppression saves a suppression directly through the repository
+func storeMockSuppression(t *testing.T, address string) {
+	err := NewSuppressionRepository(newSuppressionDatastore()).Store(context.Background(), &Suppression{Address: address, Reason: SuppressionReasonManual})
+	if err != nil {
+		t.Fatalf("Store() returned an error: %v", err)
+	}
+}
+
+func TestSuppressions(t *testing.T) {
+	useMockServices(t)
+
+	// create
+	tests := []struct {
+		body map[string]interface{}
+		want int
+	}{
+		{map[string]interface{}{"address": "Bounced@Example.com", "reason": "hard_bounce"}, 201},
+		{map[string]interface{}{"address": "bounced@example.com", "reason": "manual"}, 409},
+		{map[string]interface{}{"address": "not-an-address", "reason": "manual"}, 400},
+		{map[string]interface{}{"address": "other@example.com", "reason": "because"}, 400},
+		{map[string]interface{}{"address": "other@example.com", "reason": "unsubscribe", "description": "Asked by phone"}, 201},
+	}
+	for _, tc := range tests {
+		w := serveRequest("POST", "/suppressions", tc.body)
+		if w.Code != tc.want {
+			t.Errorf("PostSuppression(%v) StatusCode: got %v, want %v (%s)", tc.body, w.Code, tc.want, w.Body.String())
+		}
+	}
+
+	// read, by any case of the address
+	w := serveRequest("GET", "/suppressions/BOUNCED@example.com", nil)
+	var response SuppressionResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if w.Code != 200 || response.Suppression.Address != "bounced@example.com" || response.Suppression.Reason != SuppressionReasonHardBounce {
+		t.Errorf("GetSuppression: got %v %+v", w.Code, response.Suppression)
+	}
+
+	// read, by an escaped address
+	if w := serveRequest("POST", "/suppressions", map[string]interface{}{"address": "first+tag@example.com", "reason": "manual"}); w.Code != 201 {
+		t.Fatalf("PostSuppression StatusCode: got %v, want %v (%s)", w.Code, 201, w.Body.String())
+	}
+	for _, path := range []string{"/suppressions/First%2Btag%40example.com", "/suppressions/first+tag@example.com"} {
+		if w := serveRequest("GET", path, nil); w.Code != 200 {
+			t.Errorf("GetSuppression %s StatusCode: got %v, want %v", path, w.Code, 200)
+		}
+	}
+	if w := serveRequest("DELETE", "/suppressions/first%2Btag%40example.com", nil); w.Code != 204 {
+		t.Errorf("DeleteSuppression escaped StatusCode: got %v, want 204", w.Code)
+	}
+
+	// update
+	w = serveRequest("PUT", "/suppressions/bounced@example.com", map[string]interface{}{"reason": "spam_complaint"})
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if w.Code != 200 || response.Suppression.Reason != SuppressionReasonSpamComplaint {
+		t.Errorf("UpdateSuppression: got %v %+v", w.Code, response.Suppression)
+	}
+
+	// list
+	w = serveRequest("GET", "/suppressions?limit=1", nil)
+	var list SuppressionListResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if len(list.Suppressions) != 1 || !list.HasMore {
+		t.Errorf("GetSuppressions: got %d suppressions, has_more=%v, want 1 and true", len(list.Suppressions), list.HasMore)
+	}
+
+	// delete
+	if w = serveRequest("DELETE", "/suppressions/bounced@example.com", nil); w.Code != 204 {
+		t.Errorf("DeleteSuppression StatusCode: got %v, want 204", w.Code)
+	}
+	if w = serveRequest("GET", "/suppressions/bounced@example.com", nil); w.Code != 404 {
+		t.Errorf("GetSuppression after delete StatusCode: got %v, want 404", w.Code)
+	}
+}
+
+func TestPostEmailsSuppressed(t *testing.T) {
+	table, _ := useMockServices(t)
+	storeMockSuppression(t, "bounced@example.com")
+
+	w := serveRequest("POST", "/emails", map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"ok@example.com", "Bounced@example.com"}, "template": "welcome", "priority": 1},
+			{"recipients": []string{"bounced@example.com"}, "template": "welcome", "priority": 1},
+		},
+	})
+	if w.Code != 201 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", w.Code, 201, w.Body.String())
+	}
+
+	var response BatchEmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Queued != 1 {
+		t.Errorf("PostEmails queued: got %d, want 1", response.Queued)
+	}
+
+	tests := []struct {
+		wantStatus     int
+		wantSuppressed []string
+	}{
+		{EmailStatusQueued, []string{"Bounced@example.com"}},
+		{EmailStatusFailed, []string{"bounced@example.com"}},
+	}
+	for i, tc := range tests {
+		payload := response.Emails[i]
+		if payload.SendStatus != tc.wantStatus || fmt.Sprint(payload.Suppressed) != fmt.Sprint(tc.wantSuppressed) {
+			t.Errorf("email %d: got status=%d suppressed=%v, want status=%d suppressed=%v", i, payload.SendStatus, payload.Suppressed, tc.wantStatus, tc.wantSuppressed)
+		}
+	}
+
+	// fully suppressed emails are failed, not queued
+	email, err := NewEmailRepository(table).Get(context.Background(), response.Emails[1].ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.PriorityQueued != "" || email.FailureReason != "All recipients are suppressed" {
+		t.Errorf("suppressed email: got priority_queued=%q failure_reason=%q", email.PriorityQueued, email.FailureReason)
+	}
+}
+
+// listMockCallbacks returns every stored callback, oldest first
+func listMockCallbacks(t *testing.T) []*Callback {
+	var callbacks []*Callback
+	if _, err := newCallbackDatastore().List(context.Background(), &callbacks, 100, "", nil); err != nil {
+		t.Fatalf("List() returned an error: %v", err)
+	}
+	sort.Slice(callbacks, func(i, j int) bool {
+		return callbacks[i].CreatedAt.Before(callbacks[j].CreatedAt)
+	})
+	return callbacks
+}
+
+func TestPostEmailsCallbacks(t *testing.T) {
+	useMockServices(t)
+	t.Setenv("CALLBACK_URL", "https://default.example.com/hook")
+
+	w := serveRequest("POST", "/emails", map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"now@example.com"}, "template": "welcome", "priority": 0, "callback_url": "https://caller.example.com/hook"},
+			{"recipients": []string{"later@example.com"}, "template": "welcome", "priority": 2},
+		},
+	})
+	if w.Code != 201 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", w.Code, 201, w.Body.String())
+	}
+
+	// sending now moves through processing to complete; queued emails use the default URL
+	tests := []struct {
+		url                string
+		eventType          string
+		previousSendStatus int
+		sendStatus         int
+	}{
+		{"https://caller.example.com/hook", "email.processing", 0, EmailStatusProcessing},
+		{"https://caller.example.com/hook", "email.complete", EmailStatusProcessing, EmailStatusComplete},
+		{"https://default.example.com/hook", "email.queued", 0, EmailStatusQueued},
+	}
+	callbacks := listMockCallbacks(t)
+	if len(callbacks) != len(tests) {
+		t.Fatalf("callbacks queued: got %d, want %d", len(callbacks), len(tests))
+	}
+	for i, tc := range tests {
+		var event CallbackEventSchema
+		if err := json.Unmarshal([]byte(callbacks[i].Payload), &event); err != nil {
+			t.Fatalf("Unmarshalling error: %v", err)
+		}
+		if callbacks[i].URL != tc.url || callbacks[i].DeliveryStatus != CallbackStatusPending || callbacks[i].Due == "" {
+			t.Errorf("callback %d: got url=%s delivery_status=%d due=%q", i, callbacks[i].URL, callbacks[i].DeliveryStatus, callbacks[i].Due)
+		}
+		if event.ID != callbacks[i].ID || event.Type != tc.eventType || event.Data.PreviousSendStatus != tc.previousSendStatus || event.Data.SendStatus != tc.sendStatus {
+			t.Errorf("callback %d: got %+v, want type=%s previous=%d status=%d", i, event, tc.eventType, tc.previousSendStatus, tc.sendStatus)
+		}
+	}
+
+	// invalid callback URLs are rejected
+	w = serveRequest("PUT", "/email/"+callbacks[2].EmailID.String(), map[string]interface{}{
+		"recipients": []string{"later@example.com"}, "template": "welcome", "priority": 2, "callback_url": "not a url",
+	})
+	if w.Code != 400 {
+		t.Errorf("PostEmails StatusCode: got %v, want %v", w.Code, 400)
+	}
+}
+
+func TestGetEmailAttempts(t *testing.T) {
+	table, exchange := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+
+	// first attempt fails, the second succeeds once the backoff has passed
+	exchange.err = errors.New("service unavailable")
+	w := serveRequest("POST", "/emails", map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"test@example.com"}, "template": "welcome", "priority": 0},
+		},
+	})
+	var created BatchEmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	target := "/email/" + created.Emails[0].ID.String()
+	exchange.err = nil
+	email, err := NewEmailRepository(table).Get(context.Background(), created.Emails[0].ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusQueued || !email.Queued.After(time.Now()) {
+		t.Fatalf("failed send: got status %d queued %v, want queued for later", email.SendStatus, email.Queued)
+	}
+	if err := NewEmailRepository(table).Update(context.Background(), email, store.ChangeSet{"queued": time.Now().Add(-time.Second)}); err != nil {
+		t.Fatalf("Update() returned an error: %v", err)
+	}
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	w = serveRequest("GET", target+"/attempts", nil)
+	if w.Code != 200 {
+		t.Fatalf("GetEmailAttempts StatusCode: got %v, want %v", w.Code, 200)
+	}
+	var response AttemptListResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+
+	tests := []struct {
+		number  int
+		outcome string
+		err     string
+	}{
+		{1, AttemptOutcomeError, "service unavailable"},
+		{2, AttemptOutcomeSent, ""},
+	}
+	if len(response.Attempts) != len(tests) || response.Total != len(tests) {
+		t.Fatalf("GetEmailAttempts: got %d attempts (total %d), want %d", len(response.Attempts), response.Total, len(tests))
+	}
+	for i, tc := range tests {
+		attempt := response.Attempts[i]
+		if attempt.Number != tc.number || attempt.Outcome != tc.outcome || attempt.Error != tc.err || attempt.Provider != "mock" {
+			t.Errorf("attempt %d: got %+v, want number=%d outcome=%s error=%q", i, attempt, tc.number, tc.outcome, tc.err)
+		}
+	}
+	if response.Attempts[1].ServiceID == "" || response.Attempts[1].Accepted != 1 {
+		t.Errorf("sent attempt: got %+v, want service ID and 1 accepted", response.Attempts[1])
+	}
+
+	if w := serveRequest("GET", "/email/"+uuid.New().String()+"/attempts", nil); w.Code != 404 {
+		t.Errorf("GetEmailAttempts StatusCode: got %v, want %v", w.Code, 404)
+	}
+}
+
+// countMockEmails returns the number of stored emails
+func countMockEmails(t *testing.T, table store.Datastore) int {
+	var emails []*Email
+	if _, err := table.List(context.Background(), &emails, 100, "", nil); err != nil {
+		t.Fatalf("List() returned an error: %v", err)
+	}
+	return len(emails)
+}
+
+func TestPostEmailsIdempotencyKey(t *testing.T) {
+	table, exchange := useMockServices(t)
+
+	payload := map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"test@example.com"}, "template": "welcome", "priority": 0},
+		},
+	}
+	headers := map[string]string{"Idempotency-Key": "request-1"}
+
+	// first request sends, the retry returns the original response
+	first := serveRequestWithHeaders("POST", "/emails", payload, headers)
+	if first.Code != 201 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", first.Code, 201, first.Body.String())
+	}
+	retry := serveRequestWithHeaders("POST", "/emails", payload, headers)
+	if retry.Code != 201 || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("PostEmails retry: got %v %s, want %v %s", retry.Code, retry.Body.String(), 201, first.Body.String())
+	}
+	if exchange.sentCount() != 1 || countMockEmails(t, table) != 1 {
+		t.Errorf("PostEmails retry: got sent=%d stored=%d, want sent=1 stored=1", exchange.sentCount(), countMockEmails(t, table))
+	}
+
+	// the key can't be reused for a different request
+	payload["emails"].([]map[string]interface{})[0]["template"] = "other"
+	if w := serveRequestWithHeaders("POST", "/emails", payload, headers); w.Code != 409 {
+		t.Errorf("PostEmails reused key StatusCode: got %v, want %v", w.Code, 409)
+	}
+}
+
+func TestIdempotencyRepositoryReserve(t *testing.T) {
+	ctx := context.Background()
+	table := store.NewMemoryTable()
+	repository := NewIdempotencyRepository(table, time.Hour, time.Minute)
+
+	// a key in progress is locked
+	if _, reserved, err := repository.Reserve(ctx, IdempotencyScopeRequest, "locked", "a"); err != nil || !reserved {
+		t.Fatalf("Reserve(): got %v %v, want reserved", reserved, err)
+	}
+	if _, reserved, _ := repository.Reserve(ctx, IdempotencyScopeRequest, "locked", "a"); reserved {
+		t.Errorf("Reserve() locked key: got reserved, want the existing record")
+	}
+
+	// a key whose request was abandoned, or whose record expired, is taken over by a single retry
+	abandoned := NewIdempotencyRepository(table, time.Hour, -time.Minute)
+	if _, _, err := abandoned.Reserve(ctx, IdempotencyScopeRequest, "abandoned", "a"); err != nil {
+		t.Fatalf("Reserve() returned an error: %v", err)
+	}
+	expired := NewIdempotencyRepository(table, -time.Hour, time.Minute)
+	record, _, err := expired.Reserve(ctx, IdempotencyScopeRequest, "expired", "a")
+	if err != nil {
+		t.Fatalf("Reserve() returned an error: %v", err)
+	}
+	if err := expired.Update(ctx, record, store.ChangeSet{"status_code": 201, "response": "{}"}); err != nil {
+		t.Fatalf("Update() returned an error: %v", err)
+	}
+	for _, key := range []string{"abandoned", "expired"} {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		count := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				record, reserved, err := repository.Reserve(ctx, IdempotencyScopeRequest, key, "b")
+				if err != nil {
+					t.Errorf("Reserve() returned an error: %v", err)
+					return
+				}
+				if reserved {
+					mu.Lock()
+					count++
+					mu.Unlock()
+					if record.RequestHash != "b" || record.Completed() {
+						t.Errorf("Reserve() %s: got %+v, want a new record", key, record)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if count != 1 {
+			t.Errorf("Reserve() %s: got %d reservations, want 1", key, count)
+		}
+	}
+}
+
+func TestPostEmailsEmailIdempotencyKeys(t *testing.T) {
+	table, _ := useMockServices(t)
+
+	first := serveRequest("POST", "/emails", map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"a@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "a"},
+		},
+	})
+	if first.Code != 201 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", first.Code, 201, first.Body.String())
+	}
+	var original BatchEmailResponseSchema
+	if err := json.Unmarshal(first.Body.Bytes(), &original); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+
+	// a batch retried with a new email only creates the new email
+	w := serveRequest("POST", "/emails", map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"a@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "a"},
+			{"recipients": []string{"b@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "b"},
+		},
+	})
+	var response BatchEmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Replayed != 1 || response.Queued != 1 || response.Emails[0].ID != original.Emails[0].ID {
+		t.Errorf("PostEmails retry: got replayed=%d queued=%d id=%v, want replayed=1 queued=1 id=%v", response.Replayed, response.Queued, response.Emails[0].ID, original.Emails[0].ID)
+	}
+
+	// reusing a key for a different email only rejects that email
+	tests := [][]map[string]interface{}{
+		{
+			{"recipients": []string{"c@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "c"},
+			{"recipients": []string{"a@example.com"}, "template": "other", "priority": 2, "idempotency_key": "a"},
+		},
+		{
+			{"recipients": []string{"d@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "d"},
+			{"recipients": []string{"e@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "d"},
+		},
+	}
+	for i, tc := range tests {
+		w := serveRequest("POST", "/emails", map[string]interface{}{"emails": tc})
+		if w.Code != 207 {
+			t.Errorf("case %d: PostEmails StatusCode: got %v, want %v", i, w.Code, 207)
+			continue
+		}
+		var response BatchEmailResponseSchema
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unmarshalling error: %v", err)
+		}
+		if result := response.Results[1]; result.Code != 409 || result.Status != BatchStatusConflict {
+			t.Errorf("case %d: result: got %v %v, want %v %v", i, result.Code, result.Status, 409, BatchStatusConflict)
+		}
+	}
+	if count := countMockEmails(t, table); count != 4 {
+		t.Errorf("stored emails: got %d, want 4", count)
+	}
+}
+
+func TestPostEmailsPartialSuccess(t *testing.T) {
+	table, _ := useMockServices(t)
+
+	w := serveRequest("POST", "/emails", map[string]interface{}{
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"now@example.com"}, "template": "welcome", "priority": 0},
+			{"recipients": []string{"invalid"}, "template": "welcome", "priority": 2},
+			{"recipients": []string{"later@example.com"}, "template": "welcome", "priority": 2},
+		},
+	})
+	if w.Code != 207 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", w.Code, 207, w.Body.String())
+	}
+	var response BatchEmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+
+	tests := []struct {
+		code   int
+		status string
+		email  bool
+	}{
+		{201, BatchStatusSent, true},
+		{400, BatchStatusInvalid, false},
+		{201, BatchStatusQueued, true},
+	}
+	if len(response.Results) != len(tests) {
+		t.Fatalf("PostEmails results: got %v, want %v", len(response.Results), len(tests))
+	}
+	for i, tc := range tests {
+		result := response.Results[i]
+		if result.Index != i || result.Code != tc.code || result.Status != tc.status || (result.Email != nil) != tc.email {
+			t.Errorf("case %d: result: got %v %v %v, want %v %v %v", i, result.Code, result.Status, result.Email != nil, tc.code, tc.status, tc.email)
+		}
+	}
+	if rules, ok := response.Results[1].Errors["emails[1].recipients[0]"]; !ok || rules["email"] != "" {
+		t.Errorf("invalid result errors: got %v, want %v", response.Results[1].Errors, "emails[1].recipients[0]")
+	}
+	if response.Sent != 1 || response.Queued != 1 || response.Unprocessed != 1 {
+		t.Errorf("PostEmails counts: got sent=%d queued=%d unprocessed=%d, want 1 1 1", response.Sent, response.Queued, response.Unprocessed)
+	}
+	if count := countMockEmails(t, table); count != 2 {
+		t.Errorf("stored emails: got %d, want 2", count)
+	}
+}
+
+func TestPostEmailsAtomic(t *testing.T) {
+	table, _ := useMockServices(t)
+
+	// one invalid email aborts the batch
+	w := serveRequest("POST", "/emails", map[string]interface{}{
+		"atomic": true,
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"a@example.com"}, "template": "welcome", "priority": 2},
+			{"recipients": []string{"b@example.com"}, "priority": 2},
+		},
+	})
+	if w.Code != 400 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", w.Code, 400, w.Body.String())
+	}
+	var response BatchEmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if status := response.Results[0].Status; status != BatchStatusAborted {
+		t.Errorf("valid result status: got %v, want %v", status, BatchStatusAborted)
+	}
+	if status := response.Results[1].Status; status != BatchStatusInvalid {
+		t.Errorf("invalid result status: got %v, want %v", status, BatchStatusInvalid)
+	}
+	if len(response.Details) != 1 || response.Details[0].Path != "emails[1].template" || response.Details[0].Rule != "required" {
+		t.Errorf("PostEmails details: got %+v, want emails[1].template required", response.Details)
+	}
+	if count := countMockEmails(t, table); count != 0 {
+		t.Errorf("stored emails: got %d, want 0", count)
+	}
+
+	// a valid batch is written together
+	w = serveRequest("POST", "/emails", map[string]interface{}{
+		"atomic": true,
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"a@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "a"},
+			{"recipients": []string{"b@example.com"}, "template": "welcome", "priority": 0},
+		},
+	})
+	if w.Code != 201 {
+		t.Fatalf("PostEmails StatusCode: got %v, want %v (%s)", w.Code, 201, w.Body.String())
+	}
+	if count := countMockEmails(t, table); count != 2 {
+		t.Errorf("stored emails: got %d, want 2", count)
+	}
+
+	// reusing a key aborts the batch and frees the keys it reserved
+	w = serveRequest("POST", "/emails", map[string]interface{}{
+		"atomic": true,
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"c@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "c"},
+			{"recipients": []string{"a@example.com"}, "template": "other", "priority": 2, "idempotency_key": "a"},
+		},
+	})
+	if w.Code != 409 {
+		t.Errorf("PostEmails reused key StatusCode: got %v, want %v", w.Code, 409)
+	}
+	w = serveRequest("POST", "/emails", map[string]interface{}{
+		"atomic": true,
+		"emails": []map[string]interface{}{
+			{"recipients": []string{"c@example.com"}, "template": "welcome", "priority": 2, "idempotency_key": "c"},
+		},
+	})
+	if w.Code != 201 {
+		t.Errorf("PostEmails released key StatusCode: got %v, want %v (%s)", w.Code, 201, w.Body.String())
+	}
+
+	// atomic batches are limited to a single transaction
+	emails := []map[string]interface{}{}
+	for i := 0; i <= store.MaxTransactionItems; i++ {
+		emails = append(emails, map[string]interface{}{"recipients": []string{"a@example.com"}, "template": "welcome", "priority": 2})
+	}
+	if w := serveRequest("POST", "/emails", map[string]interface{}{"atomic": true, "emails": emails}); w.Code != 400 {
+		t.Errorf("PostEmails oversized StatusCode: got %v, want %v", w.Code, 400)
+	}
+	if count := countMockEmails(t, table); count != 3 {
+		t.Errorf("stored emails: got %d, want 3", count)
+	}
+}
+
+func TestGetFailedEmails(t *testing.T) {
+	table, _ := useMockServices(t)
+
+	storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusFailed, FailureReason: "Invalid template", FailureClass: FailureClassPermanent})
+	storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusFailed, FailureReason: "service unavailable", FailureClass: FailureClassRetriesExhausted})
+	storeMockEmail(t, table, &Email{Recipients: []string{"c@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusQueued, Queued: time.Now()})
+
+	tests := []struct {
+		query string
+		code  int
+		count int
+	}{
+		{"", 200, 2},
+		{"?failure_class=permanent", 200, 1},
+		{"?failure_class=expired", 200, 0},
+		{"?template=other", 200, 0},
+		{"?send_status=4", 200, 2},
+		{"?send_status=1", 400, 0},
+		{"?failure_class=unknown", 400, 0},
+	}
+	for _, tc := range tests {
+		w := serveRequest("GET", "/emails/failed"+tc.query, nil)
+		if w.Code != tc.code {
+			t.Errorf("GetFailedEmails%s StatusCode: got %v, want %v", tc.query, w.Code, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var response EmailListResponseSchema
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unmarshalling error: %v", err)
+		}
+		if len(response.Emails) != tc.count {
+			t.Errorf("GetFailedEmails%s: got %d emails, want %d", tc.query, len(response.Emails), tc.count)
+		}
+		for _, email := range response.Emails {
+			if email.SendStatus != EmailStatusFailed || email.FailureReason == "" || email.FailureClass == "" {
+				t.Errorf("GetFailedEmails%s: got %+v, want a failed email with its reason and class", tc.query, email)
+			}
+		}
+	}
+}
+
+func TestRetryEmail(t *testing.T) {
+	table, exchange := useMockServices(t)
+	t.Setenv("RETRY_LIMIT", "5")
+
+	failed := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusFailed, Attempts: 5, FailureReason: "service unavailable", FailureClass: FailureClassRetriesExhausted})
+	target := "/email/" + failed.ID.String() + "/retry"
+
+	// attempts are reset and the retry is noted in the audit log
+	w := serveRequest("POST", target, map[string]interface{}{"note": "Provider outage is over"})
+	if w.Code != 200 {
+		t.Fatalf("RetryEmail StatusCode: got %v, want %v (%s)", w.Code, 200, w.Body.String())
+	}
+	var response RetryEmailResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	email := response.Email
+	if response.Status != BatchStatusQueued || email.SendStatus != EmailStatusQueued || email.Attempts != 0 || email.FailureReason != "" || email.FailureClass != "" {
+		t.Errorf("RetryEmail: got %s %+v, want a queued email with no attempts or failure", response.Status, email)
+	}
+	if len(email.AuditLog) != 1 {
+		t.Fatalf("RetryEmail audit log: got %d entries, want 1", len(email.AuditLog))
+	}
+	entry := email.AuditLog[0]
+	if entry.Action != AuditActionRetry || entry.Note != "Provider outage is over" || entry.SendStatus != EmailStatusFailed || entry.Attempts != 5 || entry.FailureReason != "service unavailable" {
+		t.Errorf("RetryEmail audit entry: got %+v, want the retry and the failure it replaced", entry)
+	}
+
+	// only failed emails can be retried
+	if w := serveRequest("POST", target, nil); w.Code != 409 {
+		t.Errorf("RetryEmail queued StatusCode: got %v, want %v", w.Code, 409)
+	}
+
+	// priority 0 sends the email now, with a single attempt left
+	failed = storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusFailed, Attempts: 1, FailureClass: FailureClassPermanent})
+	w = serveRequest("POST", "/email/"+failed.ID.String()+"/retry", map[string]interface{}{"attempts": "single", "priority": 0})
+	if w.Code != 200 {
+		t.Fatalf("RetryEmail StatusCode: got %v, want %v (%s)", w.Code, 200, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Status != BatchStatusSent || response.Email.SendStatus != EmailStatusComplete || response.Email.Attempts != 5 || len(exchange.sent) != 1 {
+		t.Errorf("RetryEmail now: got %s %+v, want a sent email on its last attempt", response.Status, response.Email)
+	}
+
+	// emails can't be retried to suppressed recipients, or with an invalid policy
+	failed = storeMockEmail(t, table, &Email{Recipients: []string{"c@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusFailed, FailureClass: FailureClassSuppressed})
+	storeMockSuppression(t, "c@example.com")
+	if w := serveRequest("POST", "/email/"+failed.ID.String()+"/retry", nil); w.Code != 409 {
+		t.Errorf("RetryEmail suppressed StatusCode: got %v, want %v", w.Code, 409)
+	}
+	if w := serveRequest("POST", "/email/"+failed.ID.String()+"/retry", map[string]interface{}{"attempts": "some"}); w.Code != 400 {
+		t.Errorf("RetryEmail invalid StatusCode: got %v, want %v", w.Code, 400)
+	}
+}
+
+func TestRetryEmails(t *testing.T) {
+	table, exchange := useMockServices(t)
+
+	for i := 0; i < 3; i++ {
+		storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusFailed, Attempts: 5, FailureClass: FailureClassRetriesExhausted})
+	}
+	storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", Priority: 2, SendStatus: EmailStatusFailed, FailureClass: FailureClassPermanent})
+	storeMockEmail(t, table, &Email{Recipients: []string{"c@example.com"}, Template: "digest", Priority: 2, SendStatus: EmailStatusFailed, Attempts: 5, FailureClass: FailureClassRetriesExhausted})
+
+	// only matching emails are retried, up to the limit
+	w := serveRequest("POST", "/emails/retry", map[string]interface{}{
+		"template":      "welcome",
+		"failure_class": "retries_exhausted",
+		"limit":         2,
+		"note":          "Provider outage is over",
+	})
+	if w.Code != 200 {
+		t.Fatalf("RetryEmails StatusCode: got %v, want %v (%s)", w.Code, 200, w.Body.String())
+	}
+	var response RetryEmailsResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if len(response.Emails) != 2 || response.Queued != 2 || response.Skipped != 0 || !response.HasMore {
+		t.Errorf("RetryEmails: got %d emails (%d queued, %d skipped, more %v), want 2 queued and more", len(response.Emails), response.Queued, response.Skipped, response.HasMore)
+	}
+	for _, email := range response.Emails {
+		if email.Template != "welcome" || email.SendStatus != EmailStatusQueued || len(email.AuditLog) != 1 || email.AuditLog[0].Note != "Provider outage is over" {
+			t.Errorf("RetryEmails: got %+v, want a queued welcome email with an audit entry", email)
+		}
+	}
+
+	// the rest are retried next
+	w = serveRequest("POST", "/emails/retry", map[string]interface{}{"template": "welcome", "failure_class": "retries_exhausted"})
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Queued != 1 || response.HasMore {
+		t.Errorf("RetryEmails: got %d queued (more %v), want 1", response.Queued, response.HasMore)
+	}
+
+	// urgent emails are queued too, rather than sent during the request
+	storeMockEmail(t, table, &Email{Recipients: []string{"d@example.com"}, Template: "receipt", Priority: 0, SendStatus: EmailStatusFailed, Attempts: 5, FailureClass: FailureClassRetriesExhausted})
+	w = serveRequest("POST", "/emails/retry", map[string]interface{}{"template": "receipt"})
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if response.Queued != 1 || exchange.sentCount() != 0 {
+		t.Errorf("RetryEmails priority 0: got %d queued and %d sent, want 1 queued and none sent", response.Queued, exchange.sentCount())
+	}
+	if len(response.Emails) == 1 && (response.Emails[0].SendStatus != EmailStatusQueued || response.Emails[0].Priority != 0) {
+		t.Errorf("RetryEmails priority 0: got status %d priority %d, want queued with priority 0", response.Emails[0].SendStatus, response.Emails[0].Priority)
+	}
+
+	// invalid filters are rejected
+	if w := serveRequest("POST", "/emails/retry", map[string]interface{}{"failure_class": "unknown"}); w.Code != 400 {
+		t.Errorf("RetryEmails invalid StatusCode: got %v, want %v", w.Code, 400)
+	}
+
+	w = serveRequest("GET", "/emails/failed", nil)
+	var failed EmailListResponseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &failed); err != nil {
+		t.Fatalf("Unmarshalling error: %v", err)
+	}
+	if len(failed.Emails) != 2 {
+		t.Errorf("GetFailedEmails: got %d emails, want 2", len(failed.Emails))
+	}
+}
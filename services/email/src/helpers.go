@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"carrier.microservices.go/src/lib/datetime"
 	es "carrier.microservices.go/src/lib/email"
+	"carrier.microservices.go/src/lib/retry"
 	"carrier.microservices.go/src/lib/store"
 )
 
@@ -22,9 +33,146 @@ func GetQueryParamInt64(r *http.Request, key string, def int64) (int64, error) {
 	return value, err
 }
 
-// SendEmail sends an email via the supplied service
-func SendEmail(exchange es.EmailExchange, email *Email, emailRepository *EmailRepository) bool {
+// GetQueryParamString parses a string value from the URL query string, using a default if not present
+func GetQueryParamString(r *http.Request, key string, def string) string {
+	if r.URL.Query().Has(key) {
+		return r.URL.Query().Get(key)
+	}
+	return def
+}
+
+// GetQueryParamTime parses an ISO 8601 datetime or date from the URL query string; returns a zero time if not
+// present
+func GetQueryParamTime(r *http.Request, key string) (time.Time, error) {
+	if !r.URL.Query().Has(key) {
+		return time.Time{}, nil
+	}
+	value := r.URL.Query().Get(key)
+	for _, layout := range []string{datetime.ISO8601Datetime, time.RFC3339, datetime.ISO8601Date} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", value)
+}
+
+// cursorSecret returns the key used to sign list cursors handed out to clients
+func cursorSecret() []byte {
+	return []byte(os.Getenv("CURSOR_SECRET"))
+}
+
+// cursorScope identifies the listing a cursor belongs to: the kind of item, the index the datastore reads, and the
+// query, so a cursor is only accepted for the same listing it came from
+func cursorScope(ds store.Datastore, kind string, query *store.Query) (string, error) {
+	plan, err := ds.Plan(query)
+	if err != nil {
+		return "", err
+	}
+	return kind + ":" + plan.Index + ":" + requestHash(query), nil
+}
+
+// idempotencyTTL returns how long idempotency keys are remembered
+func idempotencyTTL() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL")); err == nil && hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// requestHash fingerprints a decoded request payload, so a reused idempotency key can be told apart from a retry
+func requestHash(payload interface{}) string {
+	body, _ := json.Marshal(payload)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyConflict returns why a request can't reuse an idempotency key's record, or an empty string if the
+// record's result can be returned
+func idempotencyConflict(record *IdempotencyRecord, requestHash string) string {
+	if record.RequestHash != requestHash {
+		return "Idempotency key was used with a different request"
+	}
+	if !record.Completed() {
+		return "A request with this idempotency key is in progress"
+	}
+	return ""
+}
+
+// ifMatch reports whether If-Match header values match an entity tag: "*" matches any, otherwise one of the listed
+// tags must be the same strong tag, as weak tags never match (RFC 7232)
+func ifMatch(values []string, etag string) bool {
+	header := strings.TrimSpace(strings.Join(values, ","))
+	if header == "*" {
+		return true
+	}
+	for header != "" {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			break
+		}
+		weak := strings.HasPrefix(header, "W/")
+		if weak {
+			header = header[2:]
+		}
+		if !strings.HasPrefix(header, "\"") {
+			return false // malformed list
+		}
+		end := strings.Index(header[1:], "\"")
+		if end < 0 {
+			return false
+		}
+		tag := header[:end+2]
+		header = strings.TrimLeft(header[end+2:], " \t")
+		if header != "" && header[0] != ',' {
+			return false
+		}
+		if !weak && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// responseRecorder passes a response through while keeping a copy, so it can be saved
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+// WriteHeader records and sends the status code
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	rec.statusCode = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records and sends part of the body
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// outcomeTimeout bounds saving the outcome of work that may have run out of time
+const outcomeTimeout = 5 * time.Second
+
+// outcomeContext returns a context for saving the outcome of work whose own context may be done, so an interrupted
+// send or delivery is still recorded
+func outcomeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), outcomeTimeout)
+}
+
+// SendEmail sends an email via the supplied service; returns whether it was sent and, if not, the exchange error. A
+// failed send is queued for its next attempt by the retry policies, or failed once the attempt limit is reached or
+// the policy gives up, in the same update that records the attempt. A send interrupted by the context is returned
+// to the queue as it was, to be retried without backoff and without counting as an attempt
+func SendEmail(ctx context.Context, exchange es.EmailExchange, email *Email, emailRepository *EmailRepository, suppressionRepository *SuppressionRepository, policies *retry.Policies, attemptLimit int) (bool, error) {
 	var err error
+	var permanentErr *es.PermanentError
+	var rateLimitErr *es.RateLimitError
+	var deadlineErr *es.DeadlineError
 
 	sent := false
 
@@ -40,28 +188,280 @@ func SendEmail(exchange es.EmailExchange, email *Email, emailRepository *EmailRe
 		Substitutions: email.Substitutions,
 	}
 
-	// send email and update record
-	err = exchange.Send(&exEmail) // comment out this line to mock sending an email successfully
+	// drop suppressed recipients, failing the email if none are left
+	var sendErr error
+	failureClass := FailureClassPermanent
+	suppressed, err := suppressionRepository.Suppressed(ctx, email.Recipients)
 	if err != nil {
-		logger.Errorf("Email exchange error: %s\n", err)
-		changeSet["send_status"] = EmailStatusQueued
+		sendErr = &es.TransientError{Reason: fmt.Sprintf("Unable to check suppression list: %s", err), Err: err}
+		if ctx.Err() != nil {
+			sendErr = &es.DeadlineError{Reason: fmt.Sprintf("Send interrupted: %s", err), Err: ctx.Err()}
+		}
+	} else {
+		email.Suppressed = suppressed
+		changeSet["suppressed"] = suppressed
+		exEmail.Recipients = withoutAddresses(email.Recipients, suppressed)
+		if len(exEmail.Recipients) == 0 {
+			sendErr = &es.PermanentError{Reason: "All recipients are suppressed"}
+			failureClass = FailureClassSuppressed
+		}
+	}
+
+	// send email and update record
+	start := time.Now()
+	if sendErr == nil {
+		sendErr = exchange.Send(ctx, &exEmail) // comment out this line to mock sending an email successfully
 	} else {
-		logger.Debugw("SparkPost transmission successful.")
+		exEmail.LastAttemptAt = time.Now()
+	}
+	attempt := SendAttempt{
+		Number:    email.Attempts + 1,
+		At:        exEmail.LastAttemptAt,
+		Provider:  exEmail.Provider,
+		Outcome:   AttemptOutcomeSent,
+		ServiceID: exEmail.ID,
+		Accepted:  exEmail.Accepted,
+		Rejected:  exEmail.Rejected,
+		Duration:  time.Since(start).Milliseconds(),
+	}
+	if attempt.At.IsZero() {
+		attempt.At = start
+	}
+	if sendErr != nil {
+		logger.Errorf("Email exchange error: %s\n", sendErr)
+		changeSet["failure_reason"] = sendErr.Error()
+		attempt.Error = sendErr.Error()
+		switch {
+		case errors.As(sendErr, &permanentErr):
+
+			// retrying will not help, fail now
+			email.Queued = time.Time{}
+			changeSet["send_status"] = EmailStatusFailed
+			changeSet["queued"] = email.Queued
+			changeSet["failure_class"] = failureClass
+			attempt.Outcome = AttemptOutcomeFailed
+		case errors.As(sendErr, &rateLimitErr):
+
+			// retry no sooner than the service asked for
+			email.Queued = time.Now().Add(rateLimitErr.RetryAfter)
+			changeSet["send_status"] = EmailStatusQueued
+			changeSet["queued"] = email.Queued
+			attempt.Outcome = AttemptOutcomeRateLimited
+		case errors.As(sendErr, &deadlineErr):
+
+			// the send ran out of time, which says nothing about the email or the service, so it doesn't count
+			delete(changeSet, "attempts")
+			delete(changeSet, "failure_reason")
+			changeSet["send_status"] = EmailStatusQueued
+			attempt.Outcome = AttemptOutcomeInterrupted
+		default:
+			attempt.Outcome = AttemptOutcomeError
+
+			// the retry policy builds on the attempt being recorded
+			attempted := *email
+			attempted.Attempts++
+			attempted.AttemptHistory = withAttempt(email.AttemptHistory, attempt)
+			next, ok := nextAttemptDate(&attempted, policies)
+			switch {
+			case attempted.Attempts >= attemptLimit:
+
+				// failed too many times, do not attempt again
+				email.Queued = time.Time{}
+				changeSet["send_status"] = EmailStatusFailed
+				changeSet["failure_class"] = FailureClassRetriesExhausted
+			case !ok:
+
+				// the retry policy's time is up, do not attempt again
+				email.Queued = time.Time{}
+				changeSet["send_status"] = EmailStatusFailed
+				changeSet["failure_class"] = FailureClassExpired
+			default:
+
+				// push it back in the queue until its next attempt
+				email.Queued = next
+				changeSet["send_status"] = EmailStatusQueued
+			}
+			changeSet["queued"] = email.Queued
+		}
+	} else {
+		logger.Debugw("Email transmission successful.")
 		email.Queued = time.Time{}
 		changeSet["send_status"] = EmailStatusComplete
 		changeSet["service_id"] = exEmail.ID
+		changeSet["provider"] = exEmail.Provider
 		changeSet["accepted"] = exEmail.Accepted
 		changeSet["rejected"] = exEmail.Rejected
 		changeSet["queued"] = email.Queued
+		changeSet["failure_reason"] = ""
 		sent = true
 	}
 	changeSet["last_attempt_at"] = exEmail.LastAttemptAt
+	changeSet["attempt_history"] = withAttempt(email.AttemptHistory, attempt)
 
-	// save again with transmission data
-	err = emailRepository.Update(email, changeSet)
+	// save again with transmission data, even if the send ran out of time
+	saveCtx, cancel := outcomeContext()
+	defer cancel()
+	err = emailRepository.Update(saveCtx, email, changeSet)
 	if err != nil {
 		logger.Errorf("Unable to update email: %v", err)
 	}
 
+	return sent, sendErr
+}
+
+// enqueue sets the status of an email that is created or retried: claimed to be sent now if its priority is 0,
+// otherwise queued, or failed if every recipient is suppressed
+func enqueue(email *Email, suppressed []string) {
+	email.Suppressed = suppressed
+	email.Queued = time.Now()
+	email.FailureReason = ""
+	email.FailureClass = ""
+
+	if len(suppressed) == len(email.Recipients) {
+		email.SendStatus = EmailStatusFailed
+		email.Queued = time.Time{}
+		email.FailureReason = "All recipients are suppressed"
+		email.FailureClass = FailureClassSuppressed
+	} else if email.Priority == EmailPriorityNow {
+		email.SendStatus = EmailStatusProcessing
+	} else {
+		email.SendStatus = EmailStatusQueued
+	}
+}
+
+// emailSender sends emails during a request; the exchange is only initialized if an email is sent
+type emailSender struct {
+	emailRepository       *EmailRepository
+	suppressionRepository *SuppressionRepository
+	exchange              es.EmailExchange
+	initialized           bool
+}
+
+// send sends an email claimed by the request; returns whether it was sent
+func (s *emailSender) send(ctx context.Context, email *Email) bool {
+	if s.exchange == nil {
+		s.exchange = ctx.Value(keyEmailExchange).(func() es.EmailExchange)()
+		if err := s.exchange.Init(); err != nil {
+			logger.Errorf("Cannot create email exchange: %s\n", err)
+		} else {
+			logger.Debugw("Initialized email exchange")
+			s.initialized = true
+		}
+	}
+	if !s.initialized {
+		return false
+	}
+	logger.Debugw("Sending email synchronously")
+	sent, _ := SendEmail(ctx, s.exchange, email, s.emailRepository, s.suppressionRepository, retryPolicies(), retryLimit())
 	return sent
 }
+
+// ErrNotFailed is returned when an email that is not failed is retried
+var ErrNotFailed = errors.New("only failed emails can be retried")
+
+// ErrAllSuppressed is returned when an email is retried while all of its recipients are still suppressed
+var ErrAllSuppressed = errors.New("all recipients are suppressed")
+
+// retryEmail puts a failed email back in the queue the way PostEmails queues a new one, noting the retry in its
+// audit log; attempts are reset, or set so only one is left. Priority 0 emails are sent right away if sendNow is
+// set, otherwise left for the scheduled job. Returns the batch status of the email; a conflict means the email
+// changed since it was read
+func retryEmail(ctx context.Context, email *Email, payload RetryEmailRequestSchema, sender *emailSender, sendNow bool) (string, error) {
+	if email.SendStatus != EmailStatusFailed {
+		return "", ErrNotFailed
+	}
+
+	// suppressed recipients are still skipped, but there must be someone left to send to
+	suppressed, err := sender.suppressionRepository.Suppressed(ctx, email.Recipients)
+	if err != nil {
+		return "", err
+	}
+	if len(suppressed) == len(email.Recipients) {
+		return "", ErrAllSuppressed
+	}
+
+	attempts := 0
+	if payload.Attempts == RetryAttemptsSingle {
+		if attempts = retryLimit() - 1; attempts < 0 {
+			attempts = 0
+		}
+	}
+
+	// queue a copy, so the repository still sees the email's previous status
+	retried := *email
+	if payload.Priority != nil {
+		retried.Priority = *payload.Priority
+	}
+	enqueue(&retried, suppressed)
+	if retried.SendStatus == EmailStatusProcessing && !sendNow {
+		retried.SendStatus = EmailStatusQueued
+	}
+
+	entry := AuditEntry{
+		At:            time.Now(),
+		Action:        AuditActionRetry,
+		Note:          payload.Note,
+		SendStatus:    email.SendStatus,
+		Attempts:      email.Attempts,
+		FailureReason: email.FailureReason,
+	}
+	err = sender.emailRepository.UpdateWhere(ctx, email, store.ChangeSet{
+		"send_status":    retried.SendStatus,
+		"priority":       retried.Priority,
+		"queued":         retried.Queued,
+		"suppressed":     retried.Suppressed,
+		"attempts":       attempts,
+		"failure_reason": retried.FailureReason,
+		"failure_class":  retried.FailureClass,
+		"audit_log":      withAuditEntry(email.AuditLog, entry),
+	}, store.ConditionSet{"send_status": EmailStatusFailed})
+	if err != nil {
+		return "", err
+	}
+
+	// cleared attributes are removed, which leaves their old values on the email
+	email.FailureReason = retried.FailureReason
+	email.FailureClass = retried.FailureClass
+
+	if email.SendStatus == EmailStatusProcessing && sender.send(ctx, email) {
+		return BatchStatusSent, nil
+	}
+	return BatchStatusQueued, nil
+}
+
+// withoutAddresses returns the addresses that are not in the excluded list
+func withoutAddresses(addresses, excluded []string) []string {
+	skip := map[string]bool{}
+	for _, address := range excluded {
+		skip[normalizeAddress(address)] = true
+	}
+	remaining := []string{}
+	for _, address := range addresses {
+		if !skip[normalizeAddress(address)] {
+			remaining = append(remaining, address)
+		}
+	}
+	return remaining
+}
+
+// sparkPostHardBounceClasses are the SparkPost bounce classes that mean an address will never accept email
+var sparkPostHardBounceClasses = map[string]bool{
+	"10": true, // invalid recipient
+	"30": true, // generic bounce: no RCPT
+	"90": true, // unsubscribe
+}
+
+// suppressionReason returns why a delivery event's recipient should be suppressed, or an empty string if it shouldn't
+func suppressionReason(event *es.DeliveryEvent) string {
+	switch event.Type {
+	case "bounce", "out_of_band":
+		if sparkPostHardBounceClasses[event.BounceClass] {
+			return SuppressionReasonHardBounce
+		}
+	case "spam_complaint":
+		return SuppressionReasonSpamComplaint
+	case "list_unsubscribe", "link_unsubscribe":
+		return SuppressionReasonUnsubscribe
+	}
+	return ""
+}
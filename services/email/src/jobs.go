@@ -2,134 +2,691 @@ package main
 
 import (
 	"context"
+	"errors"
 	"math"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"carrier.microservices.go/src/lib/callback"
 	emailService "carrier.microservices.go/src/lib/email"
+	"carrier.microservices.go/src/lib/retry"
 	"carrier.microservices.go/src/lib/store"
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
-// EmailQueue ...
+// EmailQueue sends due queued emails, draining each priority in turn from the most urgent; emails scheduled for
+// later never hold up due ones, and each priority is first given a share of the run so none of them starves
 func EmailQueue(ctx context.Context, cloudWatchEvent events.CloudWatchEvent) {
-	var emailExchange emailService.EmailExchange
-	var err error
 
 	logger.Debugf("CloudWatch event: EmailQueue: %+v", cloudWatchEvent)
 
+	summary := newQueueRun().run(ctx)
+	logger.Infow("Email queue run finished",
+		"Claimed", summary.Claimed,
+		"Sent", summary.Sent,
+		"Requeued", summary.Requeued,
+		"Failed", summary.Failed,
+		"StopReason", summary.StopReason,
+	)
+}
+
+// queueBatchSize is the most due emails EmailQueue fetches at once
+const queueBatchSize = 25
+
+// Reasons an EmailQueue run stopped
+const (
+	QueueStopLimit    = "limit reached"
+	QueueStopEmpty    = "queue empty"
+	QueueStopDeadline = "deadline"
+	QueueStopError    = "error"
+)
+
+// QueueSummary counts what an EmailQueue run did with the emails it claimed, and why it stopped
+type QueueSummary struct {
+	Claimed    int
+	Sent       int
+	Requeued   int
+	Failed     int
+	StopReason string
+}
+
+// queueRun is the state of one EmailQueue run; emails are fetched by a single dispatcher and sent by a pool of
+// workers
+type queueRun struct {
+	limit                 int
+	attemptLimit          int
+	concurrency           int
+	limiter               *sendLimiter
+	policies              *retry.Policies
+	margin                time.Duration
+	reserve               time.Duration
+	deadline              time.Time
+	counter               int
+	sends                 map[int]int
+	exchange              emailService.EmailExchange
+	emailRepository       *EmailRepository
+	suppressionRepository *SuppressionRepository
+
+	work    chan *Email
+	pending sync.WaitGroup
+	mutex   sync.Mutex
+	summary QueueSummary
+}
+
+// newQueueRun creates a run configured from ENV
+func newQueueRun() *queueRun {
 	limit, _ := strconv.Atoi(os.Getenv("JOB_SEND_LIMIT"))
-	attemptLimit, _ := strconv.Atoi(os.Getenv("RETRY_LIMIT"))
-	counter := 0
-	continueLoop := true
-	exchangeInitialized := false
 
-	// get email repository
-	emailRepository := NewEmailRepository(store.NewDynamoDBTable(db, os.Getenv("EMAILS_TABLE")))
+	// get email and suppression repositories
+	return &queueRun{
+		limit:                 limit,
+		attemptLimit:          retryLimit(),
+		concurrency:           queueConcurrency(),
+		limiter:               &sendLimiter{interval: sendInterval()},
+		policies:              retryPolicies(),
+		margin:                deadlineMargin(),
+		reserve:               outcomeTimeout,
+		sends:                 map[int]int{},
+		emailRepository:       NewEmailRepository(newEmailDatastore()).WithCallbacks(NewCallbackRepository(newCallbackDatastore())),
+		suppressionRepository: NewSuppressionRepository(newSuppressionDatastore()),
+	}
+}
 
-	// main loop
-	for continueLoop && counter < limit {
+// run sends due emails through the worker pool and returns what was done with them; no email is claimed once the
+// context's deadline is within the margin, and sends in flight are interrupted in time to save their outcome
+func (q *queueRun) run(ctx context.Context) QueueSummary {
+	sendCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		q.deadline = deadline
+		sendCtx, cancel = context.WithDeadline(ctx, deadline.Add(-q.reserve))
+		defer cancel()
+	}
+
+	// start workers, each logging through its own logger
+	q.work = make(chan *Email)
+	var workers sync.WaitGroup
+	for i := 1; i <= q.concurrency; i++ {
+		workers.Add(1)
+		go func(log *zap.SugaredLogger) {
+			defer workers.Done()
+			for email := range q.work {
+				q.send(sendCtx, log, email)
+				q.pending.Done()
+			}
+		}(logger.With("Worker", i))
+	}
 
-		counter++
+	q.dispatch(ctx)
+	close(q.work)
+	workers.Wait()
+	return q.summary
+}
 
-		// get exchange from context if not initialized
-		if emailExchange == nil {
-			emailExchange = &emailService.SparkPostExchange{}
-			err = emailExchange.Init()
-			if err != nil {
-				logger.Errorf("Cannot create email exchange: %s\n", err)
+// dispatch hands due emails to the workers, each priority's share first, then the rest of the limit in priority
+// order
+func (q *queueRun) dispatch(ctx context.Context) {
+	for _, share := range []int{priorityShare(q.limit), q.limit} {
+		for priority := EmailPriorityNow; priority <= EmailPriorityLowest; priority++ {
+			if !q.drain(ctx, priority, share) {
 				return
 			}
-			logger.Debugw("Initialized email exchange")
-			exchangeInitialized = true
-		}
-
-		// get email from top of queue and try to send
-		if exchangeInitialized {
-
-			// retrieve the first queued email (as list)
-			emails, err := emailRepository.List(
-				1,
-				1,
-				map[string]interface{}{
-					"index": os.Getenv("EMAIL_QUEUE_INDEX"),
-					"query": "send_status = :send_status",
-					"expressionAttributeValues": map[string]*dynamodb.AttributeValue{
-						":send_status": {
-							N: aws.String(strconv.Itoa(EmailStatusQueued)),
-						},
-					},
-				},
-			)
-			if err != nil {
+		}
+	}
+	if q.counter >= q.limit {
+		q.stop(QueueStopLimit)
+	} else {
+		q.stop(QueueStopEmpty)
+	}
+}
+
+// drain sends the due emails of a priority, a batch at a time, until it has had share sends this run or the run
+// reaches its limit; returns false if the run can't go on
+func (q *queueRun) drain(ctx context.Context, priority int, share int) bool {
+	for q.counter < q.limit && q.sends[priority] < share {
+		if q.outOfTime() {
+			q.stop(QueueStopDeadline)
+			return false
+		}
+
+		// retrieve a batch of the longest due emails of this priority
+		batch := q.limit - q.counter
+		if share-q.sends[priority] < batch {
+			batch = share - q.sends[priority]
+		}
+		if batch > queueBatchSize {
+			batch = queueBatchSize
+		}
+		emails, _, err := q.emailRepository.ListDue(ctx, priority, time.Now(), int64(batch), "")
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Warnw("List queued emails interrupted", "Error", err)
+				q.stop(QueueStopDeadline)
+			} else {
 				logger.Errorf("List queued emails error: %v", err)
-				return
+				q.stop(QueueStopError)
 			}
+			return false
+		}
+		if len(emails) == 0 {
+			return true // no more due emails of this priority
+		}
+		logger.Debugf("Due emails: (%d) priority %d", len(emails), priority)
+
+		// get exchange if not initialized; workers share it
+		if q.exchange == nil {
+			emailExchange := newEmailExchange()
+			if err := emailExchange.Init(); err != nil {
+				logger.Errorf("Cannot create email exchange: %s\n", err)
+				q.stop(QueueStopError)
+				return false
+			}
+			logger.Debugw("Initialized email exchange")
+			q.exchange = emailExchange
+		}
+
+		// hand the batch to the workers, and wait for it so the next batch doesn't fetch the same emails
+		for _, email := range emails {
+			if q.isStopped() || q.outOfTime() {
+				break
+			}
+			q.counter++
+			q.sends[priority]++
+			q.pending.Add(1)
+			q.work <- email
+		}
+		q.pending.Wait()
+		if q.outOfTime() {
+			q.stop(QueueStopDeadline)
+		}
+		if q.isStopped() {
+			return false
+		}
+	}
+	return true
+}
+
+// send claims a due email, sends it and records the outcome; a send that runs out of time stops the run
+func (q *queueRun) send(ctx context.Context, log *zap.SugaredLogger, email *Email) {
+	var permanentErr *emailService.PermanentError
+	var rateLimitErr *emailService.RateLimitError
+	var deadlineErr *emailService.DeadlineError
+
+	// wait for the run's turn to send, before the email is claimed; no new work is claimed once the run is stopping
+	if err := q.limiter.Wait(ctx); err != nil || q.outOfTime() {
+		q.stop(QueueStopDeadline)
+		return
+	}
+	if q.isStopped() {
+		return
+	}
+
+	// claim email by setting its status to processing
+	err := q.emailRepository.Claim(ctx, email)
+	if err != nil {
+		switch err.(type) {
+		case *store.ConflictError:
+			log.Infow("Email claimed by another worker", "ID", email.ID)
+		default:
+			log.Errorf("Unable to claim email: %v", err)
+		}
+		return
+	}
+	q.record(QueueSummary{Claimed: 1})
+
+	// send email
+	sent, sendErr := SendEmail(ctx, q.exchange, email, q.emailRepository, q.suppressionRepository, q.policies, q.attemptLimit)
+	if sent {
+		q.record(QueueSummary{Sent: 1})
+		return
+	}
 
-			// if have emails in queue send
-			if len(emails) > 0 {
+	if errors.As(sendErr, &permanentErr) {
 
-				var emailIDs []uuid.UUID
-				for _, email := range emails {
-					emailIDs = append(emailIDs, email.ID)
+		// failed permanently, already removed from the queue
+		log.Infow("Email failed permanently", "ID", email.ID, "Reason", email.FailureReason)
+		q.record(QueueSummary{Failed: 1})
+	} else if errors.As(sendErr, &rateLimitErr) {
+
+		// already pushed back in the queue until the service accepts sends again
+		log.Infow("Email rate limited", "ID", email.ID, "Queued", email.Queued)
+		q.record(QueueSummary{Requeued: 1})
+	} else if errors.As(sendErr, &deadlineErr) {
+
+		// already returned to the queue as it was; the provider never answered, so it wasn't an attempt
+		log.Infow("Email send interrupted", "ID", email.ID, "Reason", sendErr)
+		q.record(QueueSummary{Requeued: 1})
+	} else if email.SendStatus == EmailStatusFailed {
+
+		// failed too many times, or for too long, already removed from the queue
+		log.Infow("Email failed", "ID", email.ID, "FailureClass", email.FailureClass, "Reason", email.FailureReason)
+		q.record(QueueSummary{Failed: 1})
+	} else {
+
+		// already pushed back in the queue until its next attempt
+		log.Infow("Email requeued", "ID", email.ID, "Queued", email.Queued)
+		q.record(QueueSummary{Requeued: 1})
+	}
+
+	// there's no time left for more sends
+	if errors.As(sendErr, &deadlineErr) {
+		q.stop(QueueStopDeadline)
+	}
+}
+
+// record adds a worker's outcome to the run's summary
+func (q *queueRun) record(outcome QueueSummary) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.summary.Claimed += outcome.Claimed
+	q.summary.Sent += outcome.Sent
+	q.summary.Requeued += outcome.Requeued
+	q.summary.Failed += outcome.Failed
+}
+
+// stop keeps the run from claiming more emails; the first reason given is the one reported
+func (q *queueRun) stop(reason string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.summary.StopReason == "" {
+		q.summary.StopReason = reason
+	}
+}
+
+func (q *queueRun) isStopped() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.summary.StopReason != ""
+}
+
+// outOfTime reports whether the run's deadline is within the safety margin, leaving too little time to claim and
+// send another email
+func (q *queueRun) outOfTime() bool {
+	return !q.deadline.IsZero() && time.Until(q.deadline) < q.margin
+}
+
+// sendLimiter spaces out the sends of all of a run's workers; a zero interval doesn't limit them
+type sendLimiter struct {
+	interval time.Duration
+
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// Wait blocks until the next send is allowed, or returns the context's error if it's done first
+func (l *sendLimiter) Wait(ctx context.Context) error {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mutex.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deadlineMargin is how long before the Lambda's deadline EmailQueue stops claiming emails, from
+// JOB_DEADLINE_MARGIN seconds
+func deadlineMargin() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("JOB_DEADLINE_MARGIN")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 15 * time.Second
+}
+
+// queueConcurrency is the number of emails EmailQueue sends at once
+func queueConcurrency() int {
+	if concurrency, err := strconv.Atoi(os.Getenv("JOB_CONCURRENCY")); err == nil && concurrency > 0 {
+		return concurrency
+	}
+	return 4
+}
+
+// sendInterval is the shortest time between two sends of an EmailQueue run, from JOB_SEND_RATE sends per second;
+// a rate of 0 doesn't limit sends
+func sendInterval() time.Duration {
+	rate, err := strconv.Atoi(os.Getenv("JOB_SEND_RATE"))
+	if err != nil || rate < 0 {
+		rate = 10
+	}
+	if rate == 0 {
+		return 0
+	}
+	return time.Second / time.Duration(rate)
+}
+
+// priorityShare is the number of sends each priority is guaranteed in a run before more urgent priorities use the
+// rest of the limit, JOB_PRIORITY_SHARE percent of the limit
+func priorityShare(limit int) int {
+	percent, err := strconv.Atoi(os.Getenv("JOB_PRIORITY_SHARE"))
+	if err != nil || percent < 0 || percent > 100 {
+		percent = 10
+	}
+	return int(math.Ceil(float64(limit*percent) / 100))
+}
+
+// nextAttemptDate generates the next time to attempt a send with the retry policy of the email's template or
+// priority; returns false if the policy doesn't allow another attempt
+func nextAttemptDate(email *Email, policies *retry.Policies) (time.Time, bool) {
+
+	// the delay before the failed attempt, for policies that build on it
+	var previous time.Duration
+	if n := len(email.AttemptHistory); n > 1 {
+		previous = email.AttemptHistory[n-1].At.Sub(email.AttemptHistory[n-2].At)
+	}
+	return policies.For(email.Template, email.Priority).Next(email.CreatedAt, time.Now(), email.Attempts, previous)
+}
+
+// retryLimit is the number of times an email is attempted before it is failed
+func retryLimit() int {
+	limit, _ := strconv.Atoi(os.Getenv("RETRY_LIMIT"))
+	return limit
+}
+
+// retryPolicies reads the email retry policies from RETRY_POLICIES, or uses the default policy if there are none
+func retryPolicies() *retry.Policies {
+	if config := os.Getenv("RETRY_POLICIES"); config != "" {
+		policies, err := retry.Parse([]byte(config))
+		if err == nil {
+			return policies
+		}
+		logger.Errorf("Invalid RETRY_POLICIES, using the default policy: %v", err)
+	}
+	return &retry.Policies{Default: retry.DefaultPolicy}
+}
+
+// EmailRecovery returns emails stuck in processing, e.g. after the Lambda timed out mid-send, to the queue; emails
+// that have used up their attempts are failed instead
+func EmailRecovery(ctx context.Context, cloudWatchEvent events.CloudWatchEvent) {
+	var cursor string
+
+	logger.Debugf("CloudWatch event: EmailRecovery: %+v", cloudWatchEvent)
+
+	attemptLimit := retryLimit()
+	lease := processingLease()
+	now := time.Now()
+
+	// get email repository
+	emailRepository := NewEmailRepository(newEmailDatastore()).WithCallbacks(NewCallbackRepository(newCallbackDatastore()))
+
+	// page through all emails in processing
+	for {
+		query := store.NewQuery().UseIndex(os.Getenv("EMAIL_QUEUE_INDEX")).Where("send_status", store.Equal, EmailStatusProcessing)
+		emails, nextCursor, err := emailRepository.List(ctx, 100, cursor, query)
+		if err != nil {
+			logger.Errorf("List processing emails error: %v", err)
+			return
+		}
+
+		for _, email := range emails {
+
+			// is the email still within its processing lease?
+			leaseStart := email.UpdatedAt
+			if email.LastAttemptAt.After(leaseStart) {
+				leaseStart = email.LastAttemptAt
+			}
+			if now.Sub(leaseStart) < lease {
+				continue
+			}
+
+			// the interrupted send counts as an attempt
+			changeSet := store.ChangeSet{
+				"attempts": email.Attempts + 1,
+				"attempt_history": withAttempt(email.AttemptHistory, SendAttempt{
+					Number:  email.Attempts + 1,
+					At:      leaseStart,
+					Outcome: AttemptOutcomeInterrupted,
+					Error:   "Send did not finish within the processing lease",
+				}),
+			}
+			if email.Attempts+1 >= attemptLimit {
+				changeSet["send_status"] = EmailStatusFailed
+				changeSet["queued"] = time.Time{}
+				changeSet["failure_class"] = FailureClassRetriesExhausted
+			} else {
+				changeSet["send_status"] = EmailStatusQueued
+				changeSet["queued"] = now
+			}
+
+			// only recover the email if no worker has touched it since it was read
+			err = emailRepository.UpdateWhere(ctx, email, changeSet, store.ConditionSet{"send_status": EmailStatusProcessing})
+			if err != nil {
+				switch err.(type) {
+				case *store.ConflictError:
+					logger.Infow("Processing email changed during recovery", "ID", email.ID)
+				default:
+					logger.Errorf("Unable to recover email: %v", err)
 				}
-				logger.Debugf("Queued emails: (%d) %v", len(emailIDs), emailIDs)
-
-				// loop over queued emails and send
-				for _, email := range emails {
-
-					// is it time to send this email?
-					if time.Now().After(email.Queued) {
-
-						// set email status to processing
-						err = emailRepository.Update(email, store.ChangeSet{"send_status": EmailStatusProcessing})
-						if err != nil {
-							logger.Errorf("Unable to update email: %v", err)
-						}
-
-						// send email
-						if sent := SendEmail(emailExchange, email, emailRepository); !sent {
-
-							if email.Attempts >= attemptLimit {
-
-								// failed too many times, do not attempt again
-								err = emailRepository.Update(email, store.ChangeSet{
-									"send_status": EmailStatusFailed,
-									"queued":      time.Time{},
-								})
-								if err != nil {
-									logger.Errorf("Unable to update email: %v", err)
-								}
-							} else {
-
-								// update `queued` attribute with new date to push it back in the queue
-								err = emailRepository.Update(email, store.ChangeSet{
-									"queued": nextAttemptDate(email),
-								})
-								if err != nil {
-									logger.Errorf("Unable to update email: %v", err)
-								}
-							}
-						}
-					} else {
-						continueLoop = false // remaining emails in queue are not scheduled yet
-						break
-					}
+				continue
+			}
+
+			logger.Warnw("Recovered email stuck in processing",
+				"ID", email.ID,
+				"Attempts", email.Attempts,
+				"SendStatus", email.SendStatus,
+				"LeaseStart", leaseStart,
+			)
+		}
+
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+}
+
+// processingLease is how long an email may stay in processing before it is considered abandoned
+func processingLease() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("PROCESSING_LEASE")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	// default to twice the Lambda timeout, no send can legitimately take longer
+	timeout, err := strconv.Atoi(os.Getenv("FUNCTION_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = 180
+	}
+	return 2 * time.Duration(timeout) * time.Second
+}
+
+// CallbackQueue posts due status-change callbacks to calling services, retrying failed deliveries with backoff; no
+// callback is claimed once the context's deadline is within the margin, and deliveries in flight are interrupted in
+// time to save their outcome
+func CallbackQueue(ctx context.Context, cloudWatchEvent events.CloudWatchEvent) {
+
+	logger.Debugf("CloudWatch event: CallbackQueue: %+v", cloudWatchEvent)
+
+	// callbacks can't be verified by receivers without a secret
+	secret := os.Getenv("CALLBACK_SECRET")
+	if secret == "" {
+		logger.Errorw("Cannot deliver callbacks: CALLBACK_SECRET is not set")
+		return
+	}
+
+	limit := callbackSendLimit()
+	attemptLimit := callbackRetryLimit()
+	policy := callbackRetryPolicy()
+	client := callback.NewClient([]byte(secret), callbackTimeout())
+	counter := 0
+	stopReason := ""
+
+	// leave time to save the outcome of a delivery that runs out of time
+	deliverCtx := ctx
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		var cancel context.CancelFunc
+		deliverCtx, cancel = context.WithDeadline(ctx, deadline.Add(-outcomeTimeout))
+		defer cancel()
+	}
+	margin := deadlineMargin()
+	outOfTime := func() bool {
+		return hasDeadline && (time.Until(deadline) < margin || deliverCtx.Err() != nil)
+	}
+
+	// get callback repository
+	callbackRepository := NewCallbackRepository(newCallbackDatastore())
+
+	// main loop
+	for stopReason == "" {
+		if counter >= limit {
+			stopReason = QueueStopLimit
+			break
+		}
+		if outOfTime() {
+			stopReason = QueueStopDeadline
+			break
+		}
+
+		// retrieve the callbacks that have been due longest
+		query := store.NewQuery().UseIndex(os.Getenv("CALLBACK_QUEUE_INDEX")).Where("delivery_status", store.Equal, CallbackStatusPending)
+		callbacks, _, err := callbackRepository.List(ctx, 10, "", query)
+		if err != nil {
+			logger.Errorf("List pending callbacks error: %v", err)
+			stopReason = QueueStopError
+			break
+		}
+
+		// deliver due callbacks; claimed ones drop to the back of the queue, so each pass makes progress
+		delivered := 0
+		for _, cb := range callbacks {
+			if counter >= limit || cb.Due > callbackDue(time.Now()) {
+				break // remaining callbacks in queue are not due yet
+			}
+			if outOfTime() {
+				stopReason = QueueStopDeadline
+				break
+			}
+			counter++
+
+			// claim callback for this attempt
+			err = callbackRepository.Claim(ctx, cb, callbackTimeout()*2)
+			if err != nil {
+				switch err.(type) {
+				case *store.ConflictError:
+					logger.Infow("Callback claimed by another worker", "ID", cb.ID)
+				default:
+					logger.Errorf("Unable to claim callback: %v", err)
 				}
-			} else {
-				continueLoop = false // no more emails in queue, end loop
+				continue
 			}
+
+			DeliverCallback(deliverCtx, client, cb, callbackRepository, attemptLimit, policy)
+			delivered++
+		}
+		if delivered == 0 && stopReason == "" {
+			stopReason = QueueStopEmpty // nothing left to deliver now
+		}
+	}
+
+	logger.Infow("Callback queue run finished", "Claimed", counter, "StopReason", stopReason)
+}
+
+// DeliverCallback posts a claimed callback and records the outcome, rescheduling it with backoff if it failed; a
+// delivery interrupted by the context is rescheduled right away without using up an attempt
+func DeliverCallback(ctx context.Context, client *callback.Client, cb *Callback, callbackRepository *CallbackRepository, attemptLimit int, policy retry.Policy) {
+	result, err := client.Deliver(ctx, cb.URL, cb.ID.String(), []byte(cb.Payload))
+
+	// record attempt
+	attempt := CallbackAttempt{
+		At:         cb.LastAttemptAt,
+		StatusCode: result.StatusCode,
+		Duration:   result.Duration.Milliseconds(),
+	}
+	changeSet := store.ChangeSet{}
+	if err == nil {
+		logger.Infow("Callback delivered", "ID", cb.ID, "EmailID", cb.EmailID, "StatusCode", result.StatusCode)
+		changeSet["delivery_status"] = CallbackStatusDelivered
+		changeSet["due"] = ""
+		changeSet["failure_reason"] = ""
+	} else if ctx.Err() != nil {
+		logger.Warnw("Callback delivery interrupted", "ID", cb.ID, "EmailID", cb.EmailID, "Error", err)
+		attempt.Error = err.Error()
+		changeSet["attempts"] = cb.Attempts - 1
+		changeSet["due"] = callbackDue(time.Now())
+	} else {
+		logger.Warnw("Callback delivery failed", "ID", cb.ID, "EmailID", cb.EmailID, "Attempts", cb.Attempts, "Error", err)
+		attempt.Error = err.Error()
+		changeSet["failure_reason"] = err.Error()
+		next, ok := nextCallbackAttemptDate(cb, policy)
+		if cb.Attempts >= attemptLimit || !ok {
+
+			// failed too many times, or for too long, do not attempt again
+			changeSet["delivery_status"] = CallbackStatusFailed
+			changeSet["due"] = ""
 		} else {
-			continueLoop = false // email exchange not initialized unexpectedly
+			changeSet["due"] = callbackDue(next)
 		}
 	}
+	changeSet["history"] = withCallbackAttempt(cb.History, attempt)
+
+	// save outcome, even if the delivery ran out of time; the claim guarantees no other worker is updating the
+	// callback
+	saveCtx, cancel := outcomeContext()
+	defer cancel()
+	if err := callbackRepository.Update(saveCtx, cb, changeSet); err != nil {
+		logger.Errorf("Unable to update callback: %v", err)
+	}
+}
+
+// nextCallbackAttemptDate generates the next time to attempt a callback using its retry policy, and false if the
+// policy gives up on it
+func nextCallbackAttemptDate(cb *Callback, policy retry.Policy) (time.Time, bool) {
+
+	// the delay before the failed attempt, for policies that build on it
+	var previous time.Duration
+	if n := len(cb.History); n > 0 {
+		previous = cb.LastAttemptAt.Sub(cb.History[n-1].At)
+	}
+	return policy.Next(cb.CreatedAt, cb.LastAttemptAt, cb.Attempts-1, previous)
 }
 
-// nextAttemptDate generates the the next time to attempt a send using a backoff algorithm
-func nextAttemptDate(email *Email) time.Time {
-	return email.Queued.Add(time.Minute * time.Duration(math.Pow(2, float64(email.Attempts))))
+// callbackRetryPolicy reads the callback retry policy from CALLBACK_RETRY_POLICY, or uses the default policy
+func callbackRetryPolicy() retry.Policy {
+	if config := os.Getenv("CALLBACK_RETRY_POLICY"); config != "" {
+		policy, err := retry.ParsePolicy([]byte(config))
+		if err == nil {
+			return policy
+		}
+		logger.Errorf("Invalid CALLBACK_RETRY_POLICY, using the default policy: %v", err)
+	}
+	return retry.DefaultPolicy
+}
+
+// callbackRetryLimit is the number of times a callback is attempted before it is failed
+func callbackRetryLimit() int {
+	if limit, err := strconv.Atoi(os.Getenv("CALLBACK_RETRY_LIMIT")); err == nil && limit > 0 {
+		return limit
+	}
+	return 8
+}
+
+// callbackSendLimit is the number of callbacks CallbackQueue delivers per run
+func callbackSendLimit() int {
+	if limit, err := strconv.Atoi(os.Getenv("CALLBACK_SEND_LIMIT")); err == nil && limit >= 0 {
+		return limit
+	}
+	return 25
+}
+
+// callbackTimeout is how long a receiver has to respond to a callback
+func callbackTimeout() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("CALLBACK_TIMEOUT")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 10 * time.Second
 }
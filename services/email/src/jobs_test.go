@@ -0,0 +1,789 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"carrier.microservices.go/src/lib/callback"
+	emailService "carrier.microservices.go/src/lib/email"
+	"carrier.microservices.go/src/lib/store"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestEmailQueue(t *testing.T) {
+	table, exchange := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+
+	due1 := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 2, Queued: time.Now().Add(-time.Minute)})
+	due2 := storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(-time.Minute)})
+	later := storeMockEmail(t, table, &Email{Recipients: []string{"c@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 3, Queued: time.Now().Add(time.Hour)})
+
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	if exchange.sentCount() != 2 {
+		t.Errorf("EmailQueue sent %d emails, want 2", exchange.sentCount())
+	}
+
+	repository := NewEmailRepository(table)
+	tests := []struct {
+		email *Email
+		want  int
+	}{
+		{due1, EmailStatusComplete},
+		{due2, EmailStatusComplete},
+		{later, EmailStatusQueued},
+	}
+	for _, tc := range tests {
+		email, err := repository.Get(context.Background(), tc.email.ID)
+		if err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		if email.SendStatus != tc.want {
+			t.Errorf("SendStatus: got %d, want %d", email.SendStatus, tc.want)
+		}
+		if tc.want == EmailStatusComplete && email.Provider != "mock" {
+			t.Errorf("Provider: got %q, want %q", email.Provider, "mock")
+		}
+	}
+}
+
+func TestEmailQueueScheduledLater(t *testing.T) {
+	table, exchange := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+
+	// an urgent email scheduled for later doesn't hold up due emails of lower priorities
+	later := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(24 * time.Hour)})
+	due2 := storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 2, Queued: time.Now().Add(-time.Minute)})
+	due3 := storeMockEmail(t, table, &Email{Recipients: []string{"c@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 3, Queued: time.Now().Add(-time.Hour)})
+
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	if exchange.sentCount() != 2 {
+		t.Errorf("EmailQueue sent %d emails, want 2", exchange.sentCount())
+	}
+
+	// due emails are sent in priority order
+	if exchange.sentCount() == 2 && (exchange.sent[0].Recipients[0] != "b@example.com" || exchange.sent[1].Recipients[0] != "c@example.com") {
+		t.Errorf("EmailQueue send order: got %v then %v, want b@example.com then c@example.com", exchange.sent[0].Recipients, exchange.sent[1].Recipients)
+	}
+
+	repository := NewEmailRepository(table)
+	tests := []struct {
+		email *Email
+		want  int
+	}{
+		{later, EmailStatusQueued},
+		{due2, EmailStatusComplete},
+		{due3, EmailStatusComplete},
+	}
+	for _, tc := range tests {
+		email, err := repository.Get(context.Background(), tc.email.ID)
+		if err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		if email.SendStatus != tc.want {
+			t.Errorf("SendStatus: got %d, want %d", email.SendStatus, tc.want)
+		}
+	}
+}
+
+func TestEmailRepositoryUpdateQueuePosition(t *testing.T) {
+	table, _ := useMockServices(t)
+	repository := NewEmailRepository(table)
+	now := time.Now()
+
+	// the queue position follows the priority and queued time being written, not the ones last read
+	email := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 2, Queued: now.Add(-time.Minute)})
+	later := now.Add(time.Hour)
+	if err := repository.Update(context.Background(), email, store.ChangeSet{"priority": 1, "queued": later}); err != nil {
+		t.Fatalf("Update() returned an error: %v", err)
+	}
+	if want := priorityQueued(1, later); email.PriorityQueued != want {
+		t.Errorf("PriorityQueued: got %q, want %q", email.PriorityQueued, want)
+	}
+
+	tests := []struct {
+		priority int
+		now      time.Time
+		want     int
+	}{
+		{2, now, 0},
+		{1, now, 0},
+		{1, later, 1},
+	}
+	for _, tc := range tests {
+		emails, _, err := repository.ListDue(context.Background(), tc.priority, tc.now, 10, "")
+		if err != nil {
+			t.Fatalf("ListDue() returned an error: %v", err)
+		}
+		if len(emails) != tc.want {
+			t.Errorf("ListDue(%d, %v): got %d emails, want %d", tc.priority, tc.now, len(emails), tc.want)
+		}
+	}
+
+	// clearing the queued time takes the email out of the queue index
+	if err := repository.Update(context.Background(), email, store.ChangeSet{"queued": time.Time{}}); err != nil {
+		t.Fatalf("Update() returned an error: %v", err)
+	}
+	if email.PriorityQueued != "" {
+		t.Errorf("PriorityQueued: got %q, want empty", email.PriorityQueued)
+	}
+}
+
+func TestEmailQueuePriorityShare(t *testing.T) {
+	table, exchange := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "4")
+	t.Setenv("RETRY_LIMIT", "5")
+	t.Setenv("JOB_PRIORITY_SHARE", "25")
+
+	// more urgent email is due than the run can send, the lowest priority still gets its share
+	for i := 0; i < 6; i++ {
+		storeMockEmail(t, table, &Email{Recipients: []string{fmt.Sprintf("%d@example.com", i)}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(-time.Minute)})
+	}
+	low := storeMockEmail(t, table, &Email{Recipients: []string{"low@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 3, Queued: time.Now().Add(-time.Minute)})
+
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	if exchange.sentCount() != 4 {
+		t.Errorf("EmailQueue sent %d emails, want 4", exchange.sentCount())
+	}
+	email, err := NewEmailRepository(table).Get(context.Background(), low.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusComplete {
+		t.Errorf("low priority SendStatus: got %d, want %d", email.SendStatus, EmailStatusComplete)
+	}
+
+	// without a share, the run is spent on the most urgent emails
+	table, exchange = useMockServices(t)
+	t.Setenv("JOB_PRIORITY_SHARE", "0")
+	for i := 0; i < 6; i++ {
+		storeMockEmail(t, table, &Email{Recipients: []string{fmt.Sprintf("%d@example.com", i)}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(-time.Minute)})
+	}
+	low = storeMockEmail(t, table, &Email{Recipients: []string{"low@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 3, Queued: time.Now().Add(-time.Minute)})
+
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	email, err = NewEmailRepository(table).Get(context.Background(), low.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if exchange.sentCount() != 4 || email.SendStatus != EmailStatusQueued {
+		t.Errorf("EmailQueue without share: got %d sent and low priority status %d, want 4 sent and status %d", exchange.sentCount(), email.SendStatus, EmailStatusQueued)
+	}
+}
+
+func TestEmailQueueRetry(t *testing.T) {
+	table, exchange := useMockServices(t)
+	exchange.err = errors.New("service unavailable")
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "2")
+
+	queued := time.Now().Add(-time.Minute)
+	retry := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: queued})
+	exhausted := storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: queued, Attempts: 1})
+
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	repository := NewEmailRepository(table)
+
+	// first failure is pushed back in the queue
+	email, err := repository.Get(context.Background(), retry.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusQueued || email.Attempts != 1 {
+		t.Errorf("retried email: got status=%d attempts=%d, want status=%d attempts=1", email.SendStatus, email.Attempts, EmailStatusQueued)
+	}
+	if !email.Queued.After(time.Now()) {
+		t.Errorf("retried email Queued: got %v, want later than now", email.Queued)
+	}
+
+	// the backoff is saved with the attempt, so the email is never due again in between
+	if email.Version != retry.Version+2 {
+		t.Errorf("retried email Version: got %d, want %d (claim and outcome)", email.Version, retry.Version+2)
+	}
+
+	// email that reached the retry limit is failed
+	email, err = repository.Get(context.Background(), exhausted.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusFailed || email.FailureClass != FailureClassRetriesExhausted || !email.Queued.IsZero() {
+		t.Errorf("exhausted email: got status=%d class=%q queued=%v, want status=%d class=%q", email.SendStatus, email.FailureClass, email.Queued, EmailStatusFailed, FailureClassRetriesExhausted)
+	}
+}
+
+func TestEmailQueueRetryPolicies(t *testing.T) {
+	table, exchange := useMockServices(t)
+	exchange.err = errors.New("service unavailable")
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+	t.Setenv("RETRY_POLICIES", `{"default": {"max_age": 30}, "templates": {"digest": {"strategy": "fixed", "delay": 600}}}`)
+
+	queued := time.Now().Add(-time.Minute)
+	digest := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "digest", SendStatus: EmailStatusQueued, Priority: 2, Queued: queued})
+	expired := storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 2, Queued: queued})
+
+	start := time.Now()
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	repository := NewEmailRepository(table)
+
+	// the template's policy schedules the retry
+	email, err := repository.Get(context.Background(), digest.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusQueued || email.Queued.Before(start.Add(599*time.Second)) || email.Queued.After(time.Now().Add(601*time.Second)) {
+		t.Errorf("digest email: got status=%d queued=%v, want status=%d queued 10 minutes from now", email.SendStatus, email.Queued, EmailStatusQueued)
+	}
+
+	// the default policy gives up once a retry would be too long after the email was created
+	email, err = repository.Get(context.Background(), expired.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusFailed || !email.Queued.IsZero() {
+		t.Errorf("expired email: got status=%d queued=%v, want status=%d", email.SendStatus, email.Queued, EmailStatusFailed)
+	}
+}
+
+func TestEmailQueueInterrupted(t *testing.T) {
+	table, exchange := useMockServices(t)
+	exchange.err = &emailService.DeadlineError{Reason: "Send interrupted", Err: context.DeadlineExceeded}
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+
+	queued := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	first := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: queued})
+	second := storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 2, Queued: queued})
+
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	repository := NewEmailRepository(table)
+
+	// the interrupted email is back in the queue as it was, without counting the attempt
+	email, err := repository.Get(context.Background(), first.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusQueued || email.Attempts != 0 || !email.Queued.Equal(queued) {
+		t.Errorf("interrupted email: got status=%d attempts=%d queued=%v, want status=%d attempts=0 queued=%v", email.SendStatus, email.Attempts, email.Queued, EmailStatusQueued, queued)
+	}
+	if len(email.AttemptHistory) != 1 || email.AttemptHistory[0].Outcome != AttemptOutcomeInterrupted {
+		t.Errorf("interrupted email AttemptHistory: got %+v, want one %q attempt", email.AttemptHistory, AttemptOutcomeInterrupted)
+	}
+
+	// the run stops instead of trying more emails
+	email, err = repository.Get(context.Background(), second.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if len(email.AttemptHistory) != 0 {
+		t.Errorf("second email AttemptHistory: got %+v, want no attempts", email.AttemptHistory)
+	}
+}
+
+func TestEmailQueueConcurrentRuns(t *testing.T) {
+	table, exchange := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "25")
+	t.Setenv("RETRY_LIMIT", "5")
+
+	for i := 0; i < 20; i++ {
+		storeMockEmail(t, table, &Email{
+			Recipients: []string{fmt.Sprintf("user%d@example.com", i)},
+			Template:   "welcome",
+			SendStatus: EmailStatusQueued,
+			Priority:   1 + i%3,
+			Queued:     time.Now().Add(-time.Minute),
+		})
+	}
+
+	// overlapping scheduled runs share the same queue
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			EmailQueue(context.Background(), events.CloudWatchEvent{})
+		}()
+	}
+	wg.Wait()
+
+	// every email is sent exactly once
+	sentTo := map[string]int{}
+	for _, email := range exchange.sent {
+		sentTo[email.Recipients[0]]++
+	}
+	if len(exchange.sent) != 20 || len(sentTo) != 20 {
+		t.Errorf("EmailQueue sent %d emails to %d recipients, want 20 to 20", len(exchange.sent), len(sentTo))
+	}
+	for recipient, count := range sentTo {
+		if count != 1 {
+			t.Errorf("EmailQueue sent %d emails to %s, want 1", count, recipient)
+		}
+	}
+}
+
+func TestEmailQueueWorkerPool(t *testing.T) {
+	table, exchange := useMockServices(t)
+	exchange.delay = 20 * time.Millisecond
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+	t.Setenv("JOB_CONCURRENCY", "3")
+
+	for i := 0; i < 8; i++ {
+		storeMockEmail(t, table, &Email{Recipients: []string{fmt.Sprintf("user%d@example.com", i)}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 2, Queued: time.Now().Add(-time.Minute)})
+	}
+	failed := storeMockEmail(t, table, &Email{Recipients: []string{"fail@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 3, Queued: time.Now().Add(-time.Minute)})
+	storeMockSuppression(t, "fail@example.com")
+
+	summary := newQueueRun().run(context.Background())
+
+	// sends overlap, but never more than the pool allows
+	if exchange.maxInFlight < 2 || exchange.maxInFlight > 3 {
+		t.Errorf("EmailQueue concurrent sends: got %d, want 2-3", exchange.maxInFlight)
+	}
+	want := QueueSummary{Claimed: 9, Sent: 8, Failed: 1, StopReason: QueueStopEmpty}
+	if summary != want {
+		t.Errorf("EmailQueue summary: got %+v, want %+v", summary, want)
+	}
+	email, err := NewEmailRepository(table).Get(context.Background(), failed.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if email.SendStatus != EmailStatusFailed {
+		t.Errorf("suppressed email SendStatus: got %d, want %d", email.SendStatus, EmailStatusFailed)
+	}
+}
+
+func TestEmailQueueDeadline(t *testing.T) {
+	table, exchange := useMockServices(t)
+	exchange.delay = time.Second
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+	t.Setenv("JOB_CONCURRENCY", "2")
+	t.Setenv("JOB_PRIORITY_SHARE", "0")
+
+	// every email is on its last attempt
+	var emails []*Email
+	for i := 0; i < 4; i++ {
+		emails = append(emails, storeMockEmail(t, table, &Email{Recipients: []string{fmt.Sprintf("user%d@example.com", i)}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Attempts: 4, Queued: time.Now().Add(-time.Minute)}))
+	}
+
+	// nothing is claimed when the deadline is already within the margin
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	run := newQueueRun()
+	run.margin = 200 * time.Millisecond
+	summary := run.run(ctx)
+	if want := (QueueSummary{StopReason: QueueStopDeadline}); summary != want {
+		t.Errorf("EmailQueue summary: got %+v, want %+v", summary, want)
+	}
+
+	// slow sends are interrupted in time to return their emails to the queue, without counting as attempts, and
+	// no more are claimed
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	run = newQueueRun()
+	run.margin = 100 * time.Millisecond
+	run.reserve = 100 * time.Millisecond
+	summary = run.run(ctx)
+	if want := (QueueSummary{Claimed: 2, Requeued: 2, StopReason: QueueStopDeadline}); summary != want {
+		t.Errorf("EmailQueue summary: got %+v, want %+v", summary, want)
+	}
+
+	repository := NewEmailRepository(table)
+	interrupted := 0
+	for _, e := range emails {
+		email, err := repository.Get(context.Background(), e.ID)
+		if err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		if email.SendStatus != EmailStatusQueued || email.Attempts != 4 {
+			t.Errorf("SendStatus, Attempts: got %d, %d, want %d, %d", email.SendStatus, email.Attempts, EmailStatusQueued, 4)
+		}
+		interrupted += len(email.AttemptHistory)
+	}
+	if interrupted != 2 {
+		t.Errorf("interrupted attempts: got %d, want 2", interrupted)
+	}
+}
+
+func TestEmailQueueListInterrupted(t *testing.T) {
+	table, _ := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(-time.Minute)})
+
+	// listing due emails fails once the context is done, which is the deadline rather than an error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if summary := newQueueRun().run(ctx); summary.StopReason != QueueStopDeadline || summary.Claimed != 0 {
+		t.Errorf("EmailQueue summary: got %+v, want stop reason %q", summary, QueueStopDeadline)
+	}
+}
+
+func TestSendLimiter(t *testing.T) {
+	limiter := &sendLimiter{interval: 20 * time.Millisecond}
+
+	// the first send goes right away, the rest are spaced out
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() returned an error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Wait() elapsed: got %v, want at least %v", elapsed, 60*time.Millisecond)
+	}
+
+	// waiting ends when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() error: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestEmailRecovery(t *testing.T) {
+	table, _ := useMockServices(t)
+	t.Setenv("RETRY_LIMIT", "3")
+	t.Setenv("PROCESSING_LEASE", "300")
+
+	// processing emails whose last activity was `age` ago
+	createProcessingEmail := func(attempts int, age time.Duration) *Email {
+		email := storeMockEmail(t, table, &Email{
+			Recipients: []string{"a@example.com"},
+			Template:   "welcome",
+			SendStatus: EmailStatusProcessing,
+			Priority:   1,
+			Queued:     time.Now().Add(-age),
+			Attempts:   attempts,
+		})
+		err := table.Update(context.Background(), email.ID, email, store.ChangeSet{
+			"updated_at":      time.Now().Add(-age),
+			"last_attempt_at": time.Now().Add(-age),
+		})
+		if err != nil {
+			t.Fatalf("Update() returned an error: %v", err)
+		}
+		return email
+	}
+
+	tests := []struct {
+		email        *Email
+		wantStatus   int
+		wantAttempts int
+	}{
+		{createProcessingEmail(0, time.Hour), EmailStatusQueued, 1},
+		{createProcessingEmail(2, time.Hour), EmailStatusFailed, 3},
+		{createProcessingEmail(0, time.Minute), EmailStatusProcessing, 0},
+	}
+
+	EmailRecovery(context.Background(), events.CloudWatchEvent{})
+
+	repository := NewEmailRepository(table)
+	for i, tc := range tests {
+		email, err := repository.Get(context.Background(), tc.email.ID)
+		if err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		if email.SendStatus != tc.wantStatus || email.Attempts != tc.wantAttempts {
+			t.Errorf("case %d: got status=%d attempts=%d, want status=%d attempts=%d", i, email.SendStatus, email.Attempts, tc.wantStatus, tc.wantAttempts)
+		}
+		if tc.wantStatus == EmailStatusQueued && time.Since(email.Queued) > time.Minute {
+			t.Errorf("case %d: recovered email Queued: got %v, want about now", i, email.Queued)
+		}
+		if recovered := tc.wantAttempts > tc.email.Attempts; recovered && (len(email.AttemptHistory) != 1 || email.AttemptHistory[0].Outcome != AttemptOutcomeInterrupted) {
+			t.Errorf("case %d: AttemptHistory: got %+v, want one interrupted attempt", i, email.AttemptHistory)
+		}
+	}
+}
+
+func TestEmailQueueErrorClasses(t *testing.T) {
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+
+	tests := []struct {
+		err         error
+		wantStatus  int
+		wantQueued  time.Duration
+		wantMessage string
+	}{
+		{&emailService.PermanentError{Reason: "unknown template"}, EmailStatusFailed, 0, "unknown template"},
+		{&emailService.RateLimitError{Reason: "slow down", RetryAfter: time.Hour}, EmailStatusQueued, time.Hour, "slow down"},
+		{&emailService.TransientError{Reason: "unavailable"}, EmailStatusQueued, 0, "unavailable"},
+	}
+
+	for i, tc := range tests {
+		table, exchange := useMockServices(t)
+		exchange.err = tc.err
+		email := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(-time.Minute)})
+
+		EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+		result, err := NewEmailRepository(table).Get(context.Background(), email.ID)
+		if err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		if result.SendStatus != tc.wantStatus {
+			t.Errorf("case %d SendStatus: got %d, want %d", i, result.SendStatus, tc.wantStatus)
+		}
+		if result.Attempts != 1 {
+			t.Errorf("case %d Attempts: got %d, want 1", i, result.Attempts)
+		}
+		if result.FailureReason != tc.wantMessage {
+			t.Errorf("case %d FailureReason: got %q, want %q", i, result.FailureReason, tc.wantMessage)
+		}
+		if tc.wantQueued > 0 && time.Until(result.Queued) < tc.wantQueued-time.Minute {
+			t.Errorf("case %d Queued: got %v, want about %v from now", i, result.Queued, tc.wantQueued)
+		}
+	}
+}
+
+func TestEmailQueueSuppressed(t *testing.T) {
+	table, exchange := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "10")
+	t.Setenv("RETRY_LIMIT", "5")
+
+	partial := storeMockEmail(t, table, &Email{Recipients: []string{"a@example.com", "b@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(-time.Minute)})
+	full := storeMockEmail(t, table, &Email{Recipients: []string{"b@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now().Add(-time.Minute)})
+
+	// suppressed after the emails were queued
+	storeMockSuppression(t, "b@example.com")
+
+	EmailQueue(context.Background(), events.CloudWatchEvent{})
+
+	if exchange.sentCount() != 1 || len(exchange.sent[0].Recipients) != 1 || exchange.sent[0].Recipients[0] != "a@example.com" {
+		t.Fatalf("EmailQueue sent %+v, want one email to a@example.com", exchange.sent)
+	}
+
+	repository := NewEmailRepository(table)
+	tests := []struct {
+		email      *Email
+		wantStatus int
+		wantReason string
+	}{
+		{partial, EmailStatusComplete, ""},
+		{full, EmailStatusFailed, "All recipients are suppressed"},
+	}
+	for i, tc := range tests {
+		email, err := repository.Get(context.Background(), tc.email.ID)
+		if err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		if email.SendStatus != tc.wantStatus || email.FailureReason != tc.wantReason {
+			t.Errorf("case %d: got status=%d reason=%q, want status=%d reason=%q", i, email.SendStatus, email.FailureReason, tc.wantStatus, tc.wantReason)
+		}
+		if len(email.Suppressed) != 1 || email.Suppressed[0] != "b@example.com" {
+			t.Errorf("case %d Suppressed: got %v, want [b@example.com]", i, email.Suppressed)
+		}
+	}
+}
+
+func TestCallbackQueue(t *testing.T) {
+	table, _ := useMockServices(t)
+	t.Setenv("CALLBACK_SEND_LIMIT", "10")
+	t.Setenv("CALLBACK_RETRY_LIMIT", "2")
+	t.Setenv("CALLBACK_SECRET", "secret")
+
+	// receiver verifies signatures and accepts callbacks for the first email only
+	var mu sync.Mutex
+	received := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := callback.Verify(r.Header.Get(callback.SignatureHeader), body, []byte("secret"), time.Minute); err != nil {
+			t.Errorf("Verify() returned an error: %v", err)
+		}
+		mu.Lock()
+		received[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	repository := NewEmailRepository(table).WithCallbacks(NewCallbackRepository(newCallbackDatastore()))
+	for _, path := range []string{"/ok", "/down"} {
+		email := &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now(), CallbackURL: server.URL + path}
+		if err := repository.Store(context.Background(), email); err != nil {
+			t.Fatalf("Store() returned an error: %v", err)
+		}
+	}
+
+	CallbackQueue(context.Background(), events.CloudWatchEvent{})
+
+	callbacks := listMockCallbacks(t)
+	if len(callbacks) != 2 {
+		t.Fatalf("callbacks: got %d, want 2", len(callbacks))
+	}
+	for _, cb := range callbacks {
+		switch {
+		case strings.HasSuffix(cb.URL, "/ok"):
+			if cb.DeliveryStatus != CallbackStatusDelivered || cb.Due != "" || cb.Attempts != 1 || len(cb.History) != 1 || cb.History[0].StatusCode != 200 {
+				t.Errorf("delivered callback: got %+v", cb)
+			}
+		default:
+			if cb.DeliveryStatus != CallbackStatusPending || cb.Due <= callbackDue(time.Now()) || cb.Attempts != 1 || len(cb.History) != 1 || cb.History[0].StatusCode != 503 {
+				t.Errorf("retried callback: got %+v", cb)
+			}
+		}
+	}
+
+	// the failing callback is not due again yet; once it is, the retry limit fails it
+	CallbackQueue(context.Background(), events.CloudWatchEvent{})
+	if received["/down"] != 1 {
+		t.Errorf("callback attempts before backoff elapsed: got %d, want 1", received["/down"])
+	}
+	for _, cb := range listMockCallbacks(t) {
+		if cb.DeliveryStatus == CallbackStatusPending {
+			if err := NewCallbackRepository(newCallbackDatastore()).Update(context.Background(), cb, store.ChangeSet{"due": callbackDue(time.Now().Add(-time.Second))}); err != nil {
+				t.Fatalf("Update() returned an error: %v", err)
+			}
+		}
+	}
+	CallbackQueue(context.Background(), events.CloudWatchEvent{})
+	for _, cb := range listMockCallbacks(t) {
+		if strings.HasSuffix(cb.URL, "/down") && (cb.DeliveryStatus != CallbackStatusFailed || cb.Attempts != 2 || len(cb.History) != 2) {
+			t.Errorf("failed callback: got %+v", cb)
+		}
+	}
+	if received["/ok"] != 1 || received["/down"] != 2 {
+		t.Errorf("callbacks received: got %v, want /ok=1 /down=2", received)
+	}
+}
+
+func TestCallbackQueueSendLimit(t *testing.T) {
+	table, _ := useMockServices(t)
+	t.Setenv("JOB_SEND_LIMIT", "0")
+	t.Setenv("CALLBACK_SEND_LIMIT", "1")
+	t.Setenv("CALLBACK_SECRET", "secret")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	repository := NewEmailRepository(table).WithCallbacks(NewCallbackRepository(newCallbackDatastore()))
+	for _, address := range []string{"a@example.com", "b@example.com"} {
+		email := &Email{Recipients: []string{address}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now(), CallbackURL: server.URL}
+		if err := repository.Store(context.Background(), email); err != nil {
+			t.Fatalf("Store() returned an error: %v", err)
+		}
+	}
+
+	// callbacks have their own limit, whatever the email send limit
+	CallbackQueue(context.Background(), events.CloudWatchEvent{})
+	delivered := 0
+	for _, cb := range listMockCallbacks(t) {
+		if cb.DeliveryStatus == CallbackStatusDelivered {
+			delivered++
+		}
+	}
+	if delivered != 1 {
+		t.Errorf("CallbackQueue delivered %d callbacks, want 1", delivered)
+	}
+}
+
+func TestCallbackQueueRetryPolicy(t *testing.T) {
+	table, _ := useMockServices(t)
+	t.Setenv("CALLBACK_SEND_LIMIT", "10")
+	t.Setenv("CALLBACK_SECRET", "secret")
+	t.Setenv("CALLBACK_RETRY_POLICY", `{"strategy": "fixed", "delay": 30}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	repository := NewEmailRepository(table).WithCallbacks(NewCallbackRepository(newCallbackDatastore()))
+	email := &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now(), CallbackURL: server.URL}
+	if err := repository.Store(context.Background(), email); err != nil {
+		t.Fatalf("Store() returned an error: %v", err)
+	}
+
+	// failed deliveries are rescheduled by the configured policy
+	before := time.Now()
+	CallbackQueue(context.Background(), events.CloudWatchEvent{})
+	for _, cb := range listMockCallbacks(t) {
+		if cb.DeliveryStatus != CallbackStatusPending || cb.Due < callbackDue(before.Add(29*time.Second)) || cb.Due > callbackDue(time.Now().Add(31*time.Second)) {
+			t.Errorf("retried callback: got due %s, want about 30s after the attempt", cb.Due)
+		}
+	}
+}
+
+func TestCallbackQueueDeadline(t *testing.T) {
+	table, _ := useMockServices(t)
+	t.Setenv("CALLBACK_SEND_LIMIT", "10")
+	t.Setenv("CALLBACK_SECRET", "secret")
+
+	var mu sync.Mutex
+	received := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received++
+		mu.Unlock()
+		<-release // never answers in time
+	}))
+	defer server.Close()
+	defer close(release)
+
+	repository := NewEmailRepository(table).WithCallbacks(NewCallbackRepository(newCallbackDatastore()))
+	email := &Email{Recipients: []string{"a@example.com"}, Template: "welcome", SendStatus: EmailStatusQueued, Priority: 1, Queued: time.Now(), CallbackURL: server.URL}
+	if err := repository.Store(context.Background(), email); err != nil {
+		t.Fatalf("Store() returned an error: %v", err)
+	}
+
+	// nothing is claimed when the deadline is already within the margin
+	t.Setenv("JOB_DEADLINE_MARGIN", "1")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	CallbackQueue(ctx, events.CloudWatchEvent{})
+	mu.Lock()
+	if cbs := listMockCallbacks(t); received != 0 || len(cbs) != 1 || cbs[0].Attempts != 0 {
+		t.Errorf("callbacks delivered within the margin: got %d requests, want none", received)
+	}
+	mu.Unlock()
+
+	// a slow delivery is interrupted in time to put the callback back, without counting as an attempt
+	t.Setenv("JOB_DEADLINE_MARGIN", "0")
+	ctx, cancel = context.WithTimeout(context.Background(), outcomeTimeout+300*time.Millisecond)
+	defer cancel()
+	CallbackQueue(ctx, events.CloudWatchEvent{})
+	if ctx.Err() != nil {
+		t.Errorf("CallbackQueue ran past its deadline")
+	}
+	for _, cb := range listMockCallbacks(t) {
+		if cb.DeliveryStatus != CallbackStatusPending || cb.Attempts != 0 || len(cb.History) != 1 || cb.Due > callbackDue(time.Now()) {
+			t.Errorf("interrupted callback: got %+v", cb)
+		}
+	}
+}
+
+func TestCallbackHistoryLimit(t *testing.T) {
+	history := make([]CallbackAttempt, maxCallbackAttempts, maxCallbackAttempts+1) // room to append in place
+	for i := range history {
+		history[i].StatusCode = 500 + i
+	}
+
+	// the oldest attempt is dropped, and the callback's own history is left as it was
+	got := withCallbackAttempt(history, CallbackAttempt{StatusCode: 200})
+	if len(got) != maxCallbackAttempts || got[0].StatusCode != 501 || got[len(got)-1].StatusCode != 200 {
+		t.Errorf("withCallbackAttempt: got %d attempts from %d to %d, want %d from 501 to 200", len(got), got[0].StatusCode, got[len(got)-1].StatusCode, maxCallbackAttempts)
+	}
+	if spare := history[:maxCallbackAttempts+1][maxCallbackAttempts]; spare.StatusCode != 0 {
+		t.Errorf("withCallbackAttempt wrote into the history it was given: got %+v", spare)
+	}
+}
@@ -0,0 +1,64 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// EventIDHeader is the request header holding the callback event's ID, for receivers to detect duplicates
+const EventIDHeader = "X-Carrier-Event-ID"
+
+// Result describes a callback delivery attempt
+type Result struct {
+	StatusCode int
+	Duration   time.Duration
+}
+
+// Client delivers signed callbacks
+type Client struct {
+	HTTPClient *http.Client
+	Secret     []byte
+	UserAgent  string
+}
+
+// NewClient creates a callback client signing with the secret
+func NewClient(secret []byte, timeout time.Duration) *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: timeout},
+		Secret:     secret,
+		UserAgent:  "Carrier-Callback/1.0",
+	}
+}
+
+// Deliver POSTs a JSON payload to the URL; any response other than 2xx is an error. The request is abandoned when
+// the context is done
+func (c *Client) Deliver(ctx context.Context, url string, eventID string, payload []byte) (Result, error) {
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+	req.Header.Set(EventIDHeader, eventID)
+	req.Header.Set(SignatureHeader, Sign(payload, c.Secret, start))
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return Result{Duration: time.Since(start)}, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10)) // allow the connection to be reused
+
+	result := Result{StatusCode: res.StatusCode, Duration: time.Since(start)}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return result, fmt.Errorf("callback returned HTTP %d", res.StatusCode)
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package callback
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the request header holding the callback signature
+const SignatureHeader = "X-Carrier-Signature"
+
+// ErrInvalidSignature is returned when a signature header is malformed, doesn't match the payload or is too old
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Sign generates the signature header value for a payload sent at the timestamp: `t=<unix seconds>,v1=<hex
+// HMAC-SHA256 of "<unix seconds>.<payload>">`
+func Sign(payload []byte, secret []byte, timestamp time.Time) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(sign(t, payload, secret)))
+}
+
+// Verify checks a signature header created by Sign; signatures older than the tolerance are rejected to prevent
+// replays, unless the tolerance is 0
+func Verify(header string, payload []byte, secret []byte, tolerance time.Duration) error {
+	var t string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case "v1":
+			signature, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return ErrInvalidSignature
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+
+	seconds, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && time.Since(time.Unix(seconds, 0)) > tolerance {
+		return ErrInvalidSignature
+	}
+
+	expected := sign(t, payload, secret)
+	for _, signature := range signatures {
+		if hmac.Equal(signature, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// sign generates an HMAC-SHA256 signature of the timestamped payload
+func sign(timestamp string, payload []byte, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
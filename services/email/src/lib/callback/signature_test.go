@@ -0,0 +1,38 @@
+package callback
+
+import (
+	"testing"
+	"time"
+)
+
+// tests that signatures verify only with the right payload, secret and age
+func TestSignVerify(t *testing.T) {
+	type test struct {
+		header    string
+		payload   string
+		secret    string
+		tolerance time.Duration
+		want      error
+	}
+
+	payload := `{"id":"1"}`
+	now := time.Now()
+	header := Sign([]byte(payload), []byte("secret"), now)
+	old := Sign([]byte(payload), []byte("secret"), now.Add(-time.Hour))
+
+	tests := []test{
+		{header, payload, "secret", 5 * time.Minute, nil},
+		{header, `{"id":"2"}`, "secret", 5 * time.Minute, ErrInvalidSignature},
+		{header, payload, "other", 5 * time.Minute, ErrInvalidSignature},
+		{old, payload, "secret", 5 * time.Minute, ErrInvalidSignature},
+		{old, payload, "secret", 0, nil},
+		{"v1=abc", payload, "secret", 0, ErrInvalidSignature},
+		{"garbage", payload, "secret", 0, ErrInvalidSignature},
+	}
+
+	for i, tc := range tests {
+		if err := Verify(tc.header, []byte(tc.payload), []byte(tc.secret), tc.tolerance); err != tc.want {
+			t.Errorf("case %d: Verify() was incorrect: got %v, expected %v", i, err, tc.want)
+		}
+	}
+}
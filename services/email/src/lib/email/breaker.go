@@ -0,0 +1,106 @@
+package mail
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker stops traffic to a failing service after Threshold consecutive failures; after Cooldown a single
+// probe is let through, which closes the circuit if it succeeds or opens it again if it fails
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown, now: time.Now}
+}
+
+// State returns the current state of the circuit
+func (b *CircuitBreaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state()
+}
+
+func (b *CircuitBreaker) state() string {
+	if b.openUntil.IsZero() {
+		return CircuitClosed
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+// Allow reports whether a request may be sent; in the half-open state only one probe is allowed at a time
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state() {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		b.probing = true
+		return true
+	}
+	return false
+}
+
+// Success records a successful request and closes the circuit
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// Failure records a failed request, opening the circuit once the threshold is reached or if a probe failed
+func (b *CircuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.probing || b.failures >= b.Threshold {
+		b.open(b.Cooldown)
+	}
+}
+
+// Release ends a request that neither succeeded nor failed, e.g. one that was cancelled; if it was the half-open
+// probe, another probe is allowed
+func (b *CircuitBreaker) Release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+// Trip opens the circuit immediately for at least the wait, e.g. when the service asks to slow down
+func (b *CircuitBreaker) Trip(wait time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if wait < b.Cooldown {
+		wait = b.Cooldown
+	}
+	b.open(wait)
+}
+
+func (b *CircuitBreaker) open(wait time.Duration) {
+	b.openUntil = b.now().Add(wait)
+	b.probing = false
+}
@@ -0,0 +1,80 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// PermanentError is a send failure that will not succeed if retried, such as an unknown template or a rejected
+// recipient
+type PermanentError struct {
+	Reason string
+	Err    error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Reason
+}
+
+// Unwrap returns the underlying service error
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// TransientError is a send failure that may succeed if retried later, such as a network error or service outage
+type TransientError struct {
+	Reason string
+	Err    error
+}
+
+func (e *TransientError) Error() string {
+	return e.Reason
+}
+
+// Unwrap returns the underlying service error
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// RateLimitError is a send failure caused by exceeding the service's sending rate; the send should be retried
+// no sooner than RetryAfter from now
+type RateLimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Reason
+}
+
+// Unwrap returns the underlying service error
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// DeadlineError is a send interrupted because its context was cancelled or its deadline passed. It says nothing
+// about the email or the service, and the email may have been sent before the send was interrupted
+type DeadlineError struct {
+	Reason string
+	Err    error
+}
+
+func (e *DeadlineError) Error() string {
+	return e.Reason
+}
+
+// Unwrap returns the context error, context.DeadlineExceeded or context.Canceled
+func (e *DeadlineError) Unwrap() error {
+	return e.Err
+}
+
+// deadlineError reports a send that failed once its context was done as a DeadlineError, since services report an
+// interrupted request like any other network error; returns nil if the context is not done
+func deadlineError(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return &DeadlineError{Reason: fmt.Sprintf("Send interrupted: %s (%s)", ctx.Err(), err), Err: ctx.Err()}
+}
@@ -1,6 +1,9 @@
 package mail
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -13,10 +16,32 @@ type Email struct {
 	Accepted      int
 	Rejected      int
 	LastAttemptAt time.Time
+	Provider      string
 }
 
-// EmailExchange is a generic interface for an email service
+// EmailExchange is a generic interface for an email service; a send gives up when its context is done
 type EmailExchange interface {
 	Init() error
-	Send(email *Email) error
+	Send(ctx context.Context, email *Email) error
+}
+
+// NewExchange creates an uninitialized email exchange for the named provider; defaults to SparkPost. A comma separated
+// list of providers creates a FailoverExchange.
+func NewExchange(provider string) (EmailExchange, error) {
+	if strings.Contains(provider, ",") {
+		exchange, err := NewFailoverExchange(strings.Split(provider, ",")...)
+		if err != nil {
+			return nil, err
+		}
+		return exchange, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(provider)) {
+	case "", "sparkpost":
+		return &SparkPostExchange{}, nil
+	case "ses":
+		return &SESExchange{}, nil
+	case "smtp":
+		return &SMTPExchange{}, nil
+	}
+	return nil, fmt.Errorf("unknown email provider: %s", provider)
 }
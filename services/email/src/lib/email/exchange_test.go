@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"fmt"
+	"testing"
+)
+
+// tests that providers are selected by name
+func TestNewExchange(t *testing.T) {
+	type test struct {
+		provider string
+		want     string
+	}
+
+	tests := []test{
+		{"", "*mail.SparkPostExchange"},
+		{"sparkpost", "*mail.SparkPostExchange"},
+		{"SES", "*mail.SESExchange"},
+		{"smtp", "*mail.SMTPExchange"},
+		{"sparkpost, ses", "*mail.FailoverExchange"},
+		{"sparkpost,mailgun", ""},
+		{"mailgun", ""},
+	}
+
+	for _, tc := range tests {
+		exchange, err := NewExchange(tc.provider)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("NewExchange(%q) did not return an error", tc.provider)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewExchange(%q) returned an error: %v", tc.provider, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", exchange); got != tc.want {
+			t.Errorf("NewExchange(%q) was incorrect: got %s, expected %s", tc.provider, got, tc.want)
+		}
+	}
+}
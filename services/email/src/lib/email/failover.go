@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default circuit breaker settings, overridden by CIRCUIT_BREAKER_THRESHOLD and CIRCUIT_BREAKER_COOLDOWN
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = time.Minute
+)
+
+// FailoverProvider is an email exchange used by a FailoverExchange, with its own circuit breaker
+type FailoverProvider struct {
+	Name     string
+	Exchange EmailExchange
+	Breaker  *CircuitBreaker
+}
+
+// FailoverExchange sends emails through the first available provider of an ordered list; a provider whose circuit
+// breaker has tripped is skipped until it is probed again
+type FailoverExchange struct {
+	Providers []*FailoverProvider
+
+	mutex       sync.Mutex
+	initialized bool
+}
+
+// NewFailoverExchange creates an uninitialized failover exchange for the named providers, in order of preference
+func NewFailoverExchange(names ...string) (*FailoverExchange, error) {
+	ex := &FailoverExchange{}
+	for _, name := range names {
+		exchange, err := NewExchange(name)
+		if err != nil {
+			return nil, err
+		}
+		ex.Providers = append(ex.Providers, &FailoverProvider{
+			Name:     strings.ToLower(strings.TrimSpace(name)),
+			Exchange: exchange,
+			Breaker:  NewCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown),
+		})
+	}
+	return ex, nil
+}
+
+// Init initializes each provider; the exchange keeps breaker state between sends, so providers are only initialized
+// once
+func (ex *FailoverExchange) Init() error {
+	ex.mutex.Lock()
+	defer ex.mutex.Unlock()
+
+	if ex.initialized {
+		return nil
+	}
+
+	// get circuit breaker configuration from ENV
+	threshold, _ := strconv.Atoi(os.Getenv("CIRCUIT_BREAKER_THRESHOLD"))
+	cooldown, _ := strconv.Atoi(os.Getenv("CIRCUIT_BREAKER_COOLDOWN"))
+
+	for _, provider := range ex.Providers {
+		if err := provider.Exchange.Init(); err != nil {
+			return err
+		}
+		if threshold > 0 {
+			provider.Breaker.Threshold = threshold
+		}
+		if cooldown > 0 {
+			provider.Breaker.Cooldown = time.Duration(cooldown) * time.Second
+		}
+	}
+
+	ex.initialized = true
+	return nil
+}
+
+// Send sends an email through the first provider that accepts it; errors caused by the email itself, or by the
+// context being done, are returned without trying other providers
+func (ex *FailoverExchange) Send(ctx context.Context, email *Email) error {
+	var lastErr error
+	var permanentErr *PermanentError
+	var rateLimitErr *RateLimitError
+	var deadlineErr *DeadlineError
+
+	for _, provider := range ex.Providers {
+		if err := ctx.Err(); err != nil {
+			return &DeadlineError{Reason: fmt.Sprintf("Send interrupted: %s", err), Err: err}
+		}
+		if !provider.Breaker.Allow() {
+			continue
+		}
+
+		err := provider.Exchange.Send(ctx, email)
+		switch {
+		case err == nil:
+			provider.Breaker.Success()
+			return nil
+		case errors.As(err, &permanentErr):
+			provider.Breaker.Success() // the provider is working, the email is not
+			return err
+		case errors.As(err, &deadlineErr):
+			provider.Breaker.Release() // the provider ran out of time, it didn't fail
+			return err
+		case errors.As(err, &rateLimitErr):
+			provider.Breaker.Trip(rateLimitErr.RetryAfter)
+		default:
+			provider.Breaker.Failure()
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return &TransientError{Reason: "All email providers are unavailable"}
+	}
+	return lastErr
+}
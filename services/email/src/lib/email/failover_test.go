@@ -0,0 +1,136 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stubExchange is an EmailExchange that returns a fixed error and counts sends
+type stubExchange struct {
+	name  string
+	err   error
+	sends int
+}
+
+func (ex *stubExchange) Init() error {
+	return nil
+}
+
+func (ex *stubExchange) Send(ctx context.Context, email *Email) error {
+	ex.sends++
+	email.Provider = ex.name
+	return ex.err
+}
+
+// createFailoverExchange returns a failover exchange over the stubs with a threshold of 2 and a controllable clock
+func createFailoverExchange(now *time.Time, stubs ...*stubExchange) *FailoverExchange {
+	ex := &FailoverExchange{}
+	for _, stub := range stubs {
+		breaker := NewCircuitBreaker(2, time.Minute)
+		breaker.now = func() time.Time { return *now }
+		ex.Providers = append(ex.Providers, &FailoverProvider{Name: stub.name, Exchange: stub, Breaker: breaker})
+	}
+	return ex
+}
+
+// tests that sends fail over to the next provider and the failing provider's breaker trips, then probes half-open
+func TestFailoverExchangeSend(t *testing.T) {
+	now := time.Now()
+	primary := &stubExchange{name: "primary", err: &TransientError{Reason: "unavailable"}}
+	secondary := &stubExchange{name: "secondary"}
+	ex := createFailoverExchange(&now, primary, secondary)
+
+	// failures below the threshold still try the primary first
+	for i := 0; i < 2; i++ {
+		email := &Email{}
+		if err := ex.Send(context.Background(), email); err != nil {
+			t.Fatalf("Send() returned an error: %v", err)
+		}
+		if email.Provider != "secondary" {
+			t.Errorf("Send() Provider was incorrect: got %s, expected secondary", email.Provider)
+		}
+	}
+	if primary.sends != 2 || ex.Providers[0].Breaker.State() != CircuitOpen {
+		t.Fatalf("primary: got sends=%d state=%s, expected sends=2 state=%s", primary.sends, ex.Providers[0].Breaker.State(), CircuitOpen)
+	}
+
+	// open circuit skips the primary
+	ex.Send(context.Background(), &Email{})
+	if primary.sends != 2 || secondary.sends != 3 {
+		t.Errorf("open circuit: got primary=%d secondary=%d sends, expected 2 and 3", primary.sends, secondary.sends)
+	}
+
+	// after the cooldown a failed probe opens the circuit again
+	now = now.Add(2 * time.Minute)
+	if ex.Providers[0].Breaker.State() != CircuitHalfOpen {
+		t.Errorf("after cooldown: got state=%s, expected %s", ex.Providers[0].Breaker.State(), CircuitHalfOpen)
+	}
+	ex.Send(context.Background(), &Email{})
+	if primary.sends != 3 || ex.Providers[0].Breaker.State() != CircuitOpen {
+		t.Errorf("failed probe: got sends=%d state=%s, expected sends=3 state=%s", primary.sends, ex.Providers[0].Breaker.State(), CircuitOpen)
+	}
+
+	// a successful probe closes the circuit
+	now = now.Add(2 * time.Minute)
+	primary.err = nil
+	email := &Email{}
+	ex.Send(context.Background(), email)
+	if email.Provider != "primary" || ex.Providers[0].Breaker.State() != CircuitClosed {
+		t.Errorf("successful probe: got provider=%s state=%s, expected primary and %s", email.Provider, ex.Providers[0].Breaker.State(), CircuitClosed)
+	}
+}
+
+// tests how each error class affects failover
+func TestFailoverExchangeErrors(t *testing.T) {
+	type test struct {
+		err          error
+		wantErr      bool
+		wantFailover bool
+		wantState    string
+	}
+
+	tests := []test{
+		{&PermanentError{Reason: "bad template"}, true, false, CircuitClosed},
+		{&RateLimitError{Reason: "slow down", RetryAfter: time.Hour}, false, true, CircuitOpen},
+		{&TransientError{Reason: "unavailable"}, false, true, CircuitClosed},
+		{&DeadlineError{Reason: "interrupted", Err: context.DeadlineExceeded}, true, false, CircuitClosed},
+	}
+
+	for i, tc := range tests {
+		now := time.Now()
+		primary := &stubExchange{name: "primary", err: tc.err}
+		secondary := &stubExchange{name: "secondary"}
+		ex := createFailoverExchange(&now, primary, secondary)
+
+		err := ex.Send(context.Background(), &Email{})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("case %d: got error %v, expected error: %v", i, err, tc.wantErr)
+		}
+		if (secondary.sends > 0) != tc.wantFailover {
+			t.Errorf("case %d: got %d secondary sends, expected failover: %v", i, secondary.sends, tc.wantFailover)
+		}
+		if state := ex.Providers[0].Breaker.State(); state != tc.wantState {
+			t.Errorf("case %d: got state=%s, expected %s", i, state, tc.wantState)
+		}
+	}
+}
+
+// tests the error returned when every provider fails or is unavailable
+func TestFailoverExchangeAllFailed(t *testing.T) {
+	now := time.Now()
+	primary := &stubExchange{name: "primary", err: &TransientError{Reason: "primary unavailable"}}
+	secondary := &stubExchange{name: "secondary", err: &TransientError{Reason: "secondary unavailable"}}
+	ex := createFailoverExchange(&now, primary, secondary)
+
+	var transient *TransientError
+	for i := 0; i < 2; i++ {
+		if err := ex.Send(context.Background(), &Email{}); !errors.As(err, &transient) || err.Error() != "secondary unavailable" {
+			t.Errorf("Send() with failing providers: got %v, expected the last provider's error", err)
+		}
+	}
+	if err := ex.Send(context.Background(), &Email{}); !errors.As(err, &transient) || primary.sends != 2 || secondary.sends != 2 {
+		t.Errorf("Send() with open circuits: got %v after %d and %d sends, expected TransientError after 2 and 2", err, primary.sends, secondary.sends)
+	}
+}
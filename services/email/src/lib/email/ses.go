@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+)
+
+// sesMaxDestinations is the most destinations SES accepts in one bulk request
+const sesMaxDestinations = 50
+
+// SESExchange defines an Amazon SES service
+type SESExchange struct {
+	Client           sesiface.SESAPI
+	Source           string
+	ConfigurationSet string
+}
+
+// Init initializes the SES service
+func (ex *SESExchange) Init() error {
+
+	// get SES configuration from ENV
+	ex.Source = os.Getenv("SES_SOURCE")
+	ex.ConfigurationSet = os.Getenv("SES_CONFIGURATION_SET")
+	region := os.Getenv("SES_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if ex.Source == "" {
+		return errors.New("SES_SOURCE must be set to a verified sender address")
+	}
+
+	// create new SES client; failed sends are retried by the queue with backoff, not by the SDK
+	config := &aws.Config{
+		Region:     aws.String(region),
+		MaxRetries: aws.Int(0),
+	}
+	if endpoint := os.Getenv("SES_ENDPOINT"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return err
+	}
+	ex.Client = ses.New(sess)
+	return nil
+}
+
+// Send sends an email through the service
+func (ex *SESExchange) Send(ctx context.Context, email *Email) error {
+
+	// substitutions are the template data shared by all recipients
+	substitutions := email.Substitutions
+	if substitutions == nil {
+		substitutions = map[string]string{}
+	}
+	templateData, err := json.Marshal(substitutions)
+	if err != nil {
+		return &PermanentError{Reason: fmt.Sprintf("Invalid substitutions: %s", err), Err: err}
+	}
+
+	// send each recipient their own copy, like a SparkPost transmission, in as many requests as SES needs
+	email.LastAttemptAt = time.Now()
+	email.Provider = "ses"
+	email.Accepted = 0
+	email.Rejected = 0
+	var firstFailure *ses.BulkEmailDestinationStatus
+	for start := 0; start < len(email.Recipients); start += sesMaxDestinations {
+		end := start + sesMaxDestinations
+		if end > len(email.Recipients) {
+			end = len(email.Recipients)
+		}
+		destinations := []*ses.BulkEmailDestination{}
+		for _, address := range email.Recipients[start:end] {
+			destinations = append(destinations, &ses.BulkEmailDestination{
+				Destination: &ses.Destination{ToAddresses: []*string{aws.String(address)}},
+			})
+		}
+		input := &ses.SendBulkTemplatedEmailInput{
+			Source:              aws.String(ex.Source),
+			Template:            aws.String(email.Template),
+			DefaultTemplateData: aws.String(string(templateData)),
+			Destinations:        destinations,
+		}
+		if ex.ConfigurationSet != "" {
+			input.ConfigurationSetName = aws.String(ex.ConfigurationSet)
+		}
+
+		// once any recipient has accepted the message it isn't sent again, so the rest count as rejected
+		result, err := ex.Client.SendBulkTemplatedEmailWithContext(ctx, input)
+		if err != nil {
+			if email.Accepted == 0 {
+				return sesError(ctx, err)
+			}
+			email.Rejected += len(email.Recipients) - start
+			break
+		}
+
+		// tally per-recipient results; the first accepted message identifies the send
+		for _, status := range result.Status {
+			if aws.StringValue(status.Status) == ses.BulkEmailStatusSuccess {
+				if email.Accepted == 0 {
+					email.ID = aws.StringValue(status.MessageId)
+				}
+				email.Accepted++
+			} else {
+				if firstFailure == nil {
+					firstFailure = status
+				}
+				email.Rejected++
+			}
+		}
+	}
+
+	// nothing was sent, report why
+	if email.Accepted == 0 && firstFailure != nil {
+		return sesStatusError(firstFailure)
+	}
+
+	return nil
+}
+
+// sesError classifies a failed SES request as a deadline, permanent, transient or rate limit error
+func sesError(ctx context.Context, err error) error {
+	if deadlineErr := deadlineError(ctx, err); deadlineErr != nil {
+		return deadlineErr
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return &TransientError{Reason: err.Error(), Err: err}
+	}
+	reason := fmt.Sprintf("SES error %s: %s", aerr.Code(), aerr.Message())
+
+	switch aerr.Code() {
+	case "Throttling", ses.ErrCodeLimitExceededException:
+		return &RateLimitError{Reason: reason, RetryAfter: defaultRetryAfter, Err: err}
+	case ses.ErrCodeMessageRejected,
+		ses.ErrCodeTemplateDoesNotExistException,
+		ses.ErrCodeMailFromDomainNotVerifiedException,
+		ses.ErrCodeConfigurationSetDoesNotExistException,
+		ses.ErrCodeInvalidRenderingParameterException,
+		ses.ErrCodeMissingRenderingAttributeException,
+		"InvalidParameterValue":
+		return &PermanentError{Reason: reason, Err: err}
+	}
+
+	// other client errors (e.g. credentials, paused sending) are fixed outside the email itself
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusTooManyRequests {
+		return &RateLimitError{Reason: reason, RetryAfter: defaultRetryAfter, Err: err}
+	}
+	return &TransientError{Reason: reason, Err: err}
+}
+
+// sesStatusError classifies a failed SES destination status as a permanent, transient or rate limit error
+func sesStatusError(status *ses.BulkEmailDestinationStatus) error {
+	reason := fmt.Sprintf("SES status %s: %s", aws.StringValue(status.Status), aws.StringValue(status.Error))
+	err := errors.New(reason)
+
+	switch aws.StringValue(status.Status) {
+	case ses.BulkEmailStatusAccountThrottled, ses.BulkEmailStatusAccountDailyQuotaExceeded:
+		return &RateLimitError{Reason: reason, RetryAfter: defaultRetryAfter, Err: err}
+	case ses.BulkEmailStatusMessageRejected,
+		ses.BulkEmailStatusMailFromDomainNotVerified,
+		ses.BulkEmailStatusConfigurationSetDoesNotExist,
+		ses.BulkEmailStatusTemplateDoesNotExist,
+		ses.BulkEmailStatusInvalidParameterValue:
+		return &PermanentError{Reason: reason, Err: err}
+	}
+	return &TransientError{Reason: reason, Err: err}
+}
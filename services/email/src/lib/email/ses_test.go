@@ -0,0 +1,208 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// createMockSES starts a stand-in for the SES query API that answers with a fixed response and returns an initialized
+// exchange pointed at it, along with the form values of the last request
+func createMockSES(t *testing.T, statusCode int, body string) (*SESExchange, *url.Values) {
+	var form url.Values
+	ex := createMockSESHandler(t, func(w http.ResponseWriter, request url.Values) {
+		form = request
+		w.WriteHeader(statusCode)
+		w.Write([]byte(body))
+	})
+	return ex, &form
+}
+
+// createMockSESHandler starts a stand-in for the SES query API that answers each request with a handler and returns an
+// initialized exchange pointed at it
+func createMockSESHandler(t *testing.T, handler func(w http.ResponseWriter, form url.Values)) *SESExchange {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(raw))
+		w.Header().Set("Content-Type", "text/xml")
+		handler(w, form)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("SES_REGION", "us-east-1")
+	t.Setenv("SES_ENDPOINT", server.URL)
+	t.Setenv("SES_SOURCE", "sender@example.com")
+
+	ex := &SESExchange{}
+	if err := ex.Init(); err != nil {
+		t.Fatalf("Init() returned an error: %v", err)
+	}
+	return ex
+}
+
+// tests that a templated send maps the request and per-recipient results
+func TestSESSend(t *testing.T) {
+	ex, form := createMockSES(t, 200, `<SendBulkTemplatedEmailResponse xmlns="http://ses.amazonaws.com/doc/2010-12-01/">
+  <SendBulkTemplatedEmailResult>
+    <Status>
+      <member><Status>Success</Status><MessageId>0100017c-first</MessageId></member>
+      <member><Status>MessageRejected</Status><Error>Address blacklisted.</Error></member>
+    </Status>
+  </SendBulkTemplatedEmailResult>
+  <ResponseMetadata><RequestId>a1b2c3</RequestId></ResponseMetadata>
+</SendBulkTemplatedEmailResponse>`)
+
+	email := &Email{
+		Recipients:    []string{"one@example.com", "two@example.com"},
+		Template:      "welcome",
+		Substitutions: map[string]string{"name": "Test"},
+	}
+	if err := ex.Send(context.Background(), email); err != nil {
+		t.Fatalf("Send() returned an error: %v", err)
+	}
+
+	// test request
+	expectedForm := map[string]string{
+		"Action":              "SendBulkTemplatedEmail",
+		"Source":              "sender@example.com",
+		"Template":            "welcome",
+		"DefaultTemplateData": `{"name":"Test"}`,
+		"Destinations.member.1.Destination.ToAddresses.member.1": "one@example.com",
+		"Destinations.member.2.Destination.ToAddresses.member.1": "two@example.com",
+	}
+	for key, value := range expectedForm {
+		if form.Get(key) != value {
+			t.Errorf("SES request %s was incorrect: got %q, expected %q", key, form.Get(key), value)
+		}
+	}
+
+	// test result
+	if email.ID != "0100017c-first" || email.Accepted != 1 || email.Rejected != 1 {
+		t.Errorf("Send() result was incorrect: got %+v", email)
+	}
+	if email.LastAttemptAt.IsZero() {
+		t.Errorf("Send() did not set LastAttemptAt")
+	}
+}
+
+// tests that recipients are sent in batches SES accepts, and that a failed batch doesn't fail recipients already sent
+func TestSESSendBatches(t *testing.T) {
+	type test struct {
+		recipients int
+		failFrom   int
+		requests   []int
+		id         string
+		accepted   int
+		rejected   int
+	}
+
+	tests := []test{
+		{120, 0, []int{50, 50, 20}, "message-1-0", 120, 0},
+		{120, 3, []int{50, 50, 20}, "message-1-0", 100, 20},
+		{120, 2, []int{50, 50}, "message-1-0", 50, 70},
+		{30, 0, []int{30}, "message-1-0", 30, 0},
+		{120, 1, []int{50}, "", 0, 0},
+	}
+
+	for i, tc := range tests {
+		var requests []int
+		ex := createMockSESHandler(t, func(w http.ResponseWriter, form url.Values) {
+			destinations := 0
+			for form.Get(fmt.Sprintf("Destinations.member.%d.Destination.ToAddresses.member.1", destinations+1)) != "" {
+				destinations++
+			}
+			requests = append(requests, destinations)
+			if tc.failFrom > 0 && len(requests) >= tc.failFrom {
+				w.WriteHeader(500)
+				w.Write([]byte(`<ErrorResponse><Error><Type>Receiver</Type><Code>ServiceUnavailable</Code><Message>Unavailable</Message></Error></ErrorResponse>`))
+				return
+			}
+			var members strings.Builder
+			for n := 0; n < destinations; n++ {
+				fmt.Fprintf(&members, "<member><Status>Success</Status><MessageId>message-%d-%d</MessageId></member>", len(requests), n)
+			}
+			fmt.Fprintf(w, `<SendBulkTemplatedEmailResponse xmlns="http://ses.amazonaws.com/doc/2010-12-01/">
+  <SendBulkTemplatedEmailResult><Status>%s</Status></SendBulkTemplatedEmailResult>
+</SendBulkTemplatedEmailResponse>`, members.String())
+		})
+
+		email := &Email{Template: "welcome"}
+		for n := 0; n < tc.recipients; n++ {
+			email.Recipients = append(email.Recipients, fmt.Sprintf("user%d@example.com", n))
+		}
+		err := ex.Send(context.Background(), email)
+		var transient *TransientError
+		if tc.accepted > 0 && err != nil {
+			t.Errorf("case %d: Send() returned an error: got %v, expected nil", i, err)
+		}
+		if tc.accepted == 0 && !errors.As(err, &transient) {
+			t.Errorf("case %d: Send() error was incorrect: got %T %v, expected transient error", i, err, err)
+		}
+		if fmt.Sprint(requests) != fmt.Sprint(tc.requests) {
+			t.Errorf("case %d: SES requests were incorrect: got %v, expected %v", i, requests, tc.requests)
+		}
+		if email.ID != tc.id || email.Accepted != tc.accepted || email.Rejected != tc.rejected {
+			t.Errorf("case %d: got id=%q accepted=%d rejected=%d, expected id=%q accepted=%d rejected=%d", i, email.ID, email.Accepted, email.Rejected, tc.id, tc.accepted, tc.rejected)
+		}
+	}
+}
+
+// tests that SES failures are mapped to permanent, transient and rate limit errors
+func TestSESSendErrors(t *testing.T) {
+	type test struct {
+		statusCode int
+		body       string
+		want       string
+	}
+
+	errorBody := func(code, message string) string {
+		return `<ErrorResponse><Error><Type>Sender</Type><Code>` + code + `</Code><Message>` + message + `</Message></Error><RequestId>a1b2c3</RequestId></ErrorResponse>`
+	}
+
+	tests := []test{
+		{400, errorBody("TemplateDoesNotExist", "Template welcome does not exist"), "permanent"},
+		{400, errorBody("MessageRejected", "Email address is not verified."), "permanent"},
+		{400, errorBody("Throttling", "Maximum sending rate exceeded."), "rate"},
+		{500, errorBody("InternalFailure", "Internal error"), "transient"},
+		{200, `<SendBulkTemplatedEmailResponse><SendBulkTemplatedEmailResult><Status><member><Status>AccountThrottled</Status></member></Status></SendBulkTemplatedEmailResult></SendBulkTemplatedEmailResponse>`, "rate"},
+		{200, `<SendBulkTemplatedEmailResponse><SendBulkTemplatedEmailResult><Status><member><Status>TemplateDoesNotExist</Status></member></Status></SendBulkTemplatedEmailResult></SendBulkTemplatedEmailResponse>`, "permanent"},
+	}
+
+	for _, tc := range tests {
+		ex, _ := createMockSES(t, tc.statusCode, tc.body)
+		err := ex.Send(context.Background(), &Email{Recipients: []string{"one@example.com"}, Template: "welcome"})
+
+		var permanent *PermanentError
+		var transient *TransientError
+		var rateLimited *RateLimitError
+		ok := false
+		switch tc.want {
+		case "permanent":
+			ok = errors.As(err, &permanent)
+		case "transient":
+			ok = errors.As(err, &transient)
+		case "rate":
+			ok = errors.As(err, &rateLimited)
+		}
+		if !ok {
+			t.Errorf("Send() with response %q: got %T %v, expected %s error", tc.body, err, err, tc.want)
+		}
+	}
+}
+
+// tests that a sender address is required
+func TestSESInitRequiresSource(t *testing.T) {
+	t.Setenv("SES_SOURCE", "")
+	ex := &SESExchange{}
+	if err := ex.Init(); err == nil {
+		t.Errorf("Init() without SES_SOURCE did not return an error")
+	}
+}
@@ -0,0 +1,396 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SMTP connection security modes
+const (
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+	SMTPSecurityNone     = "none"
+)
+
+// SMTP authentication mechanisms
+const (
+	SMTPAuthPlain = "plain"
+	SMTPAuthLogin = "login"
+)
+
+// SMTPExchange defines an SMTP relay service; templates are rendered locally
+type SMTPExchange struct {
+	Host      string
+	Port      string
+	Security  string
+	Auth      string
+	Username  string
+	Password  string
+	From      string
+	TLSConfig *tls.Config
+	Templates TemplateStore
+	Timeout   time.Duration
+}
+
+// Init initializes the SMTP service
+func (ex *SMTPExchange) Init() error {
+
+	// get SMTP configuration from ENV
+	ex.Host = os.Getenv("SMTP_HOST")
+	ex.Port = os.Getenv("SMTP_PORT")
+	ex.Security = strings.ToLower(os.Getenv("SMTP_SECURITY"))
+	ex.Auth = strings.ToLower(os.Getenv("SMTP_AUTH"))
+	ex.Username = os.Getenv("SMTP_USERNAME")
+	ex.Password = os.Getenv("SMTP_PASSWORD")
+	ex.From = os.Getenv("SMTP_FROM")
+	templatesPath := os.Getenv("SMTP_TEMPLATES_PATH")
+
+	// defaults
+	if ex.Security == "" {
+		ex.Security = SMTPSecurityStartTLS
+	}
+	if ex.Auth == "" {
+		ex.Auth = SMTPAuthPlain
+	}
+	if ex.Port == "" {
+		ex.Port = "587"
+		if ex.Security == SMTPSecurityTLS {
+			ex.Port = "465"
+		}
+	}
+	if templatesPath == "" {
+		templatesPath = "templates"
+	}
+
+	// validate
+	if ex.Host == "" {
+		return errors.New("SMTP_HOST must be set")
+	}
+	if _, err := netmail.ParseAddress(ex.From); err != nil {
+		return fmt.Errorf("SMTP_FROM must be a valid address: %s", err)
+	}
+	switch ex.Security {
+	case SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone:
+	default:
+		return fmt.Errorf("unknown SMTP_SECURITY: %s", ex.Security)
+	}
+	switch ex.Auth {
+	case SMTPAuthPlain, SMTPAuthLogin:
+	default:
+		return fmt.Errorf("unknown SMTP_AUTH: %s", ex.Auth)
+	}
+
+	ex.TLSConfig = &tls.Config{ServerName: ex.Host}
+	ex.Templates = NewDirectoryTemplateStore(templatesPath)
+	ex.Timeout = 30 * time.Second
+	return nil
+}
+
+// Send sends an email through the service; each recipient receives their own copy of the message, and the email
+// succeeds once any recipient has accepted it
+func (ex *SMTPExchange) Send(ctx context.Context, email *Email) error {
+
+	// render template
+	tpl, err := ex.Templates.Get(email.Template)
+	if err == ErrTemplateNotFound {
+		return &PermanentError{Reason: fmt.Sprintf("SMTP template %s does not exist", email.Template), Err: err}
+	} else if err != nil {
+		return &PermanentError{Reason: fmt.Sprintf("SMTP template %s is invalid: %s", email.Template, err), Err: err}
+	}
+	content, err := tpl.Render(email.Substitutions)
+	if err != nil {
+		return &PermanentError{Reason: fmt.Sprintf("SMTP template %s could not be rendered: %s", email.Template, err), Err: err}
+	}
+
+	// send email
+	email.LastAttemptAt = time.Now()
+	email.Provider = "smtp"
+	client, err := ex.dial(ctx)
+	if err != nil {
+		return smtpError(ctx, err)
+	}
+	defer client.Close()
+
+	// abandon the conversation if the context is cancelled before it ends
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-finished:
+		}
+	}()
+
+	email.ID = uuid.New().String()
+	email.Accepted = 0
+	email.Rejected = 0
+	var firstFailure error
+	for i, address := range email.Recipients {
+		messageID := fmt.Sprintf("<%s.%d@%s>", email.ID, i, domainOf(ex.From))
+		err := ex.transmit(client, address, messageID, content)
+		if err == nil {
+			email.Accepted++
+			continue
+		}
+
+		// a protocol error rejects this recipient; anything else breaks the connection
+		if _, ok := err.(*textproto.Error); !ok {
+			return interrupted(ctx, email, i, err)
+		}
+		if firstFailure == nil {
+			firstFailure = err
+		}
+		email.Rejected++
+		if err := client.Reset(); err != nil {
+			return interrupted(ctx, email, i+1, err)
+		}
+	}
+	client.Quit()
+
+	// nothing was sent, report why
+	if email.Accepted == 0 && firstFailure != nil {
+		return smtpError(ctx, firstFailure)
+	}
+
+	return nil
+}
+
+// interrupted reports a connection that broke before every recipient was tried; once any recipient has accepted
+// the message it isn't sent again, so the recipients from remaining on count as rejected
+func interrupted(ctx context.Context, email *Email, remaining int, err error) error {
+	if email.Accepted == 0 {
+		return smtpError(ctx, err)
+	}
+	email.Rejected += len(email.Recipients) - remaining
+	return nil
+}
+
+// dial connects and authenticates to the SMTP server; the connection times out at the context's deadline if that
+// comes before the exchange's timeout
+func (ex *SMTPExchange) dial(ctx context.Context) (*smtp.Client, error) {
+	address := net.JoinHostPort(ex.Host, ex.Port)
+	dialer := &net.Dialer{Timeout: ex.Timeout}
+
+	// connect, with implicit TLS if configured
+	var conn net.Conn
+	var err error
+	if ex.Security == SMTPSecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: ex.TLSConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if ex.Timeout > 0 && (!ok || time.Now().Add(ex.Timeout).Before(deadline)) {
+		deadline, ok = time.Now().Add(ex.Timeout), true
+	}
+	if ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, ex.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// upgrade the connection
+	if ex.Security == SMTPSecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(ex.TLSConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	// authenticate
+	if ex.Username != "" {
+		var auth smtp.Auth
+		if ex.Auth == SMTPAuthLogin {
+			auth = &loginAuth{username: ex.Username, password: ex.Password, host: ex.Host}
+		} else {
+			auth = smtp.PlainAuth("", ex.Username, ex.Password, ex.Host)
+		}
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// transmit sends a single message to one recipient over an open connection
+func (ex *SMTPExchange) transmit(client *smtp.Client, to, messageID string, content *RenderedTemplate) error {
+	message, err := buildMessage(ex.From, to, messageID, content)
+	if err != nil {
+		return err
+	}
+	from, _ := netmail.ParseAddress(ex.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// buildMessage creates a MIME message; with both text and HTML parts the message is multipart/alternative
+func buildMessage(from, to, messageID string, content *RenderedTemplate) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", from)
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", content.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID)
+	header("MIME-Version", "1.0")
+
+	// single part message
+	if content.Text == "" || content.HTML == "" {
+		contentType, body := "text/plain; charset=utf-8", content.Text
+		if content.HTML != "" {
+			contentType, body = "text/html; charset=utf-8", content.HTML
+		}
+		header("Content-Type", contentType)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	// multipart message, least preferred part first
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", mw.Boundary()))
+	buf.WriteString("\r\n")
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", content.Text},
+		{"text/html; charset=utf-8", content.HTML},
+	}
+	for _, part := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeQuotedPrintable writes a body with quoted-printable encoding
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// domainOf returns the domain of an address, used for message IDs
+func domainOf(address string) string {
+	if parsed, err := netmail.ParseAddress(address); err == nil {
+		address = parsed.Address
+	}
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
+
+// smtpError classifies a failed SMTP exchange as a deadline, permanent, transient or rate limit error
+func smtpError(ctx context.Context, err error) error {
+	if deadlineErr := deadlineError(ctx, err); deadlineErr != nil {
+		return deadlineErr
+	}
+	perr, ok := err.(*textproto.Error)
+	if !ok {
+		return &TransientError{Reason: fmt.Sprintf("SMTP error: %s", err), Err: err}
+	}
+	reason := fmt.Sprintf("SMTP error %d: %s", perr.Code, perr.Msg)
+
+	switch code := perr.Code; {
+	case code == 421 || code == 450 || code == 451 || code == 452:
+		if strings.Contains(strings.ToLower(perr.Msg), "rate") || strings.Contains(strings.ToLower(perr.Msg), "too many") {
+			return &RateLimitError{Reason: reason, RetryAfter: defaultRetryAfter, Err: err}
+		}
+		return &TransientError{Reason: reason, Err: err}
+	case code == 530 || code == 534 || code == 535 || code == 538:
+		return &TransientError{Reason: reason, Err: err} // credentials or connection security, not the email itself
+	case code >= 500:
+		return &PermanentError{Reason: reason, Err: err}
+	}
+	return &TransientError{Reason: reason, Err: err}
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which net/smtp doesn't provide
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+// Start begins LOGIN authentication; like PLAIN, credentials are only sent over TLS or to localhost
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next answers the server's username and password challenges
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %s", fromServer)
+}
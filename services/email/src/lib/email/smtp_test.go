@@ -0,0 +1,467 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPMessage is a message received by the fake SMTP server
+type fakeSMTPMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTPServer is a minimal in-process SMTP server supporting STARTTLS, implicit TLS and PLAIN/LOGIN auth
+type fakeSMTPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	username  string
+	password  string
+	reject    map[string]string // recipient => SMTP reply
+	hangUp    map[string]bool   // recipients whose RCPT drops the connection
+	mutex     sync.Mutex
+	messages  []fakeSMTPMessage
+}
+
+// startFakeSMTP starts a fake SMTP server; with implicitTLS the connection is encrypted from the start
+func startFakeSMTP(t *testing.T, implicitTLS bool) (*fakeSMTPServer, *tls.Config) {
+	cert, pool := createTestCertificate(t)
+	server := &fakeSMTPServer{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		username:  "user",
+		password:  "secret",
+		reject:    map[string]string{},
+		hangUp:    map[string]bool{},
+	}
+
+	var err error
+	if implicitTLS {
+		server.listener, err = tls.Listen("tcp", "127.0.0.1:0", server.tlsConfig)
+	} else {
+		server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("Listen() returned an error: %v", err)
+	}
+	t.Cleanup(func() { server.listener.Close() })
+
+	go func() {
+		for {
+			conn, err := server.listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, implicitTLS)
+		}
+	}()
+
+	return server, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+}
+
+// serve handles one SMTP session
+func (s *fakeSMTPServer) serve(conn net.Conn, secure bool) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			conn.Write([]byte(line + "\r\n"))
+		}
+	}
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+
+	reply("220 fake.smtp ESMTP")
+	authenticated := false
+	var message fakeSMTPMessage
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+
+		switch verb {
+		case "EHLO":
+			if secure {
+				reply("250-fake.smtp", "250 AUTH PLAIN LOGIN")
+			} else {
+				reply("250-fake.smtp", "250 STARTTLS")
+			}
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, r, secure = tlsConn, bufio.NewReader(tlsConn), true
+		case "AUTH":
+			var username, password string
+			fields := strings.Fields(arg)
+			switch strings.ToUpper(fields[0]) {
+			case "PLAIN":
+				decoded, _ := base64.StdEncoding.DecodeString(fields[1])
+				parts := strings.Split(string(decoded), "\x00")
+				if len(parts) == 3 {
+					username, password = parts[1], parts[2]
+				}
+			case "LOGIN":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				line, _ := readLine()
+				decoded, _ := base64.StdEncoding.DecodeString(line)
+				username = string(decoded)
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				line, _ = readLine()
+				decoded, _ = base64.StdEncoding.DecodeString(line)
+				password = string(decoded)
+			}
+			if username == s.username && password == s.password {
+				authenticated = true
+				reply("235 authenticated")
+			} else {
+				reply("535 authentication failed")
+			}
+		case "MAIL":
+			if !authenticated {
+				reply("530 authentication required")
+				continue
+			}
+			message = fakeSMTPMessage{From: strings.Trim(arg[5:], "<>")}
+			reply("250 ok")
+		case "RCPT":
+			to := strings.Trim(arg[3:], "<>")
+			if s.hangUp[to] {
+				return
+			}
+			if rejection, ok := s.reject[to]; ok {
+				reply(rejection)
+				continue
+			}
+			message.To = append(message.To, to)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, ok := readLine()
+				if !ok {
+					return
+				}
+				if line == "." {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, ".") + "\r\n")
+			}
+			message.Data = data.String()
+			s.mutex.Lock()
+			s.messages = append(s.messages, message)
+			s.mutex.Unlock()
+			reply("250 queued")
+		case "RSET":
+			message = fakeSMTPMessage{}
+			reply("250 ok")
+		case "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// received returns the messages received so far
+func (s *fakeSMTPServer) received() []fakeSMTPMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]fakeSMTPMessage{}, s.messages...)
+}
+
+// createTestCertificate creates a self-signed certificate for 127.0.0.1
+func createTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() returned an error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake.smtp"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() returned an error: %v", err)
+	}
+	parsed, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// createTestTemplates writes a template directory with a multipart "welcome" template and a text-only "notice"
+func createTestTemplates(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"welcome/subject.tmpl": "Welcome, {{.name}}!\n",
+		"welcome/text.tmpl":    "Hello {{.name}}, thanks for signing up.",
+		"welcome/html.tmpl":    "<p>Hello <b>{{.name}}</b>, thanks for signing up.</p>",
+		"notice/subject.tmpl":  "Notice",
+		"notice/text.tmpl":     "Something happened.",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile() returned an error: %v", err)
+		}
+	}
+	return dir
+}
+
+// createSMTPExchange returns an exchange configured for the fake server
+func createSMTPExchange(t *testing.T, server *fakeSMTPServer, clientTLS *tls.Config, security, auth string) *SMTPExchange {
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	return &SMTPExchange{
+		Host:      host,
+		Port:      port,
+		Security:  security,
+		Auth:      auth,
+		Username:  "user",
+		Password:  "secret",
+		From:      "Carrier <sender@example.com>",
+		TLSConfig: clientTLS,
+		Templates: NewDirectoryTemplateStore(createTestTemplates(t)),
+		Timeout:   5 * time.Second,
+	}
+}
+
+// tests sending a multipart message over each connection security mode and auth mechanism
+func TestSMTPSend(t *testing.T) {
+	type test struct {
+		implicitTLS bool
+		security    string
+		auth        string
+	}
+
+	tests := []test{
+		{false, SMTPSecurityStartTLS, SMTPAuthPlain},
+		{false, SMTPSecurityStartTLS, SMTPAuthLogin},
+		{true, SMTPSecurityTLS, SMTPAuthPlain},
+		{true, SMTPSecurityTLS, SMTPAuthLogin},
+	}
+
+	for _, tc := range tests {
+		server, clientTLS := startFakeSMTP(t, tc.implicitTLS)
+		ex := createSMTPExchange(t, server, clientTLS, tc.security, tc.auth)
+		email := &Email{
+			Recipients:    []string{"one@example.com", "two@example.com"},
+			Template:      "welcome",
+			Substitutions: map[string]string{"name": "Zoë <Test>"},
+		}
+
+		if err := ex.Send(context.Background(), email); err != nil {
+			t.Fatalf("Send() over %s/%s returned an error: %v", tc.security, tc.auth, err)
+		}
+		if email.ID == "" || email.Accepted != 2 || email.Rejected != 0 || email.LastAttemptAt.IsZero() {
+			t.Errorf("Send() over %s/%s result was incorrect: got %+v", tc.security, tc.auth, email)
+		}
+
+		// each recipient gets their own message
+		messages := server.received()
+		if len(messages) != 2 {
+			t.Fatalf("server received %d messages, expected 2", len(messages))
+		}
+		for i, message := range messages {
+			if message.From != "sender@example.com" || len(message.To) != 1 || message.To[0] != email.Recipients[i] {
+				t.Errorf("message %d envelope was incorrect: got from=%s to=%v", i, message.From, message.To)
+			}
+		}
+
+		// test MIME structure
+		msg, err := netmail.ReadMessage(strings.NewReader(messages[0].Data))
+		if err != nil {
+			t.Fatalf("ReadMessage() returned an error: %v", err)
+		}
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if subject != "Welcome, Zoë <Test>!" {
+			t.Errorf("Subject was incorrect: got %q", subject)
+		}
+		if msg.Header.Get("To") != "one@example.com" || msg.Header.Get("Message-ID") == "" {
+			t.Errorf("headers were incorrect: got %v", msg.Header)
+		}
+		mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if mediaType != "multipart/alternative" {
+			t.Fatalf("Content-Type was incorrect: got %s", mediaType)
+		}
+		expected := []struct{ contentType, body string }{
+			{"text/plain; charset=utf-8", "Hello Zoë <Test>, thanks for signing up."},
+			{"text/html; charset=utf-8", "<p>Hello <b>Zoë &lt;Test&gt;</b>, thanks for signing up.</p>"},
+		}
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		for _, part := range expected {
+			p, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("NextPart() returned an error: %v", err)
+			}
+			body, _ := ioutil.ReadAll(p) // quoted-printable is decoded by the reader
+			if p.Header.Get("Content-Type") != part.contentType || string(body) != part.body {
+				t.Errorf("part was incorrect: got %s %q, expected %s %q", p.Header.Get("Content-Type"), body, part.contentType, part.body)
+			}
+		}
+	}
+}
+
+// tests that a template with only a text part is sent as a single part message
+func TestSMTPSendTextOnly(t *testing.T) {
+	server, clientTLS := startFakeSMTP(t, false)
+	ex := createSMTPExchange(t, server, clientTLS, SMTPSecurityStartTLS, SMTPAuthPlain)
+
+	if err := ex.Send(context.Background(), &Email{Recipients: []string{"one@example.com"}, Template: "notice"}); err != nil {
+		t.Fatalf("Send() returned an error: %v", err)
+	}
+	msg, err := netmail.ReadMessage(strings.NewReader(server.received()[0].Data))
+	if err != nil {
+		t.Fatalf("ReadMessage() returned an error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if msg.Header.Get("Content-Type") != "text/plain; charset=utf-8" || strings.TrimSpace(string(body)) != "Something happened." {
+		t.Errorf("message was incorrect: got %s %q", msg.Header.Get("Content-Type"), body)
+	}
+}
+
+// tests that rejected recipients are counted, and that failures are classified
+func TestSMTPSendErrors(t *testing.T) {
+	type test struct {
+		reject     map[string]string
+		template   string
+		password   string
+		want       string
+		accepted   int
+		rejected   int
+		recipients []string
+	}
+
+	tests := []test{
+		{map[string]string{"two@example.com": "550 no such user"}, "welcome", "secret", "", 1, 1, []string{"one@example.com", "two@example.com"}},
+		{map[string]string{"one@example.com": "550 no such user"}, "welcome", "secret", "permanent", 0, 1, []string{"one@example.com"}},
+		{map[string]string{"one@example.com": "451 try again later"}, "welcome", "secret", "transient", 0, 1, []string{"one@example.com"}},
+		{map[string]string{"one@example.com": "450 rate limit exceeded"}, "welcome", "secret", "rate", 0, 1, []string{"one@example.com"}},
+		{nil, "missing", "secret", "permanent", 0, 0, []string{"one@example.com"}},
+		{nil, "welcome", "wrong", "transient", 0, 0, []string{"one@example.com"}},
+	}
+
+	for i, tc := range tests {
+		server, clientTLS := startFakeSMTP(t, false)
+		for to, rejection := range tc.reject {
+			server.reject[to] = rejection
+		}
+		ex := createSMTPExchange(t, server, clientTLS, SMTPSecurityStartTLS, SMTPAuthPlain)
+		ex.Password = tc.password
+		email := &Email{Recipients: tc.recipients, Template: tc.template, Substitutions: map[string]string{"name": "Test"}}
+		err := ex.Send(context.Background(), email)
+
+		var permanent *PermanentError
+		var transient *TransientError
+		var rateLimited *RateLimitError
+		ok := false
+		switch tc.want {
+		case "":
+			ok = err == nil
+		case "permanent":
+			ok = errors.As(err, &permanent)
+		case "transient":
+			ok = errors.As(err, &transient)
+		case "rate":
+			ok = errors.As(err, &rateLimited)
+		}
+		if !ok {
+			t.Errorf("case %d: got %T %v, expected %q error", i, err, err, tc.want)
+		}
+		if email.Accepted != tc.accepted || email.Rejected != tc.rejected {
+			t.Errorf("case %d: got accepted=%d rejected=%d, expected accepted=%d rejected=%d", i, email.Accepted, email.Rejected, tc.accepted, tc.rejected)
+		}
+	}
+}
+
+// tests that a connection dropped after a recipient accepted the message doesn't fail the email, so it isn't resent
+func TestSMTPSendInterrupted(t *testing.T) {
+	type test struct {
+		recipients []string
+		want       bool
+		accepted   int
+		rejected   int
+	}
+
+	tests := []test{
+		{[]string{"one@example.com", "two@example.com", "three@example.com"}, true, 1, 2},
+		{[]string{"two@example.com", "one@example.com"}, false, 0, 0},
+	}
+
+	for i, tc := range tests {
+		server, clientTLS := startFakeSMTP(t, false)
+		server.hangUp["two@example.com"] = true
+		ex := createSMTPExchange(t, server, clientTLS, SMTPSecurityStartTLS, SMTPAuthPlain)
+		email := &Email{Recipients: tc.recipients, Template: "welcome", Substitutions: map[string]string{"name": "Test"}}
+		err := ex.Send(context.Background(), email)
+
+		var transient *TransientError
+		if tc.want && err != nil {
+			t.Errorf("case %d: Send() returned an error: got %v, expected nil", i, err)
+		}
+		if !tc.want && !errors.As(err, &transient) {
+			t.Errorf("case %d: Send() error was incorrect: got %T %v, expected transient error", i, err, err)
+		}
+		if email.Accepted != tc.accepted || email.Rejected != tc.rejected {
+			t.Errorf("case %d: got accepted=%d rejected=%d, expected accepted=%d rejected=%d", i, email.Accepted, email.Rejected, tc.accepted, tc.rejected)
+		}
+		if got := len(server.received()); got != tc.accepted {
+			t.Errorf("case %d: received messages was incorrect: got %d, expected %d", i, got, tc.accepted)
+		}
+	}
+}
+
+// tests that a missing substitution fails rendering instead of sending placeholder text
+func TestTemplateRenderMissingSubstitution(t *testing.T) {
+	templates := NewDirectoryTemplateStore(createTestTemplates(t))
+	tpl, err := templates.Get("welcome")
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if _, err := tpl.Render(map[string]string{}); err == nil {
+		t.Errorf("Render() without substitutions did not return an error")
+	}
+	if _, err := templates.Get("../welcome"); err != ErrTemplateNotFound {
+		t.Errorf("Get() with a path: got %v, expected ErrTemplateNotFound", err)
+	}
+}
@@ -1,6 +1,9 @@
 package mail
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"time"
@@ -31,7 +34,7 @@ func (ex *SparkPostExchange) Init() error {
 }
 
 // Send sends an email through the service
-func (ex *SparkPostExchange) Send(email *Email) error {
+func (ex *SparkPostExchange) Send(ctx context.Context, email *Email) error {
 
 	// create recipient list
 	recipients := []sp.Recipient{}
@@ -45,15 +48,21 @@ func (ex *SparkPostExchange) Send(email *Email) error {
 
 	// send email
 	email.LastAttemptAt = time.Now()
+	email.Provider = "sparkpost"
 	tx := &sp.Transmission{
 		Recipients: recipients,
 		Content: map[string]interface{}{
 			"template_id": email.Template,
 		},
 	}
-	id, res, err := ex.Client.Send(tx)
+
+	// a transmission SparkPost would never accept, e.g. with an empty recipient address, fails for good
+	if err := tx.Validate(); err != nil {
+		return &PermanentError{Reason: err.Error(), Err: err}
+	}
+	id, res, err := ex.Client.SendContext(ctx, tx)
 	if err != nil {
-		return err
+		return sparkPostError(ctx, res, err)
 	}
 
 	txResults := res.Results.(map[string]interface{})
@@ -63,3 +72,58 @@ func (ex *SparkPostExchange) Send(email *Email) error {
 
 	return nil
 }
+
+// sparkPostRateLimitCodes are SparkPost error codes for exceeded sending limits
+var sparkPostRateLimitCodes = map[string]bool{
+	"2101": true, // exceeded sandbox sending limit
+	"2102": true, // exceeded sending limit
+	"2103": true, // exceeded sending limit for subaccount
+}
+
+// sparkPostError classifies a failed SparkPost request as a deadline, permanent, transient or rate limit error
+func sparkPostError(ctx context.Context, res *sp.Response, err error) error {
+	if deadlineErr := deadlineError(ctx, err); deadlineErr != nil {
+		return deadlineErr
+	}
+	reason := err.Error()
+	if spErrors, ok := err.(sp.SPErrors); ok && len(spErrors) > 0 {
+		reason = fmt.Sprintf("SparkPost error %s: %s", spErrors[0].Code, spErrors[0].Message)
+		if spErrors[0].Description != "" {
+			reason = fmt.Sprintf("%s (%s)", reason, spErrors[0].Description)
+		}
+		if sparkPostRateLimitCodes[spErrors[0].Code.String()] {
+			return &RateLimitError{Reason: reason, RetryAfter: defaultRetryAfter, Err: err}
+		}
+	}
+
+	// no request was made, e.g. the client isn't configured, or no HTTP response, e.g. the connection failed or
+	// timed out; the transmission itself was validated before sending
+	if res == nil || res.HTTP == nil {
+		return &TransientError{Reason: reason, Err: err}
+	}
+
+	switch code := res.HTTP.StatusCode; {
+	case code == http.StatusTooManyRequests:
+		return &RateLimitError{Reason: reason, RetryAfter: retryAfter(res.HTTP.Header), Err: err}
+	case code == http.StatusUnauthorized || code == http.StatusForbidden || code == http.StatusRequestTimeout:
+		return &TransientError{Reason: reason, Err: err} // credentials or network, not the email itself
+	case code >= 400 && code < 500:
+		return &PermanentError{Reason: reason, Err: err}
+	}
+	return &TransientError{Reason: reason, Err: err}
+}
+
+// defaultRetryAfter is the wait used when a rate limited service doesn't say how long to wait
+const defaultRetryAfter = time.Minute
+
+// retryAfter parses the Retry-After header, which may be in seconds or an HTTP date
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && time.Until(date) > 0 {
+		return time.Until(date)
+	}
+	return defaultRetryAfter
+}
@@ -0,0 +1,145 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sp "github.com/SparkPost/gosparkpost"
+)
+
+// createMockSparkPost starts a stand-in for the SparkPost transmissions API that answers with a fixed response
+func createMockSparkPost(t *testing.T, statusCode int, headers map[string]string, body string) *SparkPostExchange {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for key, value := range headers {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(statusCode)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	ex := &SparkPostExchange{Client: sp.Client{Client: server.Client()}}
+	if err := ex.Client.Init(&sp.Config{BaseUrl: server.URL, ApiKey: "test", ApiVersion: 1}); err != nil {
+		t.Fatalf("Client.Init() returned an error: %v", err)
+	}
+	return ex
+}
+
+func createMockEmail() *Email {
+	return &Email{
+		Recipients:    []string{"test@example.com"},
+		Template:      "welcome",
+		Substitutions: map[string]string{"name": "Test"},
+	}
+}
+
+// tests that a successful transmission populates the email
+func TestSparkPostSend(t *testing.T) {
+	ex := createMockSparkPost(t, 200, nil, `{"results":{"id":"11668787484950529","total_accepted_recipients":1,"total_rejected_recipients":0}}`)
+	email := createMockEmail()
+
+	if err := ex.Send(context.Background(), email); err != nil {
+		t.Fatalf("Send() returned an error: %v", err)
+	}
+	if email.ID != "11668787484950529" || email.Accepted != 1 || email.Rejected != 0 {
+		t.Errorf("Send() result was incorrect: got %+v", email)
+	}
+	if email.LastAttemptAt.IsZero() {
+		t.Errorf("Send() did not set LastAttemptAt")
+	}
+}
+
+// tests that SparkPost failures are mapped to permanent, transient and rate limit errors
+func TestSparkPostSendErrors(t *testing.T) {
+	type test struct {
+		statusCode int
+		headers    map[string]string
+		body       string
+		want       string
+		retryAfter time.Duration
+	}
+
+	tests := []test{
+		{422, nil, `{"errors":[{"message":"Message generation rejected","code":"1902"}]}`, "permanent", 0},
+		{400, nil, `{"errors":[{"message":"Invalid recipient","code":"1200","description":"bad address"}]}`, "permanent", 0},
+		{429, map[string]string{"Retry-After": "30"}, `{"errors":[{"message":"Too many requests","code":"1"}]}`, "rate", 30 * time.Second},
+		{420, nil, `{"errors":[{"message":"Exceeded Sending Limit","code":"2102"}]}`, "rate", defaultRetryAfter},
+		{503, nil, `{"errors":[{"message":"Service unavailable"}]}`, "transient", 0},
+		{401, nil, `{"errors":[{"message":"Unauthorized."}]}`, "transient", 0},
+	}
+
+	for _, tc := range tests {
+		ex := createMockSparkPost(t, tc.statusCode, tc.headers, tc.body)
+		err := ex.Send(context.Background(), createMockEmail())
+
+		var permanent *PermanentError
+		var transient *TransientError
+		var rateLimited *RateLimitError
+		switch tc.want {
+		case "permanent":
+			if !errors.As(err, &permanent) {
+				t.Errorf("Send() with HTTP %d: got %T %v, expected PermanentError", tc.statusCode, err, err)
+			}
+		case "transient":
+			if !errors.As(err, &transient) {
+				t.Errorf("Send() with HTTP %d: got %T %v, expected TransientError", tc.statusCode, err, err)
+			}
+		case "rate":
+			if !errors.As(err, &rateLimited) {
+				t.Errorf("Send() with HTTP %d: got %T %v, expected RateLimitError", tc.statusCode, err, err)
+			} else if rateLimited.RetryAfter != tc.retryAfter {
+				t.Errorf("Send() with HTTP %d RetryAfter: got %v, expected %v", tc.statusCode, rateLimited.RetryAfter, tc.retryAfter)
+			}
+		}
+	}
+}
+
+// tests that connection failures are transient
+func TestSparkPostSendUnreachable(t *testing.T) {
+	ex := createMockSparkPost(t, 200, nil, `{}`)
+	ex.Client.Config.BaseUrl = "https://127.0.0.1:1"
+
+	err := ex.Send(context.Background(), createMockEmail())
+	var transient *TransientError
+	if !errors.As(err, &transient) {
+		t.Errorf("Send() to unreachable host: got %T %v, expected TransientError", err, err)
+	}
+}
+
+// tests that transmissions that can't be sent are permanent errors, but client failures are transient
+func TestSparkPostSendInvalid(t *testing.T) {
+	ex := createMockSparkPost(t, 200, nil, `{}`)
+	email := createMockEmail()
+	email.Recipients = []string{""}
+
+	err := ex.Send(context.Background(), email)
+	var permanent *PermanentError
+	if !errors.As(err, &permanent) {
+		t.Errorf("Send() to an empty address: got %T %v, expected PermanentError", err, err)
+	}
+
+	ex.Client.Config.BaseUrl = "http://%zz"
+	err = ex.Send(context.Background(), createMockEmail())
+	var transient *TransientError
+	if !errors.As(err, &transient) {
+		t.Errorf("Send() with a bad base URL: got %T %v, expected TransientError", err, err)
+	}
+}
+
+// tests that a send interrupted by its context is a DeadlineError rather than a provider error
+func TestSparkPostSendDeadline(t *testing.T) {
+	ex := createMockSparkPost(t, 200, nil, `{"results":{"total_rejected_recipients":0,"total_accepted_recipients":1,"id":"1"}}`)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	err := ex.Send(ctx, createMockEmail())
+	var deadline *DeadlineError
+	if !errors.As(err, &deadline) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send() past its deadline: got %T %v, expected DeadlineError", err, err)
+	}
+}
@@ -0,0 +1,140 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	htmlTemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	textTemplate "text/template"
+)
+
+// ErrTemplateNotFound is returned when a template store has no template with the requested name
+var ErrTemplateNotFound = errors.New("template not found")
+
+// Template is a parsed email template with a subject and text and/or HTML bodies
+type Template struct {
+	Subject *textTemplate.Template
+	Text    *textTemplate.Template
+	HTML    *htmlTemplate.Template
+}
+
+// RenderedTemplate is the output of a template rendered with substitutions
+type RenderedTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// TemplateStore is a generic interface for a source of email templates
+type TemplateStore interface {
+	Get(name string) (*Template, error)
+}
+
+// Render renders the template parts with the substitutions; substitutions missing from the data are an error
+func (t *Template) Render(substitutions map[string]string) (*RenderedTemplate, error) {
+	if substitutions == nil {
+		substitutions = map[string]string{}
+	}
+
+	var rendered RenderedTemplate
+	var buf bytes.Buffer
+	if err := t.Subject.Execute(&buf, substitutions); err != nil {
+		return nil, err
+	}
+	rendered.Subject = strings.TrimSpace(buf.String())
+
+	if t.Text != nil {
+		buf.Reset()
+		if err := t.Text.Execute(&buf, substitutions); err != nil {
+			return nil, err
+		}
+		rendered.Text = buf.String()
+	}
+
+	if t.HTML != nil {
+		buf.Reset()
+		if err := t.HTML.Execute(&buf, substitutions); err != nil {
+			return nil, err
+		}
+		rendered.HTML = buf.String()
+	}
+
+	return &rendered, nil
+}
+
+// DirectoryTemplateStore loads templates from a directory; each template is a subdirectory named after the template
+// containing `subject.tmpl` and at least one of `text.tmpl` and `html.tmpl`
+type DirectoryTemplateStore struct {
+	Path  string
+	mutex sync.Mutex
+	cache map[string]*Template
+}
+
+// NewDirectoryTemplateStore creates a template store reading from the directory path
+func NewDirectoryTemplateStore(path string) *DirectoryTemplateStore {
+	return &DirectoryTemplateStore{Path: path, cache: map[string]*Template{}}
+}
+
+// Get loads and parses a template by name; parsed templates are cached
+func (s *DirectoryTemplateStore) Get(name string) (*Template, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if tpl, ok := s.cache[name]; ok {
+		return tpl, nil
+	}
+
+	// template names are directory names, not paths
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, ErrTemplateNotFound
+	}
+	dir := filepath.Join(s.Path, name)
+
+	subject, err := readTemplateFile(dir, "subject.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	text, err := readTemplateFile(dir, "text.tmpl")
+	if err != nil && err != ErrTemplateNotFound {
+		return nil, err
+	}
+	html, err := readTemplateFile(dir, "html.tmpl")
+	if err != nil && err != ErrTemplateNotFound {
+		return nil, err
+	}
+	if text == "" && html == "" {
+		return nil, ErrTemplateNotFound
+	}
+
+	// parse template parts
+	tpl := &Template{}
+	if tpl.Subject, err = textTemplate.New("subject").Option("missingkey=error").Parse(subject); err != nil {
+		return nil, err
+	}
+	if text != "" {
+		if tpl.Text, err = textTemplate.New("text").Option("missingkey=error").Parse(text); err != nil {
+			return nil, err
+		}
+	}
+	if html != "" {
+		if tpl.HTML, err = htmlTemplate.New("html").Option("missingkey=error").Parse(html); err != nil {
+			return nil, err
+		}
+	}
+
+	s.cache[name] = tpl
+	return tpl, nil
+}
+
+// readTemplateFile reads a template part, returning ErrTemplateNotFound if it doesn't exist
+func readTemplateFile(dir, file string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if os.IsNotExist(err) {
+		return "", ErrTemplateNotFound
+	}
+	return string(content), err
+}
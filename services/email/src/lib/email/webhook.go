@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeliveryEvent is a delivery, engagement or failure event reported by an email service after a send
+type DeliveryEvent struct {
+	ID          string
+	ServiceID   string
+	Type        string
+	Recipient   string
+	Timestamp   time.Time
+	Reason      string
+	BounceClass string
+	URL         string
+}
+
+// sparkPostEventCategories are the SparkPost webhook event categories that concern sent emails
+var sparkPostEventCategories = []string{"message_event", "track_event", "unsubscribe_event"}
+
+// sparkPostEvent is an event object from a SparkPost webhook batch
+type sparkPostEvent struct {
+	EventID        string          `json:"event_id"`
+	Type           string          `json:"type"`
+	TransmissionID string          `json:"transmission_id"`
+	RecipientTo    string          `json:"rcpt_to"`
+	RawRecipientTo string          `json:"raw_rcpt_to"`
+	Timestamp      json.RawMessage `json:"timestamp"`
+	Reason         string          `json:"reason"`
+	RawReason      string          `json:"raw_reason"`
+	BounceClass    string          `json:"bounce_class"`
+	TargetLinkURL  string          `json:"target_link_url"`
+}
+
+// ParseSparkPostEvents parses a SparkPost webhook batch into delivery events; events that don't belong to a
+// transmission (e.g. the test ping sent when a webhook is created) are skipped
+func ParseSparkPostEvents(body []byte) ([]*DeliveryEvent, error) {
+	var batch []map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+
+	events := []*DeliveryEvent{}
+	for _, item := range batch {
+		for _, category := range sparkPostEventCategories {
+			raw, ok := item["msys"][category]
+			if !ok {
+				continue
+			}
+			var e sparkPostEvent
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return nil, err
+			}
+			if e.TransmissionID == "" {
+				continue
+			}
+
+			event := &DeliveryEvent{
+				ID:          e.EventID,
+				ServiceID:   e.TransmissionID,
+				Type:        e.Type,
+				Recipient:   e.RecipientTo,
+				Timestamp:   parseSparkPostTimestamp(e.Timestamp),
+				Reason:      e.Reason,
+				BounceClass: e.BounceClass,
+				URL:         e.TargetLinkURL,
+			}
+			if event.Recipient == "" {
+				event.Recipient = e.RawRecipientTo
+			}
+			if event.Reason == "" {
+				event.Reason = e.RawReason
+			}
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// parseSparkPostTimestamp parses an event timestamp, which is in Unix seconds or RFC 3339 depending on the
+// webhook version
+func parseSparkPostTimestamp(raw json.RawMessage) time.Time {
+	value := strings.Trim(strings.TrimSpace(string(raw)), `"`)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(int64(seconds), 0).UTC()
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC()
+	}
+	return time.Now().UTC()
+}
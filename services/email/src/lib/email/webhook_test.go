@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"testing"
+	"time"
+)
+
+// tests parsing a SparkPost webhook batch
+func TestParseSparkPostEvents(t *testing.T) {
+	body := []byte(`[
+		{"msys": {"message_event": {"type": "bounce", "event_id": "92356927693813856", "transmission_id": "65832150921904138", "rcpt_to": "recipient@example.com", "timestamp": "1454442600", "bounce_class": "10", "raw_reason": "550 5.1.1 unknown user"}}},
+		{"msys": {"track_event": {"type": "click", "event_id": "92356927693813857", "transmission_id": "65832150921904138", "raw_rcpt_to": "recipient@example.com", "timestamp": "2016-02-02T19:50:00Z", "target_link_url": "https://example.com/"}}},
+		{"msys": {"unsubscribe_event": {"type": "list_unsubscribe", "event_id": "92356927693813858", "transmission_id": "65832150921904139", "rcpt_to": "other@example.com", "timestamp": 1454442600}}},
+		{"msys": {"gen_event": {"type": "generation_failure", "transmission_id": "65832150921904140"}}},
+		{"msys": {}}
+	]`)
+
+	events, err := ParseSparkPostEvents(body)
+	if err != nil {
+		t.Fatalf("ParseSparkPostEvents() returned an error: %v", err)
+	}
+
+	expected := []DeliveryEvent{
+		{ID: "92356927693813856", ServiceID: "65832150921904138", Type: "bounce", Recipient: "recipient@example.com", Timestamp: time.Unix(1454442600, 0).UTC(), Reason: "550 5.1.1 unknown user", BounceClass: "10"},
+		{ID: "92356927693813857", ServiceID: "65832150921904138", Type: "click", Recipient: "recipient@example.com", Timestamp: time.Unix(1454442600, 0).UTC(), URL: "https://example.com/"},
+		{ID: "92356927693813858", ServiceID: "65832150921904139", Type: "list_unsubscribe", Recipient: "other@example.com", Timestamp: time.Unix(1454442600, 0).UTC()},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("ParseSparkPostEvents() returned %d events, expected %d", len(events), len(expected))
+	}
+	for i, event := range events {
+		if *event != expected[i] {
+			t.Errorf("event %d was incorrect: got %+v, expected %+v", i, *event, expected[i])
+		}
+	}
+}
+
+// tests that malformed batches are rejected
+func TestParseSparkPostEventsInvalid(t *testing.T) {
+	for _, body := range []string{``, `{}`, `[{"msys": []}]`, `[{"msys": {"message_event": []}}]`} {
+		if _, err := ParseSparkPostEvents([]byte(body)); err == nil {
+			t.Errorf("ParseSparkPostEvents(%q) did not return an error", body)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidCursor is returned when a cursor token is malformed, its signature does not match, or it was issued
+// for another scope
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrNoSecret is returned when cursors would be signed with an empty secret, which anyone could forge
+var ErrNoSecret = errors.New("cursor secret is not set")
+
+// EncodeCursor signs a datastore position, along with the scope it's valid in (e.g. the query that produced it),
+// and encodes it as an opaque, URL-safe token
+func EncodeCursor(position, scope string, secret []byte) (string, error) {
+	if position == "" {
+		return "", nil
+	}
+	if len(secret) == 0 {
+		return "", ErrNoSecret
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(position))
+	signature := base64.RawURLEncoding.EncodeToString(sign(scope, payload, secret))
+	return payload + "." + signature, nil
+}
+
+// DecodeCursor verifies a token created by EncodeCursor for the same scope and returns the datastore position
+func DecodeCursor(token, scope string, secret []byte) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	if len(secret) == 0 {
+		return "", ErrNoSecret
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, sign(scope, parts[0], secret)) {
+		return "", ErrInvalidCursor
+	}
+	position, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(position), nil
+}
+
+// sign generates an HMAC-SHA256 signature of the payload in its scope
+func sign(scope, payload string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(scope))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
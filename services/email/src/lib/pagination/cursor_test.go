@@ -0,0 +1,67 @@
+package pagination
+
+import (
+	"testing"
+)
+
+// tests that a cursor survives an encode/decode round trip
+func TestCursorRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	position := `{"id":{"B":"AAEC"}}`
+
+	token, err := EncodeCursor(position, "emails", secret)
+	if err != nil || token == "" {
+		t.Fatalf("EncodeCursor() was incorrect: got %q, %v, expected a token", token, err)
+	}
+
+	decoded, err := DecodeCursor(token, "emails", secret)
+	if err != nil {
+		t.Errorf("DecodeCursor() returned an error: got %v", err)
+	}
+	if decoded != position {
+		t.Errorf("DecodeCursor() was incorrect: got %v, expected %v", decoded, position)
+	}
+}
+
+// tests that empty positions and tokens map to each other
+func TestCursorEmpty(t *testing.T) {
+	if token, err := EncodeCursor("", "emails", []byte("secret")); token != "" || err != nil {
+		t.Errorf("EncodeCursor() was incorrect: got %v, %v, expected empty string, nil", token, err)
+	}
+	position, err := DecodeCursor("", "emails", []byte("secret"))
+	if err != nil || position != "" {
+		t.Errorf("DecodeCursor() was incorrect: got %v, %v, expected empty string, nil", position, err)
+	}
+}
+
+// tests that cursors are neither issued nor accepted without a secret
+func TestCursorNoSecret(t *testing.T) {
+	if _, err := EncodeCursor(`{"id":{"B":"AAEC"}}`, "emails", nil); err != ErrNoSecret {
+		t.Errorf("EncodeCursor() error was incorrect: got %v, expected %v", err, ErrNoSecret)
+	}
+	token, _ := EncodeCursor(`{"id":{"B":"AAEC"}}`, "emails", []byte("secret"))
+	if _, err := DecodeCursor(token, "emails", []byte{}); err != ErrNoSecret {
+		t.Errorf("DecodeCursor() error was incorrect: got %v, expected %v", err, ErrNoSecret)
+	}
+}
+
+// tests that tampered, foreign or out of scope tokens are rejected
+func TestDecodeCursorInvalid(t *testing.T) {
+	token, _ := EncodeCursor(`{"id":{"B":"AAEC"}}`, "emails", []byte("secret"))
+	foreign, _ := EncodeCursor(`{"id":{"B":"AAEC"}}`, "emails", []byte("other-secret"))
+	otherScope, _ := EncodeCursor(`{"id":{"B":"AAEC"}}`, "suppressions", []byte("secret"))
+
+	tests := []string{
+		"garbage",
+		token + "x",
+		"eyJpZCI6MX0." + token[len(token)-10:],
+		foreign,
+		otherScope,
+	}
+
+	for _, tc := range tests {
+		if _, err := DecodeCursor(tc, "emails", []byte("secret")); err != ErrInvalidCursor {
+			t.Errorf("DecodeCursor(%q) error was incorrect: got %v, expected %v", tc, err, ErrInvalidCursor)
+		}
+	}
+}
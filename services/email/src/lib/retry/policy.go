@@ -0,0 +1,250 @@
+package retry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Backoff strategies
+const (
+	StrategyExponential = "exponential"
+	StrategyLinear      = "linear"
+	StrategyFixed       = "fixed"
+)
+
+// Jitter modes of the exponential strategy
+const (
+	JitterNone         = "none"
+	JitterFull         = "full"
+	JitterDecorrelated = "decorrelated"
+)
+
+// Backoff computes the delay before the next attempt from the number of attempts made so far and the delay before
+// the last one
+type Backoff interface {
+	Delay(attempts int, previous time.Duration) time.Duration
+}
+
+// Exponential doubles the delay with each attempt; full jitter picks a delay between zero and the doubled delay,
+// decorrelated jitter picks one between Base and three times the previous delay
+type Exponential struct {
+	Base   time.Duration
+	Jitter string
+}
+
+// Delay returns the delay before the next attempt
+func (b Exponential) Delay(attempts int, previous time.Duration) time.Duration {
+	if attempts > 30 {
+		attempts = 30
+	}
+	delay := maxDelay // saturate rather than overflow
+	if b.Base <= maxDelay>>uint(attempts) {
+		delay = b.Base << uint(attempts)
+	}
+
+	switch b.Jitter {
+	case JitterFull:
+		return between(0, delay)
+	case JitterDecorrelated:
+		if previous < b.Base {
+			previous = b.Base
+		}
+		if previous > maxDelay/3 {
+			return between(b.Base, maxDelay)
+		}
+		return between(b.Base, 3*previous)
+	}
+	return delay
+}
+
+// maxDelay is the longest delay a backoff returns; longer delays would overflow
+const maxDelay = time.Duration(math.MaxInt64)
+
+// Linear adds Step to the delay with each attempt
+type Linear struct {
+	Step time.Duration
+}
+
+// Delay returns the delay before the next attempt
+func (b Linear) Delay(attempts int, previous time.Duration) time.Duration {
+	if attempts > 0 && b.Step > maxDelay/time.Duration(attempts) {
+		return maxDelay // saturate rather than overflow
+	}
+	return b.Step * time.Duration(attempts)
+}
+
+// Fixed always waits Interval
+type Fixed struct {
+	Interval time.Duration
+}
+
+// Delay returns the delay before the next attempt
+func (b Fixed) Delay(attempts int, previous time.Duration) time.Duration {
+	return b.Interval
+}
+
+// Policy decides when a failed attempt is retried: after the backoff's delay, at most MaxDelay, and only while the
+// retry is within MaxAge of the first attempt; zero limits don't apply
+type Policy struct {
+	Backoff  Backoff
+	MaxDelay time.Duration
+	MaxAge   time.Duration
+}
+
+// DefaultPolicy is used when no policy is configured: exponential backoff from a minute with decorrelated jitter,
+// so retries of emails that failed together are spread out, at most an hour apart
+var DefaultPolicy = Policy{
+	Backoff:  Exponential{Base: time.Minute, Jitter: JitterDecorrelated},
+	MaxDelay: time.Hour,
+}
+
+// Next returns when to make the next attempt after a failed one, and false if that's too long after the first
+func (p Policy) Next(first, now time.Time, attempts int, previous time.Duration) (time.Time, bool) {
+	delay := p.Backoff.Delay(attempts, previous)
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	next := now.Add(delay)
+	if p.MaxAge > 0 && next.After(first.Add(p.MaxAge)) {
+		return next, false
+	}
+	return next, true
+}
+
+// Policies are the retry policies of a service; a template's policy overrides a priority's, which overrides the
+// default
+type Policies struct {
+	Default    Policy
+	Priorities map[int]Policy
+	Templates  map[string]Policy
+}
+
+// For returns the policy for a template and priority
+func (p *Policies) For(template string, priority int) Policy {
+	if policy, ok := p.Templates[template]; ok {
+		return policy
+	}
+	if policy, ok := p.Priorities[priority]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+// policySpec is the JSON form of a policy; durations are in seconds
+type policySpec struct {
+	Strategy string `json:"strategy"`
+	Jitter   string `json:"jitter"`
+	Delay    int    `json:"delay"`
+	MaxDelay int    `json:"max_delay"`
+	MaxAge   int    `json:"max_age"`
+}
+
+// Parse reads policies from JSON, e.g.
+// {"default": {"strategy": "exponential", "jitter": "full", "delay": 60, "max_delay": 3600, "max_age": 86400},
+// "priorities": {"1": {"strategy": "fixed", "delay": 30}}, "templates": {"digest": {"strategy": "linear", "delay": 600}}};
+// policies that aren't given are DefaultPolicy
+func Parse(data []byte) (*Policies, error) {
+	var specs struct {
+		Default    *policySpec           `json:"default"`
+		Priorities map[string]policySpec `json:"priorities"`
+		Templates  map[string]policySpec `json:"templates"`
+	}
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, err
+	}
+
+	policies := &Policies{Default: DefaultPolicy, Priorities: map[int]Policy{}, Templates: map[string]Policy{}}
+	if specs.Default != nil {
+		policy, err := specs.Default.policy()
+		if err != nil {
+			return nil, fmt.Errorf("default: %w", err)
+		}
+		policies.Default = policy
+	}
+	for key, spec := range specs.Priorities {
+		priority, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("priority %q is not a number", key)
+		}
+		policy, err := spec.policy()
+		if err != nil {
+			return nil, fmt.Errorf("priority %d: %w", priority, err)
+		}
+		policies.Priorities[priority] = policy
+	}
+	for template, spec := range specs.Templates {
+		policy, err := spec.policy()
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", template, err)
+		}
+		policies.Templates[template] = policy
+	}
+	return policies, nil
+}
+
+// ParsePolicy reads a single policy from JSON, in the form of Parse's default policy, e.g.
+// {"strategy": "exponential", "jitter": "full", "delay": 60, "max_delay": 3600}
+func ParsePolicy(data []byte) (Policy, error) {
+	var spec policySpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return Policy{}, err
+	}
+	return spec.policy()
+}
+
+// policy validates a spec and creates its policy
+func (s policySpec) policy() (Policy, error) {
+	if s.Delay < 0 || s.MaxDelay < 0 || s.MaxAge < 0 {
+		return Policy{}, fmt.Errorf("durations can't be negative")
+	}
+	delay := time.Duration(s.Delay) * time.Second
+	if delay == 0 {
+		delay = time.Minute
+	}
+
+	policy := Policy{
+		MaxDelay: time.Duration(s.MaxDelay) * time.Second,
+		MaxAge:   time.Duration(s.MaxAge) * time.Second,
+	}
+	switch s.Strategy {
+	case StrategyExponential, "":
+		switch s.Jitter {
+		case JitterNone, JitterFull, JitterDecorrelated, "":
+		default:
+			return Policy{}, fmt.Errorf("unknown jitter: %s", s.Jitter)
+		}
+		policy.Backoff = Exponential{Base: delay, Jitter: s.Jitter}
+	case StrategyLinear:
+		policy.Backoff = Linear{Step: delay}
+	case StrategyFixed:
+		policy.Backoff = Fixed{Interval: delay}
+	default:
+		return Policy{}, fmt.Errorf("unknown strategy: %s", s.Strategy)
+	}
+	return policy, nil
+}
+
+// random is shared by every policy, so it's locked
+var (
+	randomMutex sync.Mutex
+	random      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// between returns a random duration in [low, high]
+func between(low, high time.Duration) time.Duration {
+	if high <= low {
+		return low
+	}
+	span := int64(high - low)
+	if span < math.MaxInt64 {
+		span++ // include high
+	}
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return low + time.Duration(random.Int63n(span))
+}
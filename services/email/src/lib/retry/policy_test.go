@@ -0,0 +1,137 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+// tests that each backoff grows its delay as expected, with jitter staying in range
+func TestBackoffDelay(t *testing.T) {
+	type test struct {
+		backoff  Backoff
+		attempts int
+		previous time.Duration
+		min      time.Duration
+		max      time.Duration
+	}
+
+	tests := []test{
+		{Exponential{Base: time.Minute}, 1, 0, 2 * time.Minute, 2 * time.Minute},
+		{Exponential{Base: time.Minute}, 3, 0, 8 * time.Minute, 8 * time.Minute},
+		{Exponential{Base: time.Minute, Jitter: JitterFull}, 3, 0, 0, 8 * time.Minute},
+		{Exponential{Base: time.Minute, Jitter: JitterDecorrelated}, 1, 0, time.Minute, 3 * time.Minute},
+		{Exponential{Base: time.Minute, Jitter: JitterDecorrelated}, 4, 10 * time.Minute, time.Minute, 30 * time.Minute},
+		{Exponential{Base: time.Second}, 100, 0, time.Second << 30, time.Second << 30},
+		{Exponential{Base: time.Hour}, 25, 0, maxDelay, maxDelay},
+		{Exponential{Base: time.Minute}, 28, 0, maxDelay, maxDelay},
+		{Exponential{Base: time.Hour, Jitter: JitterFull}, 40, 0, 0, maxDelay},
+		{Exponential{Base: time.Hour, Jitter: JitterDecorrelated}, 40, maxDelay, time.Hour, maxDelay},
+		{Linear{Step: time.Minute}, 3, 0, 3 * time.Minute, 3 * time.Minute},
+		{Linear{Step: time.Hour}, 1 << 40, 0, maxDelay, maxDelay},
+		{Fixed{Interval: time.Minute}, 5, 0, time.Minute, time.Minute},
+	}
+
+	for i, tc := range tests {
+		for n := 0; n < 20; n++ {
+			delay := tc.backoff.Delay(tc.attempts, tc.previous)
+			if delay < tc.min || delay > tc.max {
+				t.Errorf("case %d: Delay() was incorrect: got %v, expected %v to %v", i, delay, tc.min, tc.max)
+				break
+			}
+		}
+	}
+}
+
+// tests that policies cap the delay and give up after the maximum age
+func TestPolicyNext(t *testing.T) {
+	first := time.Date(2021, 10, 26, 12, 0, 0, 0, time.UTC)
+	now := first.Add(time.Hour)
+	policy := Policy{Backoff: Exponential{Base: time.Minute}, MaxDelay: 10 * time.Minute, MaxAge: 2 * time.Hour}
+
+	next, ok := policy.Next(first, now, 2, 0)
+	if !ok || !next.Equal(now.Add(4*time.Minute)) {
+		t.Errorf("Next() was incorrect: got %v %v, expected %v true", next, ok, now.Add(4*time.Minute))
+	}
+	next, ok = policy.Next(first, now, 8, 0)
+	if !ok || !next.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("Next() was incorrect: got %v %v, expected %v true", next, ok, now.Add(10*time.Minute))
+	}
+	next, ok = policy.Next(first, now, 1000, 0)
+	if !ok || !next.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("Next() with many attempts was incorrect: got %v %v, expected %v true", next, ok, now.Add(10*time.Minute))
+	}
+	hourly := Policy{Backoff: Exponential{Base: time.Hour}, MaxDelay: 24 * time.Hour}
+	if next, _ = hourly.Next(first, now, 22, 0); !next.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("Next() with a large base was incorrect: got %v, expected %v", next, now.Add(24*time.Hour))
+	}
+	if _, ok = policy.Next(first, first.Add(115*time.Minute), 8, 0); ok {
+		t.Errorf("Next() was incorrect: got a retry after the maximum age")
+	}
+}
+
+// tests that policies are read from JSON and chosen by template, then priority
+func TestParse(t *testing.T) {
+	policies, err := Parse([]byte(`{
+		"default": {"strategy": "linear", "delay": 30, "max_age": 3600},
+		"priorities": {"1": {"strategy": "fixed", "delay": 10}},
+		"templates": {"digest": {"jitter": "full", "max_delay": 600}}
+	}`))
+	if err != nil {
+		t.Fatalf("Parse() returned an error: %v", err)
+	}
+
+	type test struct {
+		template string
+		priority int
+		want     Policy
+	}
+	tests := []test{
+		{"welcome", 2, Policy{Backoff: Linear{Step: 30 * time.Second}, MaxAge: time.Hour}},
+		{"welcome", 1, Policy{Backoff: Fixed{Interval: 10 * time.Second}}},
+		{"digest", 1, Policy{Backoff: Exponential{Base: time.Minute, Jitter: JitterFull}, MaxDelay: 10 * time.Minute}},
+	}
+	for i, tc := range tests {
+		if got := policies.For(tc.template, tc.priority); got != tc.want {
+			t.Errorf("case %d: For() was incorrect: got %+v, expected %+v", i, got, tc.want)
+		}
+	}
+
+	// policies that aren't given are the default
+	policies, err = Parse([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("Parse() returned an error: %v", err)
+	}
+	if got := policies.For("welcome", 1); got != DefaultPolicy {
+		t.Errorf("For() was incorrect: got %+v, expected %+v", got, DefaultPolicy)
+	}
+
+	// invalid policies are rejected
+	for _, data := range []string{
+		`{"default": {"strategy": "random"}}`,
+		`{"default": {"jitter": "some"}}`,
+		`{"priorities": {"high": {}}}`,
+		`{"templates": {"digest": {"delay": -1}}}`,
+		`[]`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse() accepted %s", data)
+		}
+	}
+}
+
+// tests that a single policy is read from JSON
+func TestParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"strategy": "exponential", "jitter": "none", "delay": 30, "max_delay": 600}`))
+	if err != nil {
+		t.Fatalf("ParsePolicy() returned an error: %v", err)
+	}
+	if want := (Policy{Backoff: Exponential{Base: 30 * time.Second, Jitter: JitterNone}, MaxDelay: 10 * time.Minute}); policy != want {
+		t.Errorf("ParsePolicy() was incorrect: got %+v, expected %+v", policy, want)
+	}
+
+	for _, data := range []string{`{"strategy": "random"}`, `{"max_age": -1}`, `[]`} {
+		if _, err := ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("ParsePolicy() accepted %s", data)
+		}
+	}
+}
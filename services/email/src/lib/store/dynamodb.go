@@ -1,12 +1,15 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -28,125 +31,198 @@ func CreateConnection(region, endpoint string) (*dynamodb.DynamoDB, error) {
 	return dynamodb.New(sess), nil
 }
 
+// maxListRequests bounds the reads List makes to fill a page when conditions filter items out
+const maxListRequests = 10
+
 // DynamoDBTable is a reference to a specific table in DynamoDB
 type DynamoDBTable struct {
-	table string
-	conn  *dynamodb.DynamoDB
+	table   string
+	conn    *dynamodb.DynamoDB
+	indexes []Index
 }
 
-// NewDynamoDBTable creates a new reference to a DynamoDB table
-func NewDynamoDBTable(conn *dynamodb.DynamoDB, table string) *DynamoDBTable {
+// NewDynamoDBTable creates a new reference to a DynamoDB table; List can query the given secondary indexes
+func NewDynamoDBTable(conn *dynamodb.DynamoDB, table string, indexes ...Index) *DynamoDBTable {
 	return &DynamoDBTable{
-		conn: conn, table: table,
+		conn: conn, table: table, indexes: indexes,
 	}
 }
 
-// List gets a collection of resources
-func (dt *DynamoDBTable) List(castTo interface{}, page, limit int64, options ...interface{}) error {
-	var optionMap map[string]interface{}
-	var indexName, queryOption string
-	var expressionAttributeValues map[string]*dynamodb.AttributeValue
-	var ok bool
-
-	// flag to control DynamoDB query or scan behavior
-	isQuery := false
-
-	// parse options if provided
-	if options != nil {
-		optionMap = options[0].(map[string]interface{})
-		if queryOption, ok = optionMap["query"].(string); ok && queryOption != "" {
-			isQuery = true
-		}
-		indexName, _ = optionMap["index"].(string)
-		expressionAttributeValues, _ = optionMap["expressionAttributeValues"].(map[string]*dynamodb.AttributeValue)
+// List gets a collection of resources, starting after the position given by startKey; returns the position
+// to continue from, or an empty string if there are no more results. A nil query scans the whole table
+func (dt *DynamoDBTable) List(ctx context.Context, castTo interface{}, limit int64, startKey string, query *Query) (string, error) {
+	var lastEvaluatedKey map[string]*dynamodb.AttributeValue
+
+	// compile the query into a DynamoDB QUERY or SCAN
+	queryInput, scanInput, err := dt.compile(query)
+	if err != nil {
+		return "", err
 	}
 
-	if isQuery {
+	// support for pagination: resume after the last evaluated key of the previous page
+	exclusiveStartKey, err := decodeKey(startKey)
+	if err != nil {
+		return "", err
+	}
 
-		// perform DynamoDB QUERY
+	// filters are applied after a page is read, so keep reading, within reason, to fill the page
+	items := []map[string]*dynamodb.AttributeValue{}
+	for request := 1; ; request++ {
+		var page []map[string]*dynamodb.AttributeValue
+		var filtered bool
 
-		// create query config
-		input := &dynamodb.QueryInput{
-			TableName:                 aws.String(dt.table),
-			Limit:                     aws.Int64(limit),
-			KeyConditionExpression:    aws.String(queryOption),
-			ExpressionAttributeValues: expressionAttributeValues,
-		}
+		if queryInput != nil {
 
-		if indexName != "" {
-			input.IndexName = &indexName
-		}
+			// perform DynamoDB QUERY
+			queryInput.Limit = aws.Int64(limit - int64(len(items)))
+			queryInput.ExclusiveStartKey = exclusiveStartKey
+			results, err := dt.conn.QueryWithContext(ctx, queryInput)
+			if err != nil {
+				return "", requestError(ctx, err)
+			}
+			page, lastEvaluatedKey = results.Items, results.LastEvaluatedKey
+			filtered = queryInput.FilterExpression != nil
 
-		// get first page of results
-		currentPage := int64(1)
-		results, err := dt.conn.Query(input)
-		if err != nil {
-			return err
-		}
+		} else {
 
-		// support for pagination: beyond page 1
-		for currentPage < page && len(results.LastEvaluatedKey) > 0 {
-			results, err = dt.conn.Query(&dynamodb.QueryInput{
-				TableName:         aws.String(dt.table),
-				Limit:             aws.Int64(limit),
-				ExclusiveStartKey: results.LastEvaluatedKey,
-			})
+			// perform DynamoDB SCAN
+			scanInput.Limit = aws.Int64(limit - int64(len(items)))
+			scanInput.ExclusiveStartKey = exclusiveStartKey
+			results, err := dt.conn.ScanWithContext(ctx, scanInput)
 			if err != nil {
-				return err
+				return "", requestError(ctx, err)
 			}
-			currentPage++
+			page, lastEvaluatedKey = results.Items, results.LastEvaluatedKey
+			filtered = scanInput.FilterExpression != nil
 		}
 
-		// populate output with results
-		if err := dynamodbattribute.UnmarshalListOfMaps(results.Items, &castTo); err != nil {
-			return err
+		items = append(items, page...)
+		exclusiveStartKey = lastEvaluatedKey
+		if !filtered || lastEvaluatedKey == nil || int64(len(items)) >= limit || request >= maxListRequests {
+			break
 		}
+	}
 
-	} else {
+	// populate output with results
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &castTo); err != nil {
+		return "", err
+	}
 
-		// perform DynamoDB SCAN
+	return encodeKey(lastEvaluatedKey)
+}
 
-		// create scan config
-		input := &dynamodb.ScanInput{
-			TableName: aws.String(dt.table),
-			Limit:     aws.Int64(limit),
-		}
+// Plan describes how List would find the items selected by the query
+func (dt *DynamoDBTable) Plan(query *Query) (ListPlan, error) {
+	return planList(dt.indexes, query)
+}
 
-		if indexName != "" {
-			input.IndexName = &indexName
-		}
+// compile turns a query into the input of a DynamoDB QUERY of an index, or of a SCAN of the table; exactly one
+// of the inputs is returned, without a limit or start key
+func (dt *DynamoDBTable) compile(query *Query) (*dynamodb.QueryInput, *dynamodb.ScanInput, error) {
+	plan, err := dt.Plan(query)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// get first page of results
-		currentPage := int64(1)
-		results, err := dt.conn.Scan(input)
-		if err != nil {
-			return err
+	// build expressions; names are only sent if an expression uses them
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{}
+	keyConditionExpression, err := conditionExpression(plan.KeyConditions, names, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	filterExpression, err := conditionExpression(plan.Filters, names, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	projectionExpression := ""
+	if query != nil {
+		projectionExpression = projection(query.Projection, names)
+	}
+
+	optional := func(expression string) *string {
+		if expression == "" {
+			return nil
 		}
+		return aws.String(expression)
+	}
+	if len(names) == 0 {
+		names = nil
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+
+	if plan.Query {
+		return &dynamodb.QueryInput{
+			TableName:                 aws.String(dt.table),
+			IndexName:                 aws.String(plan.Index),
+			KeyConditionExpression:    aws.String(keyConditionExpression),
+			FilterExpression:          optional(filterExpression),
+			ProjectionExpression:      optional(projectionExpression),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+			ScanIndexForward:          aws.Bool(!query.Descending),
+		}, nil, nil
+	}
+	return nil, &dynamodb.ScanInput{
+		TableName:                 aws.String(dt.table),
+		FilterExpression:          optional(filterExpression),
+		ProjectionExpression:      optional(projectionExpression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}, nil
+}
 
-		// support for pagination: beyond page 1
-		for currentPage < page && len(results.LastEvaluatedKey) > 0 {
-			results, err = dt.conn.Scan(&dynamodb.ScanInput{
-				TableName:         aws.String(dt.table),
-				Limit:             aws.Int64(limit),
-				ExclusiveStartKey: results.LastEvaluatedKey,
-			})
+// conditionExpression builds an expression requiring every condition, adding the attribute names and values it
+// refers to; names are placeholders so attributes can't clash with reserved words
+func conditionExpression(conditions []Condition, names map[string]*string, values map[string]*dynamodb.AttributeValue) (string, error) {
+	clauses := []string{}
+	for _, c := range conditions {
+		name := fmt.Sprintf("#n%d", len(names))
+		names[name] = aws.String(c.Attribute)
+
+		// a range has a placeholder for each bound
+		operands := []interface{}{c.Value}
+		if r, ok := c.Value.(Range); ok && c.Operator == Between {
+			operands = []interface{}{r.From, r.To}
+		}
+		placeholders := []string{}
+		for _, operand := range operands {
+			value, err := dynamodbattribute.Marshal(operand)
 			if err != nil {
-				return err
+				return "", err
 			}
-			currentPage++
+			placeholder := fmt.Sprintf(":v%d", len(values))
+			values[placeholder] = value
+			placeholders = append(placeholders, placeholder)
 		}
 
-		// populate output with results
-		if err := dynamodbattribute.UnmarshalListOfMaps(results.Items, &castTo); err != nil {
-			return err
+		switch c.Operator {
+		case Contains:
+			clauses = append(clauses, fmt.Sprintf("contains(%s, %s)", name, placeholders[0]))
+		case Between:
+			clauses = append(clauses, fmt.Sprintf("%s BETWEEN %s AND %s", name, placeholders[0], placeholders[1]))
+		default:
+			clauses = append(clauses, fmt.Sprintf("%s %s %s", name, c.Operator, placeholders[0]))
 		}
 	}
+	return strings.Join(clauses, " AND "), nil
+}
 
-	return nil
+// projection builds an expression selecting the attributes, adding the attribute names it refers to
+func projection(attributes []string, names map[string]*string) string {
+	placeholders := []string{}
+	for _, attribute := range attributes {
+		name := fmt.Sprintf("#n%d", len(names))
+		names[name] = aws.String(attribute)
+		placeholders = append(placeholders, name)
+	}
+	return strings.Join(placeholders, ", ")
 }
 
 // Store a new Item
-func (dt *DynamoDBTable) Store(item interface{}) error {
+func (dt *DynamoDBTable) Store(ctx context.Context, item interface{}) error {
 	av, err := dynamodbattribute.MarshalMap(item)
 	if err != nil {
 		return err
@@ -155,22 +231,80 @@ func (dt *DynamoDBTable) Store(item interface{}) error {
 		Item:      av,
 		TableName: aws.String(dt.table),
 	}
-	_, err = dt.conn.PutItem(input)
+	_, err = dt.conn.PutItemWithContext(ctx, input)
 	if err != nil {
-		return err
+		return requestError(ctx, err)
 	}
 	return err
 }
 
+// Insert a new item only if no item has its key, otherwise returns a ConflictError
+func (dt *DynamoDBTable) Insert(ctx context.Context, item interface{}) error {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(dt.table),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	_, err = dt.conn.PutItemWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return &ConflictError{}
+		}
+		return requestError(ctx, err)
+	}
+	return nil
+}
+
+// InsertAll inserts new items in a single transaction: either every item is stored or none are. Returns a
+// ConflictError if any item's key is taken
+func (dt *DynamoDBTable) InsertAll(ctx context.Context, items ...interface{}) error {
+	if len(items) > MaxTransactionItems {
+		return fmt.Errorf("a transaction can hold at most %d items", MaxTransactionItems)
+	}
+
+	// create a conditional put for each item
+	writes := []*dynamodb.TransactWriteItem{}
+	for _, item := range items {
+		av, err := dynamodbattribute.MarshalMap(item)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				Item:                av,
+				TableName:           aws.String(dt.table),
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+
+	_, err := dt.conn.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	if err != nil {
+		if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+			for _, reason := range canceled.CancellationReasons {
+				if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+					return &ConflictError{}
+				}
+			}
+		}
+		return requestError(ctx, err)
+	}
+	return nil
+}
+
 // Get an item
-func (dt *DynamoDBTable) Get(key uuid.UUID, castTo interface{}) error {
+func (dt *DynamoDBTable) Get(ctx context.Context, key uuid.UUID, castTo interface{}) error {
 
 	id, err := key.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
-	result, err := dt.conn.GetItem(&dynamodb.GetItemInput{
+	result, err := dt.conn.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(dt.table),
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
@@ -179,7 +313,7 @@ func (dt *DynamoDBTable) Get(key uuid.UUID, castTo interface{}) error {
 		},
 	})
 	if err != nil {
-		return err
+		return requestError(ctx, err)
 	}
 	if result.Item == nil {
 		return &NotFoundError{}
@@ -194,7 +328,12 @@ func (dt *DynamoDBTable) Get(key uuid.UUID, castTo interface{}) error {
 }
 
 // Update an item
-func (dt *DynamoDBTable) Update(key uuid.UUID, castTo interface{}, changeSet ChangeSet) error {
+func (dt *DynamoDBTable) Update(ctx context.Context, key uuid.UUID, castTo interface{}, changeSet ChangeSet) error {
+	return dt.UpdateWhere(ctx, key, castTo, changeSet, nil)
+}
+
+// UpdateWhere updates an item only if it exists and matches all conditions, otherwise returns a ConflictError
+func (dt *DynamoDBTable) UpdateWhere(ctx context.Context, key uuid.UUID, castTo interface{}, changeSet ChangeSet, conditions ConditionSet) error {
 	var err error
 
 	// get binary value of ID
@@ -203,9 +342,119 @@ func (dt *DynamoDBTable) Update(key uuid.UUID, castTo interface{}, changeSet Cha
 		return err
 	}
 
+	// convert change set into attribute values and removals
+	updateAttributes, removeAttributes, err := changeSetAttributes(changeSet)
+	if err != nil {
+		return err
+	}
+
+	// build update expression
+	updateExpressions := []string{}
+	for k := range updateAttributes {
+		updateExpressions = append(updateExpressions, fmt.Sprintf("%s=%s", strings.TrimPrefix(k, ":"), k))
+	}
+	udpateExpression := ""
+	if len(updateExpressions) > 0 {
+		udpateExpression = fmt.Sprintf("SET %s", strings.Join(updateExpressions, ", "))
+	}
+	if len(removeAttributes) > 0 {
+		udpateExpression = strings.TrimSpace(udpateExpression + fmt.Sprintf(" REMOVE %s", strings.Join(removeAttributes, ", ")))
+	}
+
+	// create update config
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(dt.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				B: id,
+			},
+		},
+		UpdateExpression: aws.String(udpateExpression),
+		ReturnValues:     aws.String("ALL_NEW"),
+	}
+
+	// add conditions, which also prevent the update from creating a missing item
+	if conditions != nil {
+		expectedAttributes, absentAttributes, err := changeSetAttributes(ChangeSet(conditions))
+		if err != nil {
+			return err
+		}
+		conditionExpressions := []string{"attribute_exists(id)"}
+		for k, v := range expectedAttributes {
+			placeholder := ":expected_" + strings.TrimPrefix(k, ":")
+			updateAttributes[placeholder] = v
+			conditionExpressions = append(conditionExpressions, fmt.Sprintf("%s=%s", strings.TrimPrefix(k, ":"), placeholder))
+		}
+		for k, v := range conditions {
+			if v == nil {
+				absentAttributes = append(absentAttributes, k)
+			}
+		}
+		for _, k := range absentAttributes {
+			conditionExpressions = append(conditionExpressions, fmt.Sprintf("attribute_not_exists(%s)", k))
+		}
+		input.ConditionExpression = aws.String(strings.Join(conditionExpressions, " AND "))
+	}
+
+	if len(updateAttributes) > 0 {
+		input.ExpressionAttributeValues = updateAttributes
+	}
+
+	// perform update
+	result, err := dt.conn.UpdateItemWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return &ConflictError{}
+		}
+		return requestError(ctx, err)
+	}
+
+	// update original object with updated values
+	if err = dynamodbattribute.UnmarshalMap(result.Attributes, &castTo); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// requestError wraps the error of a request interrupted by its context, so callers can tell a cancelled or
+// timed out request apart from a failed one; the SDK reports both as its own error
+func requestError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %s", ctxErr, err)
+	}
+	return err
+}
+
+// encodeKey serializes a DynamoDB key so it can be handed out as a list position
+func encodeKey(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeKey deserializes a list position created by encodeKey
+func decodeKey(position string) (map[string]*dynamodb.AttributeValue, error) {
+	if position == "" {
+		return nil, nil
+	}
+	var key map[string]*dynamodb.AttributeValue
+	if err := json.Unmarshal([]byte(position), &key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// changeSetAttributes converts a change set into placeholder attribute values to set and attribute names to remove
+func changeSetAttributes(changeSet ChangeSet) (map[string]*dynamodb.AttributeValue, []string, error) {
+
 	// initialize vars that dictate update behavior
 	updateAttributes := map[string]*dynamodb.AttributeValue{}
-	updateExpressions := []string{}
 
 	// initialize vars that dictate remove behavior
 	removeAttributes := []string{}
@@ -224,37 +473,37 @@ func (dt *DynamoDBTable) Update(key uuid.UUID, castTo interface{}, changeSet Cha
 				updateAttributes[placeholder] = &dynamodb.AttributeValue{
 					S: aws.String(val),
 				}
-				updateExpressions = append(updateExpressions, fmt.Sprintf("%s=:%s", k, k))
 			}
 		case int:
 			updateAttributes[placeholder] = &dynamodb.AttributeValue{
 				N: aws.String(strconv.Itoa(v.(int))),
 			}
-			updateExpressions = append(updateExpressions, fmt.Sprintf("%s=:%s", k, k))
 		case int64:
 			updateAttributes[placeholder] = &dynamodb.AttributeValue{
 				N: aws.String(strconv.FormatInt(v.(int64), 10)),
 			}
-			updateExpressions = append(updateExpressions, fmt.Sprintf("%s=:%s", k, k))
 		case bool:
 			updateAttributes[placeholder] = &dynamodb.AttributeValue{
 				BOOL: aws.Bool(v.(bool)),
 			}
-			updateExpressions = append(updateExpressions, fmt.Sprintf("%s=:%s", k, k))
 		case []string:
-			updateAttributes[placeholder] = &dynamodb.AttributeValue{
-				SS: aws.StringSlice(v.([]string)),
+			val := v.([]string)
+			if len(val) == 0 {
+				// remove empty sets, DynamoDB doesn't store them
+				removeAttributes = append(removeAttributes, k)
+			} else {
+				updateAttributes[placeholder] = &dynamodb.AttributeValue{
+					SS: aws.StringSlice(val),
+				}
 			}
-			updateExpressions = append(updateExpressions, fmt.Sprintf("%s=:%s", k, k))
 		case map[string]string:
 			val, err := dynamodbattribute.MarshalMap(v.(map[string]string))
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 			updateAttributes[placeholder] = &dynamodb.AttributeValue{
 				M: val,
 			}
-			updateExpressions = append(updateExpressions, fmt.Sprintf("%s=:%s", k, k))
 		case time.Time:
 			val := v.(time.Time)
 			if val.IsZero() {
@@ -266,49 +515,31 @@ func (dt *DynamoDBTable) Update(key uuid.UUID, castTo interface{}, changeSet Cha
 				updateAttributes[placeholder] = &dynamodb.AttributeValue{
 					S: aws.String(val.Format("2006-01-02T15:04:05Z07:00")),
 				}
-				updateExpressions = append(updateExpressions, fmt.Sprintf("%s=:%s", k, k))
 			}
+		case nil:
+			// nothing to set, nil conditions are handled by the caller
+		default:
+			// lists of structs and other composite values
+			val, err := dynamodbattribute.Marshal(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			updateAttributes[placeholder] = val
 		}
 	}
 
-	udpateExpression := fmt.Sprintf("SET %s", strings.Join(updateExpressions, ", "))
-	if len(removeAttributes) > 0 {
-		udpateExpression = udpateExpression + fmt.Sprintf(" REMOVE %s", strings.Join(removeAttributes, ", "))
-	}
-
-	// perform update
-	result, err := dt.conn.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(dt.table),
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				B: id,
-			},
-		},
-		ExpressionAttributeValues: updateAttributes,
-		UpdateExpression:          aws.String(udpateExpression),
-		ReturnValues:              aws.String("ALL_NEW"),
-	})
-	if err != nil {
-		return err
-	}
-
-	// update original object with updated values
-	if err = dynamodbattribute.UnmarshalMap(result.Attributes, &castTo); err != nil {
-		return err
-	}
-
-	return nil
+	return updateAttributes, removeAttributes, nil
 }
 
 // Delete an item
-func (dt *DynamoDBTable) Delete(key uuid.UUID) error {
+func (dt *DynamoDBTable) Delete(ctx context.Context, key uuid.UUID) error {
 
 	id, err := key.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
-	_, err = dt.conn.DeleteItem(&dynamodb.DeleteItemInput{
+	_, err = dt.conn.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(dt.table),
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
@@ -317,7 +548,7 @@ func (dt *DynamoDBTable) Delete(key uuid.UUID) error {
 		},
 	})
 	if err != nil {
-		return err
+		return requestError(ctx, err)
 	}
 
 	return nil
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// tests that queries compile into DynamoDB QUERY or SCAN inputs
+func TestDynamoDBTableCompile(t *testing.T) {
+	dt := NewDynamoDBTable(nil, "items", Index{Name: "queue-idx", HashKey: "status", RangeKey: "priority_queued"})
+
+	// an index query, in descending order, with a filter and a projection
+	query := NewQuery().UseIndex("queue-idx").Where("status", Equal, 1).Where("priority_queued", Less, "2#").
+		Filter("name", Contains, "a").Select("id", "name")
+	query.Descending = true
+	queryInput, scanInput, err := dt.compile(query)
+	if err != nil {
+		t.Fatalf("compile() returned an error: %v", err)
+	}
+	if queryInput == nil || scanInput != nil {
+		t.Fatalf("compile() was incorrect: got %v and %v, expected a query", queryInput, scanInput)
+	}
+	if got := aws.StringValue(queryInput.IndexName); got != "queue-idx" {
+		t.Errorf("compile() index was incorrect: got %q, expected %q", got, "queue-idx")
+	}
+	if got := aws.StringValue(queryInput.KeyConditionExpression); got != "#n0 = :v0 AND #n1 < :v1" {
+		t.Errorf("compile() key condition was incorrect: got %q, expected %q", got, "#n0 = :v0 AND #n1 < :v1")
+	}
+	if got := aws.StringValue(queryInput.FilterExpression); got != "contains(#n2, :v2)" {
+		t.Errorf("compile() filter was incorrect: got %q, expected %q", got, "contains(#n2, :v2)")
+	}
+	if got := aws.StringValue(queryInput.ProjectionExpression); got != "#n3, #n4" {
+		t.Errorf("compile() projection was incorrect: got %q, expected %q", got, "#n3, #n4")
+	}
+	if len(queryInput.ExpressionAttributeNames) != 5 || aws.StringValue(queryInput.ExpressionAttributeNames["#n4"]) != "name" {
+		t.Errorf("compile() names were incorrect: got %v", queryInput.ExpressionAttributeNames)
+	}
+	if aws.StringValue(queryInput.ExpressionAttributeValues[":v0"].N) != "1" || aws.BoolValue(queryInput.ScanIndexForward) {
+		t.Errorf("compile() was incorrect: got %v", queryInput)
+	}
+
+	// a range has a value for each bound
+	queryInput, _, err = dt.compile(NewQuery().Where("status", Equal, 1).Where("priority_queued", Between, Range{"1#", "1#b"}))
+	if err != nil {
+		t.Fatalf("compile() returned an error: %v", err)
+	}
+	if got := aws.StringValue(queryInput.KeyConditionExpression); got != "#n0 = :v0 AND #n1 BETWEEN :v1 AND :v2" {
+		t.Errorf("compile() key condition was incorrect: got %q, expected %q", got, "#n0 = :v0 AND #n1 BETWEEN :v1 AND :v2")
+	}
+	if aws.StringValue(queryInput.ExpressionAttributeValues[":v2"].S) != "1#b" {
+		t.Errorf("compile() values were incorrect: got %v", queryInput.ExpressionAttributeValues)
+	}
+
+	// without a usable index the table is scanned, and a nil query has no expressions at all
+	_, scanInput, err = dt.compile(NewQuery().Where("name", Equal, "a"))
+	if err != nil {
+		t.Fatalf("compile() returned an error: %v", err)
+	}
+	if scanInput == nil || aws.StringValue(scanInput.FilterExpression) != "#n0 = :v0" {
+		t.Errorf("compile() was incorrect: got %v, expected a filtered scan", scanInput)
+	}
+
+	// indexes that aren't configured yet are never queried
+	dt = NewDynamoDBTable(nil, "items", Index{Name: "", HashKey: "status", RangeKey: "created_at"})
+	_, scanInput, err = dt.compile(NewQuery().Where("status", Equal, 1).OrderBy("created_at", false))
+	if err != nil {
+		t.Fatalf("compile() returned an error: %v", err)
+	}
+	if scanInput == nil || aws.StringValue(scanInput.FilterExpression) != "#n0 = :v0" {
+		t.Errorf("compile() was incorrect: got %v, expected a filtered scan", scanInput)
+	}
+	_, scanInput, err = dt.compile(nil)
+	if err != nil {
+		t.Fatalf("compile() returned an error: %v", err)
+	}
+	if scanInput == nil || scanInput.FilterExpression != nil || scanInput.ExpressionAttributeNames != nil || scanInput.ExpressionAttributeValues != nil {
+		t.Errorf("compile() was incorrect: got %v, expected an unfiltered scan", scanInput)
+	}
+}
+
+// tests that change sets and condition sets convert into values to set and attributes to remove, which Update
+// and UpdateWhere share
+func TestChangeSetAttributes(t *testing.T) {
+	queued := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	updateAttributes, removeAttributes, err := changeSetAttributes(ChangeSet{
+		"status":          1,
+		"priority_queued": "1#2030-01-01T00:00:00+0000",
+		"queued":          queued,
+		"failure_reason":  "",
+		"sent":            time.Time{},
+		"recipients":      []string{},
+		"locked_until":    nil,
+	})
+	if err != nil {
+		t.Fatalf("changeSetAttributes() returned an error: %v", err)
+	}
+	if len(updateAttributes) != 3 {
+		t.Errorf("changeSetAttributes() values were incorrect: got %v, expected 3 values", updateAttributes)
+	}
+	if aws.StringValue(updateAttributes[":status"].N) != "1" || aws.StringValue(updateAttributes[":queued"].S) != "2030-01-01T00:00:00Z" {
+		t.Errorf("changeSetAttributes() values were incorrect: got %v", updateAttributes)
+	}
+	sort.Strings(removeAttributes)
+	if want := []string{"failure_reason", "recipients", "sent"}; !reflect.DeepEqual(removeAttributes, want) {
+		t.Errorf("changeSetAttributes() removals were incorrect: got %v, expected %v", removeAttributes, want)
+	}
+}
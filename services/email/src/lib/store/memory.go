@@ -0,0 +1,474 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+)
+
+// MemoryTable is a thread-safe, in-memory datastore that mimics the behavior of DynamoDBTable; like DynamoDBTable,
+// calls fail with the context's error once it is done
+type MemoryTable struct {
+	mu      sync.RWMutex
+	items   map[uuid.UUID]map[string]*dynamodb.AttributeValue
+	indexes []Index
+}
+
+// NewMemoryTable creates a new, empty in-memory table with the given secondary indexes
+func NewMemoryTable(indexes ...Index) *MemoryTable {
+	return &MemoryTable{
+		items:   map[uuid.UUID]map[string]*dynamodb.AttributeValue{},
+		indexes: indexes,
+	}
+}
+
+// List gets a collection of resources, starting after the position given by startKey; returns the position
+// to continue from, or an empty string if there are no more results. A nil query lists every item
+func (mt *MemoryTable) List(ctx context.Context, castTo interface{}, limit int64, startKey string, query *Query) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// split conditions into key conditions and filters, as DynamoDBTable does
+	plan, err := mt.Plan(query)
+	if err != nil {
+		return "", err
+	}
+	descending := query != nil && query.Descending
+
+	// like DynamoDB, a page must hold at least one item
+	if limit < 1 {
+		return "", fmt.Errorf("limit must be at least 1")
+	}
+
+	// resolve index key schema; the table itself is keyed by `id`
+	index := Index{HashKey: "id"}
+	if plan.Query {
+		index, _ = findIndex(mt.indexes, plan.Index)
+	}
+
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	// collect items visible through the index (indexes are sparse); unlike DynamoDB, filters are applied before
+	// paging, so pages are always full
+	conditions := append(append([]Condition{}, plan.KeyConditions...), plan.Filters...)
+	results := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range mt.items {
+		if !hasAttribute(item, index.HashKey) || (index.RangeKey != "" && !hasAttribute(item, index.RangeKey)) {
+			continue
+		}
+		match, err := matchesConditions(item, conditions)
+		if err != nil {
+			return "", err
+		}
+		if !match {
+			continue
+		}
+		results = append(results, item)
+	}
+
+	// queries are ordered by range key, in either direction, scans by primary key
+	compare := func(a, b map[string]*dynamodb.AttributeValue) int {
+		c := 0
+		if plan.Query && index.RangeKey != "" {
+			c = compareAttributes(a[index.RangeKey], b[index.RangeKey])
+		}
+		if c == 0 {
+			c = bytes.Compare(a["id"].B, b["id"].B)
+		}
+		if plan.Query && descending {
+			return -c
+		}
+		return c
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return compare(results[i], results[j]) < 0
+	})
+
+	// support for pagination: resume after the last evaluated key of the previous page
+	exclusiveStartKey, err := decodeKey(startKey)
+	if err != nil {
+		return "", err
+	}
+	start := 0
+	if exclusiveStartKey != nil {
+		start = sort.Search(len(results), func(i int) bool {
+			return compare(results[i], exclusiveStartKey) > 0
+		})
+	}
+	end := start + int(limit)
+	if end > len(results) {
+		end = len(results)
+	}
+
+	// populate output with results, leaving out attributes that weren't selected
+	page := results[start:end]
+	if query != nil && len(query.Projection) > 0 {
+		page = project(page, query.Projection)
+	}
+	if err := dynamodbattribute.UnmarshalListOfMaps(page, castTo); err != nil {
+		return "", err
+	}
+
+	// like DynamoDB, the last evaluated key holds the table and index keys of the last item
+	if end == len(results) {
+		return "", nil
+	}
+	last := results[end-1]
+	lastEvaluatedKey := map[string]*dynamodb.AttributeValue{"id": last["id"]}
+	if index.HashKey != "id" {
+		lastEvaluatedKey[index.HashKey] = last[index.HashKey]
+	}
+	if index.RangeKey != "" {
+		lastEvaluatedKey[index.RangeKey] = last[index.RangeKey]
+	}
+	return encodeKey(lastEvaluatedKey)
+}
+
+// Plan describes how List would find the items selected by the query
+func (mt *MemoryTable) Plan(query *Query) (ListPlan, error) {
+	return planList(mt.indexes, query)
+}
+
+// Store a new Item
+func (mt *MemoryTable) Store(ctx context.Context, item interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	key, err := itemKey(av)
+	if err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.items[key] = av
+	return nil
+}
+
+// Insert a new item only if no item has its key, otherwise returns a ConflictError
+func (mt *MemoryTable) Insert(ctx context.Context, item interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	key, err := itemKey(av)
+	if err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if _, ok := mt.items[key]; ok {
+		return &ConflictError{}
+	}
+	mt.items[key] = av
+	return nil
+}
+
+// InsertAll inserts new items all at once: either every item is stored or none are. Returns a ConflictError if
+// any item's key is taken
+func (mt *MemoryTable) InsertAll(ctx context.Context, items ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(items) > MaxTransactionItems {
+		return fmt.Errorf("a transaction can hold at most %d items", MaxTransactionItems)
+	}
+
+	// convert items before changing anything
+	avs := map[uuid.UUID]map[string]*dynamodb.AttributeValue{}
+	for _, item := range items {
+		av, err := dynamodbattribute.MarshalMap(item)
+		if err != nil {
+			return err
+		}
+		key, err := itemKey(av)
+		if err != nil {
+			return err
+		}
+		if _, ok := avs[key]; ok {
+			return &ConflictError{}
+		}
+		avs[key] = av
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	for key := range avs {
+		if _, ok := mt.items[key]; ok {
+			return &ConflictError{}
+		}
+	}
+	for key, av := range avs {
+		mt.items[key] = av
+	}
+	return nil
+}
+
+// Get an item
+func (mt *MemoryTable) Get(ctx context.Context, key uuid.UUID, castTo interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	item, ok := mt.items[key]
+	if !ok {
+		return &NotFoundError{}
+	}
+	return dynamodbattribute.UnmarshalMap(item, castTo)
+}
+
+// Update an item
+func (mt *MemoryTable) Update(ctx context.Context, key uuid.UUID, castTo interface{}, changeSet ChangeSet) error {
+	return mt.UpdateWhere(ctx, key, castTo, changeSet, nil)
+}
+
+// UpdateWhere updates an item only if it exists and matches all conditions, otherwise returns a ConflictError
+func (mt *MemoryTable) UpdateWhere(ctx context.Context, key uuid.UUID, castTo interface{}, changeSet ChangeSet, conditions ConditionSet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// convert change set into attribute values and removals
+	updateAttributes, removeAttributes, err := changeSetAttributes(changeSet)
+	if err != nil {
+		return err
+	}
+
+	// convert conditions into expected attribute values and absences
+	expectedAttributes, absentAttributes, err := changeSetAttributes(ChangeSet(conditions))
+	if err != nil {
+		return err
+	}
+	for k, v := range conditions {
+		if v == nil {
+			absentAttributes = append(absentAttributes, k)
+		}
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	// check conditions against the current item
+	item, ok := mt.items[key]
+	if conditions != nil {
+		if !ok {
+			return &ConflictError{}
+		}
+		for placeholder, v := range expectedAttributes {
+			current := item[strings.TrimPrefix(placeholder, ":")]
+			if !hasAttribute(item, strings.TrimPrefix(placeholder, ":")) || !equalAttributes(current, v) {
+				return &ConflictError{}
+			}
+		}
+		for _, k := range absentAttributes {
+			if hasAttribute(item, k) {
+				return &ConflictError{}
+			}
+		}
+	}
+
+	// like DynamoDB, updating a missing item creates it
+	if !ok {
+		id, err := key.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		item = map[string]*dynamodb.AttributeValue{"id": {B: id}}
+	}
+
+	// copy item so readers of the previous version are unaffected
+	updated := make(map[string]*dynamodb.AttributeValue, len(item)+len(updateAttributes))
+	for k, v := range item {
+		updated[k] = v
+	}
+	for placeholder, v := range updateAttributes {
+		updated[strings.TrimPrefix(placeholder, ":")] = v
+	}
+	for _, k := range removeAttributes {
+		delete(updated, k)
+	}
+	mt.items[key] = updated
+
+	// update original object with updated values
+	return dynamodbattribute.UnmarshalMap(updated, castTo)
+}
+
+// Delete an item
+func (mt *MemoryTable) Delete(ctx context.Context, key uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	delete(mt.items, key)
+	return nil
+}
+
+// itemKey reads the binary `id` attribute of an item
+func itemKey(item map[string]*dynamodb.AttributeValue) (uuid.UUID, error) {
+	if item["id"] == nil || item["id"].B == nil {
+		return uuid.Nil, fmt.Errorf("item is missing binary key attribute: id")
+	}
+	return uuid.FromBytes(item["id"].B)
+}
+
+// hasAttribute checks that an item has a non-null value for an attribute
+func hasAttribute(item map[string]*dynamodb.AttributeValue, name string) bool {
+	return item[name] != nil && !aws.BoolValue(item[name].NULL)
+}
+
+// project copies items with only the given attributes
+func project(items []map[string]*dynamodb.AttributeValue, attributes []string) []map[string]*dynamodb.AttributeValue {
+	projected := make([]map[string]*dynamodb.AttributeValue, len(items))
+	for i, item := range items {
+		projected[i] = map[string]*dynamodb.AttributeValue{}
+		for _, name := range attributes {
+			if value, ok := item[name]; ok {
+				projected[i][name] = value
+			}
+		}
+	}
+	return projected
+}
+
+// matchesConditions checks an item against conditions, as a DynamoDB key condition or filter expression would
+func matchesConditions(item map[string]*dynamodb.AttributeValue, conditions []Condition) (bool, error) {
+	for _, c := range conditions {
+
+		// a range is checked as a pair of inclusive bounds
+		if r, ok := c.Value.(Range); ok && c.Operator == Between {
+			match, err := matchesConditions(item, []Condition{
+				{Attribute: c.Attribute, Operator: GreaterEqual, Value: r.From},
+				{Attribute: c.Attribute, Operator: LessEqual, Value: r.To},
+			})
+			if err != nil || !match {
+				return false, err
+			}
+			continue
+		}
+
+		value, err := dynamodbattribute.Marshal(c.Value)
+		if err != nil {
+			return false, err
+		}
+		if !hasAttribute(item, c.Attribute) {
+			return false, nil
+		}
+		attribute := item[c.Attribute]
+
+		var match bool
+		switch c.Operator {
+		case Equal:
+			match = equalAttributes(attribute, value)
+		case Contains:
+			match = containsAttribute(attribute, value)
+		default:
+			if !sameScalarType(attribute, value) {
+				return false, nil
+			}
+			order := compareAttributes(attribute, value)
+			switch c.Operator {
+			case Less:
+				match = order < 0
+			case LessEqual:
+				match = order <= 0
+			case Greater:
+				match = order > 0
+			case GreaterEqual:
+				match = order >= 0
+			default:
+				return false, fmt.Errorf("unsupported operator: %s", c.Operator)
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// containsAttribute checks whether a list or set holds a value, or a string holds a substring
+func containsAttribute(attribute, value *dynamodb.AttributeValue) bool {
+	switch {
+	case attribute.L != nil:
+		for _, element := range attribute.L {
+			if equalAttributes(element, value) {
+				return true
+			}
+		}
+	case attribute.SS != nil && value.S != nil:
+		for _, element := range attribute.SS {
+			if aws.StringValue(element) == aws.StringValue(value.S) {
+				return true
+			}
+		}
+	case attribute.S != nil && value.S != nil:
+		return strings.Contains(aws.StringValue(attribute.S), aws.StringValue(value.S))
+	}
+	return false
+}
+
+// sameScalarType checks that two attribute values are both numbers, strings or binary
+func sameScalarType(a, b *dynamodb.AttributeValue) bool {
+	return (a.N != nil && b.N != nil) || (a.S != nil && b.S != nil) || (a.B != nil && b.B != nil)
+}
+
+// equalAttributes checks two attribute values of any type for equality
+func equalAttributes(a, b *dynamodb.AttributeValue) bool {
+	if (a.N != nil && b.N != nil) || (a.S != nil && b.S != nil) || (a.B != nil && b.B != nil) {
+		return compareAttributes(a, b) == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareAttributes orders two scalar attribute values of the same type
+func compareAttributes(a, b *dynamodb.AttributeValue) int {
+	switch {
+	case a.N != nil && b.N != nil:
+		x, _ := strconv.ParseFloat(aws.StringValue(a.N), 64)
+		y, _ := strconv.ParseFloat(aws.StringValue(b.N), 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case a.S != nil && b.S != nil:
+		return strings.Compare(aws.StringValue(a.S), aws.StringValue(b.S))
+	case a.B != nil && b.B != nil:
+		return bytes.Compare(a.B, b.B)
+	}
+	return strings.Compare(a.String(), b.String())
+}
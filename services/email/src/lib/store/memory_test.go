@@ -0,0 +1,356 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ctx is the context of datastore calls in tests
+var ctx = context.Background()
+
+type testItem struct {
+	ID             uuid.UUID `json:"id"`
+	Name           string    `json:"name"`
+	Status         int       `json:"status"`
+	PriorityQueued string    `json:"priority_queued"`
+	Queued         time.Time `json:"queued"`
+}
+
+func createMockTable(t *testing.T, items ...*testItem) *MemoryTable {
+	mt := NewMemoryTable(Index{Name: "queue-idx", HashKey: "status", RangeKey: "priority_queued"})
+	for _, item := range items {
+		if err := mt.Store(ctx, item); err != nil {
+			t.Fatalf("Store() returned an error: %v", err)
+		}
+	}
+	return mt
+}
+
+// tests that Get returns stored items and NotFoundError for missing ones
+func TestMemoryTableGet(t *testing.T) {
+	item := &testItem{ID: uuid.New(), Name: "one", Status: 1}
+	mt := createMockTable(t, item)
+
+	var result *testItem
+	if err := mt.Get(ctx, item.ID, &result); err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if result.Name != "one" || result.Status != 1 {
+		t.Errorf("Get() was incorrect: got %+v, expected %+v", result, item)
+	}
+
+	var missing *testItem
+	err := mt.Get(ctx, uuid.New(), &missing)
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("Get() error was incorrect: got %v, expected NotFoundError", err)
+	}
+}
+
+// tests that Insert only stores items whose key is not taken
+func TestMemoryTableInsert(t *testing.T) {
+	item := &testItem{ID: uuid.New(), Name: "one", Status: 1}
+	mt := createMockTable(t)
+
+	if err := mt.Insert(ctx, item); err != nil {
+		t.Fatalf("Insert() returned an error: %v", err)
+	}
+
+	err := mt.Insert(ctx, &testItem{ID: item.ID, Name: "two"})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("Insert() error was incorrect: got %v, expected ConflictError", err)
+	}
+
+	var result *testItem
+	if err := mt.Get(ctx, item.ID, &result); err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if result.Name != "one" {
+		t.Errorf("Insert() overwrote the item: got %+v, expected %+v", result, item)
+	}
+}
+
+// tests that InsertAll stores every item or none
+func TestMemoryTableInsertAll(t *testing.T) {
+	existing := &testItem{ID: uuid.New(), Name: "existing"}
+	mt := createMockTable(t, existing)
+
+	one, two := &testItem{ID: uuid.New(), Name: "one"}, &testItem{ID: uuid.New(), Name: "two"}
+	var conflict *ConflictError
+	if err := mt.InsertAll(ctx, one, existing); !errors.As(err, &conflict) {
+		t.Errorf("InsertAll() error was incorrect: got %v, expected ConflictError", err)
+	}
+	var missing *testItem
+	if err := mt.Get(ctx, one.ID, &missing); err == nil {
+		t.Errorf("InsertAll() stored %+v from a failed transaction", missing)
+	}
+
+	if err := mt.InsertAll(ctx, one, two); err != nil {
+		t.Fatalf("InsertAll() returned an error: %v", err)
+	}
+	for _, item := range []*testItem{one, two} {
+		var result *testItem
+		if err := mt.Get(ctx, item.ID, &result); err != nil || result.Name != item.Name {
+			t.Errorf("InsertAll() was incorrect: got %+v (%v), expected %+v", result, err, item)
+		}
+	}
+}
+
+// tests that List supports index queries, sparse indexes and paging
+func TestMemoryTableList(t *testing.T) {
+	mt := createMockTable(t,
+		&testItem{ID: uuid.New(), Name: "c", Status: 1, PriorityQueued: "2#a"},
+		&testItem{ID: uuid.New(), Name: "a", Status: 1, PriorityQueued: "1#b"},
+		&testItem{ID: uuid.New(), Name: "b", Status: 1, PriorityQueued: "1#c"},
+		&testItem{ID: uuid.New(), Name: "d", Status: 2, PriorityQueued: "1#a"},
+		&testItem{ID: uuid.New(), Name: "e", Status: 1},
+	)
+
+	query := NewQuery().UseIndex("queue-idx").Where("status", Equal, 1)
+
+	// page through the queue index two at a time
+	pages := [][]string{}
+	startKey := ""
+	for {
+		var results []*testItem
+		next, err := mt.List(ctx, &results, 2, startKey, query)
+		if err != nil {
+			t.Fatalf("List() returned an error: %v", err)
+		}
+		names := []string{}
+		for _, result := range results {
+			names = append(names, result.Name)
+		}
+		pages = append(pages, names)
+		if next == "" {
+			break
+		}
+		startKey = next
+	}
+
+	expectedPages := [][]string{{"a", "b"}, {"c"}}
+	if !reflect.DeepEqual(pages, expectedPages) {
+		t.Errorf("List() pages were incorrect: got %v, expected %v", pages, expectedPages)
+	}
+
+	// scan returns every item in a single page
+	var results []*testItem
+	next, err := mt.List(ctx, &results, 10, "", nil)
+	if err != nil {
+		t.Fatalf("List() returned an error: %v", err)
+	}
+	if len(results) != 5 || next != "" {
+		t.Errorf("List() scan was incorrect: got %d items and next key %q, expected %d items and no next key", len(results), next, 5)
+	}
+}
+
+// tests that List plans conditions into an index query or a filtered scan, in either direction
+func TestMemoryTableListConditions(t *testing.T) {
+	mt := NewMemoryTable(
+		Index{Name: "queue-idx", HashKey: "status", RangeKey: "priority_queued"},
+		Index{Name: "status-name-idx", HashKey: "status", RangeKey: "name"},
+	)
+	for _, item := range []*testItem{
+		{ID: uuid.New(), Name: "c", Status: 1, PriorityQueued: "2#a"},
+		{ID: uuid.New(), Name: "a", Status: 1},
+		{ID: uuid.New(), Name: "b", Status: 1, PriorityQueued: "1#c"},
+		{ID: uuid.New(), Name: "d", Status: 2, PriorityQueued: "1#a"},
+	} {
+		if err := mt.Store(ctx, item); err != nil {
+			t.Fatalf("Store() returned an error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		conditions []Condition
+		descending bool
+		index      string
+		names      []string
+	}{
+		{[]Condition{{"status", Equal, 1}}, false, "status-name-idx", []string{"a", "b", "c"}},
+		{[]Condition{{"status", Equal, 1}}, true, "status-name-idx", []string{"c", "b", "a"}},
+		{[]Condition{{"status", Equal, 1}, {"name", Greater, "a"}}, false, "status-name-idx", []string{"b", "c"}},
+		{[]Condition{{"status", Equal, 1}, {"priority_queued", GreaterEqual, "2#"}}, false, "status-name-idx", []string{"c"}},
+		{[]Condition{{"status", Equal, 1}, {"name", Between, Range{"b", "c"}}}, true, "status-name-idx", []string{"c", "b"}},
+		{[]Condition{{"name", LessEqual, "b"}}, false, "", nil},
+		{[]Condition{{"priority_queued", Contains, "#a"}}, false, "", nil},
+	}
+	for i, tc := range tests {
+		query := &Query{Conditions: tc.conditions}
+		query.OrderBy("name", tc.descending)
+		plan, err := mt.Plan(query)
+		if err != nil {
+			t.Fatalf("case %d: Plan() returned an error: %v", i, err)
+		}
+		if plan.Index != tc.index || plan.Query != (tc.index != "") || plan.Sorted != (tc.index != "") {
+			t.Errorf("case %d: Plan() was incorrect: got %+v, expected index %q", i, plan, tc.index)
+		}
+
+		var results []*testItem
+		if _, err := mt.List(ctx, &results, 10, "", query); err != nil {
+			t.Fatalf("case %d: List() returned an error: %v", i, err)
+		}
+		names := []string{}
+		for _, result := range results {
+			names = append(names, result.Name)
+		}
+		if tc.names != nil && !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("case %d: List() was incorrect: got %v, expected %v", i, names, tc.names)
+		}
+		if tc.names == nil && len(names) != 2 {
+			t.Errorf("case %d: List() scan was incorrect: got %v, expected 2 items", i, names)
+		}
+	}
+
+	// a sparse index is only used when its range key has a condition
+	plan, _ := mt.Plan(NewQuery().Where("status", Equal, 1))
+	if plan.Query {
+		t.Errorf("Plan() used a sparse index: got %+v, expected a scan", plan)
+	}
+	plan, _ = mt.Plan(NewQuery().Where("status", Equal, 1).Where("priority_queued", Less, "2#"))
+	if plan.Index != "queue-idx" || len(plan.KeyConditions) != 2 || len(plan.Filters) != 0 {
+		t.Errorf("Plan() was incorrect: got %+v, expected a query of queue-idx", plan)
+	}
+	if _, err := mt.Plan(NewQuery().Where("status", "<>", 1)); err == nil {
+		t.Errorf("Plan() accepted an unsupported operator")
+	}
+	if _, err := mt.Plan(NewQuery().Where("name", Between, "b")); err == nil {
+		t.Errorf("Plan() accepted a between condition without a range")
+	}
+}
+
+// tests that List honors index hints, filters and projections
+func TestMemoryTableListQuery(t *testing.T) {
+	mt := createMockTable(t,
+		&testItem{ID: uuid.New(), Name: "c", Status: 1, PriorityQueued: "2#a"},
+		&testItem{ID: uuid.New(), Name: "a", Status: 1, PriorityQueued: "1#b"},
+		&testItem{ID: uuid.New(), Name: "b", Status: 1},
+	)
+
+	// a hinted sparse index is queried without a range key condition, filters are never key conditions
+	query := NewQuery().UseIndex("queue-idx").Where("status", Equal, 1).Filter("priority_queued", Less, "2#").Select("name")
+	plan, err := mt.Plan(query)
+	if err != nil {
+		t.Fatalf("Plan() returned an error: %v", err)
+	}
+	if plan.Index != "queue-idx" || !plan.Sorted || len(plan.KeyConditions) != 1 || len(plan.Filters) != 1 {
+		t.Errorf("Plan() was incorrect: got %+v, expected a sorted query of queue-idx with one filter", plan)
+	}
+	var results []*testItem
+	if _, err := mt.List(ctx, &results, 10, "", query); err != nil {
+		t.Fatalf("List() returned an error: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "a" || results[0].Status != 0 || results[0].ID != uuid.Nil {
+		t.Errorf("List() was incorrect: got %+v, expected only the name of item a", results)
+	}
+
+	// hints must name a known index and be served by its hash key
+	if _, err := mt.Plan(NewQuery().UseIndex("missing-idx").Where("status", Equal, 1)); err == nil {
+		t.Errorf("Plan() accepted an unknown index")
+	}
+	if _, err := mt.Plan(NewQuery().UseIndex("queue-idx").Where("status", Greater, 0)); err == nil {
+		t.Errorf("Plan() accepted an index without a hash key condition")
+	}
+}
+
+// tests that Update applies a change set, removing empty strings and zero times
+func TestMemoryTableUpdate(t *testing.T) {
+	item := &testItem{ID: uuid.New(), Name: "one", Status: 1, PriorityQueued: "1#a", Queued: time.Now()}
+	mt := createMockTable(t, item)
+
+	var result *testItem
+	err := mt.Update(ctx, item.ID, &result, ChangeSet{
+		"status":          2,
+		"priority_queued": "",
+		"queued":          time.Time{},
+	})
+	if err != nil {
+		t.Fatalf("Update() returned an error: %v", err)
+	}
+	if result.Status != 2 || result.Name != "one" || result.PriorityQueued != "" || !result.Queued.IsZero() {
+		t.Errorf("Update() was incorrect: got %+v", result)
+	}
+
+	// removed attributes drop the item from the sparse index
+	var results []*testItem
+	_, err = mt.List(ctx, &results, 10, "", NewQuery().UseIndex("queue-idx").Where("status", Equal, 2))
+	if err != nil {
+		t.Fatalf("List() returned an error: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("List() length was incorrect: got %d, expected %d", len(results), 0)
+	}
+
+	// deleted items are no longer found
+	if err := mt.Delete(ctx, item.ID); err != nil {
+		t.Fatalf("Delete() returned an error: %v", err)
+	}
+	var notFound *NotFoundError
+	if err := mt.Get(ctx, item.ID, &result); !errors.As(err, &notFound) {
+		t.Errorf("Get() error was incorrect: got %v, expected NotFoundError", err)
+	}
+}
+
+// tests that UpdateWhere only applies changes when the item matches all conditions
+func TestMemoryTableUpdateWhere(t *testing.T) {
+	item := &testItem{ID: uuid.New(), Name: "one", Status: 1, PriorityQueued: "1#a"}
+
+	type test struct {
+		key        uuid.UUID
+		conditions ConditionSet
+		conflict   bool
+	}
+
+	tests := []test{
+		{item.ID, ConditionSet{"status": 1, "name": "one"}, false},
+		{item.ID, ConditionSet{"status": 2}, true},
+		{item.ID, ConditionSet{"name": "two"}, true},
+		{item.ID, ConditionSet{"missing": nil}, false},
+		{item.ID, ConditionSet{"priority_queued": ""}, true},
+		{uuid.New(), ConditionSet{}, true},
+	}
+
+	for i, tc := range tests {
+		mt := createMockTable(t, item)
+		var result *testItem
+		err := mt.UpdateWhere(ctx, tc.key, &result, ChangeSet{"status": 3}, tc.conditions)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) != tc.conflict {
+			t.Errorf("UpdateWhere() case %d error was incorrect: got %v, expected conflict %v", i, err, tc.conflict)
+		}
+
+		// rejected changes must leave the item untouched
+		var current *testItem
+		if err := mt.Get(ctx, item.ID, &current); err != nil {
+			t.Fatalf("Get() returned an error: %v", err)
+		}
+		expectedStatus := 3
+		if tc.conflict {
+			expectedStatus = 1
+		}
+		if current.Status != expectedStatus {
+			t.Errorf("UpdateWhere() case %d status was incorrect: got %d, expected %d", i, current.Status, expectedStatus)
+		}
+	}
+}
+
+// tests that calls fail with the context's error once it is done
+func TestMemoryTableContext(t *testing.T) {
+	mt := createMockTable(t, &testItem{ID: uuid.New(), Name: "a", Status: 1})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var results []*testItem
+	if _, err := mt.List(cancelled, &results, 10, "", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("List() with a cancelled context: got %v, expected %v", err, context.Canceled)
+	}
+	if err := mt.Store(cancelled, &testItem{ID: uuid.New()}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Store() with a cancelled context: got %v, expected %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,188 @@
+package store
+
+import "fmt"
+
+// Condition operators
+const (
+	Equal        = "="
+	Less         = "<"
+	LessEqual    = "<="
+	Greater      = ">"
+	GreaterEqual = ">="
+	Between      = "between"
+	Contains     = "contains"
+)
+
+// Condition compares an attribute to a value; List only returns items that meet all of its conditions
+type Condition struct {
+	Attribute string
+	Operator  string
+	Value     interface{}
+}
+
+// Range is the value of a Between condition; both bounds are inclusive
+type Range struct {
+	From interface{}
+	To   interface{}
+}
+
+// Query selects the items List returns, independent of the datastore. Conditions may be served by an index's
+// key, filters never are; an index hint picks the index to query instead of leaving it to the planner
+type Query struct {
+	Index      string
+	Conditions []Condition
+	Filters    []Condition
+	SortKey    string
+	Descending bool
+	Projection []string
+}
+
+// NewQuery creates an empty query, which scans the whole table
+func NewQuery() *Query {
+	return &Query{}
+}
+
+// Where adds a condition, which may become a key condition of an index query
+func (q *Query) Where(attribute, operator string, value interface{}) *Query {
+	q.Conditions = append(q.Conditions, Condition{Attribute: attribute, Operator: operator, Value: value})
+	return q
+}
+
+// Filter adds a condition that is only applied to the items read
+func (q *Query) Filter(attribute, operator string, value interface{}) *Query {
+	q.Filters = append(q.Filters, Condition{Attribute: attribute, Operator: operator, Value: value})
+	return q
+}
+
+// UseIndex queries the named index, which needs an equality condition on its hash key
+func (q *Query) UseIndex(name string) *Query {
+	q.Index = name
+	return q
+}
+
+// OrderBy prefers an index ordered by the attribute, in either direction
+func (q *Query) OrderBy(attribute string, descending bool) *Query {
+	q.SortKey = attribute
+	q.Descending = descending
+	return q
+}
+
+// Select only returns the given attributes of each item
+func (q *Query) Select(attributes ...string) *Query {
+	q.Projection = append(q.Projection, attributes...)
+	return q
+}
+
+// ListPlan describes how List finds items: a query of an index by its key conditions, or a scan of the whole
+// table; the remaining conditions filter the items read. Sorted plans return items ordered by the query's sort
+// key, or by the index's range key if it has none
+type ListPlan struct {
+	Index         string
+	Query         bool
+	Sorted        bool
+	KeyConditions []Condition
+	Filters       []Condition
+}
+
+// planList picks the index to query. An index's hash key needs an equality condition; since indexes are sparse,
+// its range key needs a condition too, unless it's the sort key, which every item is assumed to have, or the
+// index was hinted. Indexes ordered by the sort key are preferred, and without a usable index the table is scanned;
+// indexes without a name aren't configured (e.g. not created yet) and are never chosen
+func planList(indexes []Index, query *Query) (ListPlan, error) {
+	if query == nil {
+		return ListPlan{}, nil
+	}
+	for _, c := range append(append([]Condition{}, query.Conditions...), query.Filters...) {
+		switch c.Operator {
+		case Equal, Less, LessEqual, Greater, GreaterEqual, Contains:
+		case Between:
+			if _, ok := c.Value.(Range); !ok {
+				return ListPlan{}, fmt.Errorf("between condition on %s needs a Range value", c.Attribute)
+			}
+		default:
+			return ListPlan{}, fmt.Errorf("unsupported operator: %s", c.Operator)
+		}
+	}
+
+	var index Index
+	if query.Index != "" {
+
+		// use the hinted index
+		var ok bool
+		if index, ok = findIndex(indexes, query.Index); !ok {
+			return ListPlan{}, fmt.Errorf("index not found: %s", query.Index)
+		}
+		if !hasCondition(query.Conditions, index.HashKey, true) {
+			return ListPlan{}, fmt.Errorf("index %s needs an equality condition on %s", index.Name, index.HashKey)
+		}
+
+	} else {
+
+		// rank the indexes that can serve the conditions
+		best, bestScore := -1, 0
+		for i, index := range indexes {
+			if index.Name == "" || !hasCondition(query.Conditions, index.HashKey, true) {
+				continue
+			}
+			score := 0
+			switch {
+			case index.RangeKey == "":
+				score = 1
+			case query.SortKey != "" && index.RangeKey == query.SortKey:
+				score = 3
+			case hasCondition(query.Conditions, index.RangeKey, false):
+				score = 2
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			filters := append(append([]Condition{}, query.Conditions...), query.Filters...)
+			return ListPlan{Filters: filters}, nil
+		}
+		index = indexes[best]
+	}
+
+	// one condition on each key can be a key condition, the rest are filters
+	plan := ListPlan{
+		Index:  index.Name,
+		Query:  true,
+		Sorted: index.RangeKey != "" && (query.SortKey == "" || index.RangeKey == query.SortKey),
+	}
+	hashKeyUsed, rangeKeyUsed := false, false
+	for _, c := range query.Conditions {
+		switch {
+		case !hashKeyUsed && c.Attribute == index.HashKey && c.Operator == Equal:
+			hashKeyUsed = true
+			plan.KeyConditions = append(plan.KeyConditions, c)
+		case !rangeKeyUsed && c.Attribute == index.RangeKey && c.Operator != Contains:
+			rangeKeyUsed = true
+			plan.KeyConditions = append(plan.KeyConditions, c)
+		default:
+			plan.Filters = append(plan.Filters, c)
+		}
+	}
+	plan.Filters = append(plan.Filters, query.Filters...)
+	return plan, nil
+}
+
+// findIndex finds a secondary index by name
+func findIndex(indexes []Index, name string) (Index, bool) {
+	for _, index := range indexes {
+		if index.Name == name {
+			return index, true
+		}
+	}
+	return Index{}, false
+}
+
+// hasCondition checks for a condition on an attribute that a key condition can use
+func hasCondition(conditions []Condition, attribute string, equal bool) bool {
+	for _, c := range conditions {
+		if c.Attribute == attribute && c.Operator != Contains && (!equal || c.Operator == Equal) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,18 +1,26 @@
 package store
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/google/uuid"
 )
 
-// Datastore is a generic interface for a datastore
+// MaxTransactionItems is the most items a datastore can write in one transaction
+const MaxTransactionItems = 100
+
+// Datastore is a generic interface for a datastore; calls give up when their context is done
 type Datastore interface {
-	List(castTo interface{}, page, limit int64, options ...interface{}) error
-	Store(item interface{}) error
-	Get(key uuid.UUID, castTo interface{}) error
-	Update(key uuid.UUID, castTo interface{}, changeSet ChangeSet) error
-	Delete(key uuid.UUID) error
+	List(ctx context.Context, castTo interface{}, limit int64, startKey string, query *Query) (string, error)
+	Store(ctx context.Context, item interface{}) error
+	Insert(ctx context.Context, item interface{}) error
+	InsertAll(ctx context.Context, items ...interface{}) error
+	Get(ctx context.Context, key uuid.UUID, castTo interface{}) error
+	Update(ctx context.Context, key uuid.UUID, castTo interface{}, changeSet ChangeSet) error
+	UpdateWhere(ctx context.Context, key uuid.UUID, castTo interface{}, changeSet ChangeSet, conditions ConditionSet) error
+	Delete(ctx context.Context, key uuid.UUID) error
+	Plan(query *Query) (ListPlan, error)
 }
 
 // NotFoundError error type for records not found in the datastore
@@ -22,5 +30,23 @@ func (e *NotFoundError) Error() string {
 	return fmt.Sprintf("Item not found")
 }
 
+// ConflictError error type for changes rejected because the item no longer matches the expected conditions
+type ConflictError struct{}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Item has been modified")
+}
+
 // ChangeSet is a generic interface to map attribute changes
 type ChangeSet map[string]interface{}
+
+// ConditionSet is a generic interface to map the attribute values an item must currently have for a change to apply;
+// nil values, empty strings and zero times require the attribute to be absent
+type ConditionSet map[string]interface{}
+
+// Index describes a secondary index of a table
+type Index struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+}
@@ -1,7 +1,9 @@
 package validation
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -18,11 +20,65 @@ func AddCustomTypeFunc(function validator.CustomTypeFunc, customType interface{}
 	customTypeFuncs = append(customTypeFuncs, &ctf{function, customType})
 }
 
-// Check performs validation on a struct using github.com/go-playground/validator rules.
-func Check(s interface{}) (bool, map[string]map[string]map[string]string) {
+// FieldError describes a field that failed a validation rule
+type FieldError struct {
+	Path    string `json:"path"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param"`
+	Message string `json:"message"`
+}
+
+// Errors are the validation errors of a struct, in field order
+type Errors []*FieldError
+
+// Error implements the error interface
+func (errs Errors) Error() string {
+	messages := []string{}
+	for _, e := range errs {
+		messages = append(messages, e.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Prefix nests the errors under a parent path, e.g. the errors of an element validated on its own
+func (errs Errors) Prefix(path string) Errors {
+	nested := Errors{}
+	for _, e := range errs {
+		nested = append(nested, &FieldError{
+			Path:    joinPath(path, e.Path),
+			Rule:    e.Rule,
+			Param:   e.Param,
+			Message: joinPath(path, e.Message),
+		})
+	}
+	return nested
+}
 
-	// init validation
+// Map groups the errors by path, then by rule with its parameter
+func (errs Errors) Map() map[string]map[string]string {
+	errorMap := map[string]map[string]string{}
+	for _, e := range errs {
+		if errorMap[e.Path] == nil {
+			errorMap[e.Path] = map[string]string{}
+		}
+		errorMap[e.Path][e.Rule] = e.Param
+	}
+	return errorMap
+}
+
+// Validate performs validation on a struct using github.com/go-playground/validator rules; errors are reported by
+// JSON path, e.g. `emails[3].recipients[1]`. Returns nil if the struct is valid
+func Validate(s interface{}) Errors {
+
+	// init validation, naming fields after their JSON keys
 	validate := validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
 
 	// register custom typ functions
 	for _, ctf := range customTypeFuncs {
@@ -31,27 +87,90 @@ func Check(s interface{}) (bool, map[string]map[string]map[string]string) {
 
 	// perform validation
 	err := validate.Struct(s)
+	if err == nil {
+		return nil
+	}
 
-	// validation did not pass
-	if err != nil {
-		errorMap := make(map[string]map[string]map[string]string)
-		errorMap["errors"] = map[string]map[string]string{}
-
-		val := reflect.ValueOf(s)
-
-		// loop over validation errors, add to output map
-		for _, e := range err.(validator.ValidationErrors) {
-			field, _ := val.Type().FieldByName(e.Field())
-			jsonName := field.Tag.Get("json")
-			if errorMap["errors"][jsonName] == nil {
-				errorMap["errors"][jsonName] = map[string]string{}
-			}
-			errorMap["errors"][jsonName][e.Tag()] = e.Param()
+	// loop over validation errors; the namespace starts with the struct's type name
+	errs := Errors{}
+	for _, e := range err.(validator.ValidationErrors) {
+		path := e.Namespace()
+		if i := strings.Index(path, "."); i >= 0 {
+			path = path[i+1:]
 		}
+		errs = append(errs, &FieldError{
+			Path:    path,
+			Rule:    e.Tag(),
+			Param:   e.Param(),
+			Message: fmt.Sprintf("%s %s", path, message(e)),
+		})
+	}
+	return errs
+}
 
+// Check performs validation on a struct using github.com/go-playground/validator rules.
+func Check(s interface{}) (bool, map[string]map[string]map[string]string) {
+	errs := Validate(s)
+
+	// validation did not pass
+	if errs != nil {
+		errorMap := make(map[string]map[string]map[string]string)
+		errorMap["errors"] = errs.Map()
 		return false, errorMap
 	}
 
 	// validation passed
 	return true, nil
 }
+
+// message describes a failed rule, e.g. "must be a valid email address"
+func message(e validator.FieldError) string {
+	countable := e.Kind() == reflect.String || e.Kind() == reflect.Slice || e.Kind() == reflect.Map || e.Kind() == reflect.Array
+	unit := "item"
+	if e.Kind() == reflect.String {
+		unit = "character"
+	}
+	if e.Param() != "1" {
+		unit += "s"
+	}
+
+	switch e.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "url":
+		return "must be a valid URL"
+	case "numeric":
+		return "must be a number"
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", strings.Join(strings.Fields(e.Param()), ", "))
+	case "len":
+		if countable {
+			return fmt.Sprintf("must be exactly %s %s long", e.Param(), unit)
+		}
+		return fmt.Sprintf("must be %s", e.Param())
+	case "min", "gte":
+		if countable {
+			return fmt.Sprintf("must have at least %s %s", e.Param(), unit)
+		}
+		return fmt.Sprintf("must be %s or greater", e.Param())
+	case "max", "lte":
+		if countable {
+			return fmt.Sprintf("must have at most %s %s", e.Param(), unit)
+		}
+		return fmt.Sprintf("must be %s or less", e.Param())
+	}
+	return fmt.Sprintf("failed the %s rule", e.Tag())
+}
+
+// joinPath prefixes a path, or a message starting with one, with a parent path
+func joinPath(parent, path string) string {
+	if parent == "" {
+		return path
+	}
+	if strings.HasPrefix(path, "[") {
+		return parent + path
+	}
+	return parent + "." + path
+}
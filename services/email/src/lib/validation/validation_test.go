@@ -155,3 +155,46 @@ func TestCheckFailWithEmptyCustomTypeFunc(t *testing.T) {
 	// reset customTypeFuncs
 	customTypeFuncs = customTypeFuncs[:0]
 }
+
+type testRecipient struct {
+	Address string `json:"address" validate:"required,email"`
+}
+
+type testBatch struct {
+	Name       string          `json:"name" validate:"required"`
+	Recipients []testRecipient `json:"recipients" validate:"required,min=1,dive"`
+	Tags       []string        `json:"tags" validate:"dive,max=3"`
+}
+
+// tests that Validate reports nested errors by JSON path
+func TestValidate(t *testing.T) {
+	payload := testBatch{
+		Recipients: []testRecipient{{Address: "a@example.com"}, {Address: "invalid"}},
+		Tags:       []string{"ok", "toolong"},
+	}
+
+	expected := Errors{
+		{Path: "name", Rule: "required", Param: "", Message: "name is required"},
+		{Path: "recipients[1].address", Rule: "email", Param: "", Message: "recipients[1].address must be a valid email address"},
+		{Path: "tags[1]", Rule: "max", Param: "3", Message: "tags[1] must have at most 3 characters"},
+	}
+
+	errs := Validate(payload)
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Validate() was incorrect: got %v, expected %v.", errs, expected)
+	}
+
+	// test nesting under a parent path
+	prefixed := errs.Prefix("batches[2]")
+	if prefixed[1].Path != "batches[2].recipients[1].address" || prefixed[1].Message != "batches[2].recipients[1].address must be a valid email address" {
+		t.Errorf("Prefix() was incorrect: got %+v.", prefixed[1])
+	}
+
+	// test valid payload
+	payload.Name = "batch"
+	payload.Recipients[1].Address = "b@example.com"
+	payload.Tags = nil
+	if errs := Validate(payload); errs != nil {
+		t.Errorf("Validate() was incorrect: got %v, expected nil.", errs)
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"os"
 	"time"
 
+	emailService "carrier.microservices.go/src/lib/email"
 	"carrier.microservices.go/src/lib/store"
+	"carrier.microservices.go/src/lib/validation"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-lambda-go/lambdacontext"
@@ -24,35 +26,112 @@ var logger *zap.SugaredLogger
 var adapter *chiproxy.ChiLambda
 var db *dynamodb.DynamoDB
 
+// newEmailDatastore creates the datastore backing the EmailRepository (replaceable for tests); the queue and
+// service indexes are queried by name, GET /emails filters can query the status and template indexes
+var newEmailDatastore = func() store.Datastore {
+	return store.NewDynamoDBTable(db, os.Getenv("EMAILS_TABLE"),
+		store.Index{Name: os.Getenv("EMAIL_QUEUE_INDEX"), HashKey: "send_status", RangeKey: "priority_queued"},
+		store.Index{Name: os.Getenv("EMAIL_SERVICE_INDEX"), HashKey: "service_id"},
+		store.Index{Name: os.Getenv("EMAIL_STATUS_INDEX"), HashKey: "send_status", RangeKey: "created_at"},
+		store.Index{Name: os.Getenv("EMAIL_TEMPLATE_INDEX"), HashKey: "template", RangeKey: "created_at"},
+	)
+}
+
+// newSuppressionDatastore creates the datastore backing the SuppressionRepository (replaceable for tests)
+var newSuppressionDatastore = func() store.Datastore {
+	return store.NewDynamoDBTable(db, os.Getenv("SUPPRESSIONS_TABLE"))
+}
+
+// newCallbackDatastore creates the datastore backing the CallbackRepository (replaceable for tests)
+var newCallbackDatastore = func() store.Datastore {
+	return store.NewDynamoDBTable(db, os.Getenv("CALLBACKS_TABLE"),
+		store.Index{Name: os.Getenv("CALLBACK_QUEUE_INDEX"), HashKey: "delivery_status", RangeKey: "due"},
+	)
+}
+
+// newRecipientDatastore creates the datastore backing the RecipientRepository (replaceable for tests)
+var newRecipientDatastore = func() store.Datastore {
+	return store.NewDynamoDBTable(db, os.Getenv("RECIPIENTS_TABLE"),
+		store.Index{Name: os.Getenv("RECIPIENT_ADDRESS_INDEX"), HashKey: "address", RangeKey: "created_at"},
+	)
+}
+
+// newIdempotencyDatastore creates the datastore backing the IdempotencyRepository (replaceable for tests)
+var newIdempotencyDatastore = func() store.Datastore {
+	return store.NewDynamoDBTable(db, os.Getenv("IDEMPOTENCY_TABLE"))
+}
+
+// emailExchange is shared by all invocations in the container so provider circuit breakers keep their state
+var emailExchange emailService.EmailExchange
+
+// newEmailExchange returns the service used to transmit emails (replaceable for tests)
+var newEmailExchange = func() emailService.EmailExchange {
+	return emailExchange
+}
+
 func init() {
 	var err error
 
+	// create email provider(s)
+	emailExchange, err = emailService.NewExchange(os.Getenv("EMAIL_PROVIDER"))
+	if err != nil {
+		log.Fatalf("Email provider configuration error: %s", err)
+	}
+
 	// connect to datastore
 	db, err = store.CreateConnection(os.Getenv("AWS_REGION"), os.Getenv("DYNAMODB_ENDPOINT"))
 	if err != nil {
 		log.Fatalf("Database connection error: %s", err)
 	}
 
+	adapter = chiproxy.New(newRouter())
+}
+
+// newRouter creates the HTTP router with all middleware and routes attached
+func newRouter() *chi.Mux {
+
 	// create router
 	r := chi.NewRouter()
 
 	// add middleware
 	r.Use(LogRequest)
-	r.Use(Authorize)
 	r.Use(EmailRepositoryCtx)
+	r.Use(SuppressionRepositoryCtx)
+	r.Use(IdempotencyRepositoryCtx)
 	r.Use(EmailExchangeCtx)
 
 	// add routes
-	r.Route("/email/{emailID}", func(r chi.Router) {
-		r.Use(EmailCtx)
-		r.Get("/", GetEmail)
-		r.Put("/", UpdateEmail)
-		r.Delete("/", DeleteEmail)
+	r.Group(func(r chi.Router) {
+		r.Use(Authorize)
+		r.Route("/email/{emailID}", func(r chi.Router) {
+			r.Use(EmailCtx)
+			r.Get("/", GetEmail)
+			r.Put("/", UpdateEmail)
+			r.Delete("/", DeleteEmail)
+			r.Get("/attempts", GetEmailAttempts)
+			r.Post("/retry", RetryEmail)
+		})
+		r.Get("/emails", GetEmails)
+		r.Post("/emails", PostEmails)
+		r.Get("/emails/failed", GetFailedEmails)
+		r.Post("/emails/retry", RetryEmails)
+		r.Get("/recipients/{address}/emails", GetRecipientEmails)
+		r.Route("/suppressions", func(r chi.Router) {
+			r.Get("/", GetSuppressions)
+			r.Post("/", PostSuppression)
+			r.Route("/{address}", func(r chi.Router) {
+				r.Use(SuppressionCtx)
+				r.Get("/", GetSuppression)
+				r.Put("/", UpdateSuppression)
+				r.Delete("/", DeleteSuppression)
+			})
+		})
 	})
-	r.Get("/emails", GetEmails)
-	r.Post("/emails", PostEmails)
 
-	adapter = chiproxy.New(r)
+	// add webhook routes, authenticated by the email service's own scheme
+	r.With(AuthorizeSparkPostWebhook).Post("/webhooks/sparkpost", PostSparkPostWebhook)
+
+	return r
 }
 
 // APIGatewayHandler is the lambda handler invoked by API Gateway events
@@ -76,8 +155,10 @@ func CloudWatchHandler(ctx context.Context, cloudWatchEvent events.CloudWatchEve
 	logger = sugaredLogger(lc.AwsRequestID)
 	defer logger.Sync()
 
-	// run job
+	// run jobs
+	EmailRecovery(ctx, cloudWatchEvent)
 	EmailQueue(ctx, cloudWatchEvent)
+	CallbackQueue(ctx, cloudWatchEvent)
 }
 
 // sugaredLogger initializes the zap sugar logger
@@ -142,6 +223,19 @@ func userErrorResponse(w http.ResponseWriter, code int, errorMessage string) {
 	generateResponse(w, code, body)
 }
 
+// validationErrorResponse generates a bad request (400) response listing a payload's validation errors by path
+func validationErrorResponse(w http.ResponseWriter, errs validation.Errors) {
+	body, err := json.Marshal(map[string]interface{}{
+		"errors":  errs.Map(),
+		"details": errs,
+	})
+	if err != nil {
+		logger.Errorf("Marshalling error: %s", err)
+		serverErrorResponse(w)
+	}
+	generateResponse(w, http.StatusBadRequest, body)
+}
+
 // serverErrorResponse generates a server error (500) response
 func serverErrorResponse(w http.ResponseWriter) {
 	generateResponse(w, 500, []byte("{\"error\":\"Server error\"}"))
@@ -206,5 +300,8 @@ func (h Handler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
 }
 
 func main() {
+	if len(cursorSecret()) == 0 {
+		log.Fatalf("Cursor configuration error: %s", "CURSOR_SECRET is not set")
+	}
 	lambda.StartHandler(Handler{})
 }
@@ -8,8 +8,18 @@ import (
 	"os"
 	"reflect"
 	"testing"
+
+	"go.uber.org/zap"
 )
 
+func TestMain(m *testing.M) {
+
+	// handlers log through the package logger, which is normally created per Lambda invocation
+	logger = zap.NewNop().Sugar()
+
+	os.Exit(m.Run())
+}
+
 func createMockRequest(headers map[string]string) http.Request {
 	req := httptest.NewRequest("GET", "/noop", nil)
 	for key, value := range headers {
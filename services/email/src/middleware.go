@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
+	"net/url"
 	"os"
 
 	emailService "carrier.microservices.go/src/lib/email"
@@ -17,6 +19,9 @@ const (
 	keyEmail key = iota
 	keyEmailRepository
 	keyEmailExchange
+	keySuppression
+	keySuppressionRepository
+	keyIdempotencyRepository
 )
 
 // LogRequest logs the request
@@ -61,11 +66,55 @@ func authentication(r *http.Request) bool {
 	return true
 }
 
+// AuthorizeSparkPostWebhook checks that a webhook request was sent by SparkPost, using either the basic auth
+// credentials or the token configured on the webhook
+func AuthorizeSparkPostWebhook(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// check webhook credentials
+		ok := sparkPostWebhookAuthentication(r)
+		if !ok {
+			userErrorResponse(w, 401, "Permission denied.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sparkPostWebhookAuthentication compares the request's basic auth credentials or X-MessageSystems-Webhook-Token
+// header to env parameters; requests are refused if neither is configured
+func sparkPostWebhookAuthentication(r *http.Request) bool {
+	username := os.Getenv("SPARKPOST_WEBHOOK_USERNAME")
+	password := os.Getenv("SPARKPOST_WEBHOOK_PASSWORD")
+	token := os.Getenv("SPARKPOST_WEBHOOK_TOKEN")
+
+	if username != "" && password != "" {
+		headerUsername, headerPassword, ok := r.BasicAuth()
+		if ok && secureCompare(headerUsername, username) && secureCompare(headerPassword, password) {
+			return true
+		}
+	}
+	if token != "" {
+		if secureCompare(r.Header.Get("X-MessageSystems-Webhook-Token"), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureCompare compares secrets in constant time
+func secureCompare(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
 // EmailRepositoryCtx adds a hepler function to the context to generate an instance of the EmailRepository
 func EmailRepositoryCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		getEmailRepository := func() *EmailRepository {
-			return NewEmailRepository(store.NewDynamoDBTable(db, os.Getenv("EMAILS_TABLE")))
+			return NewEmailRepository(newEmailDatastore()).
+				WithCallbacks(NewCallbackRepository(newCallbackDatastore())).
+				WithRecipients(NewRecipientRepository(newRecipientDatastore()))
 		}
 		ctx := context.WithValue(r.Context(), keyEmailRepository, getEmailRepository)
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -87,7 +136,7 @@ func EmailCtx(next http.Handler) http.Handler {
 		}
 
 		// retrieve a single email
-		email, err := emailRepository.Get(id)
+		email, err := emailRepository.Get(r.Context(), id)
 		if err != nil {
 			switch err.(type) {
 			case *store.NotFoundError:
@@ -108,9 +157,64 @@ func EmailCtx(next http.Handler) http.Handler {
 func EmailExchangeCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		getEmailExchange := func() emailService.EmailExchange {
-			return &emailService.SparkPostExchange{}
+			return newEmailExchange()
 		}
 		ctx := context.WithValue(r.Context(), keyEmailExchange, getEmailExchange)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// SuppressionRepositoryCtx adds a hepler function to the context to generate an instance of the SuppressionRepository
+func SuppressionRepositoryCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getSuppressionRepository := func() *SuppressionRepository {
+			return NewSuppressionRepository(newSuppressionDatastore())
+		}
+		ctx := context.WithValue(r.Context(), keySuppressionRepository, getSuppressionRepository)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SuppressionCtx adds a Suppression object to the context if requested
+func SuppressionCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// get suppression repository from context
+		suppressionRepository := r.Context().Value(keySuppressionRepository).(func() *SuppressionRepository)()
+
+		// get address from path, which may be escaped
+		address, err := url.PathUnescape(chi.URLParam(r, "address"))
+		address = normalizeAddress(address)
+		if err != nil || address == "" {
+			userErrorResponse(w, http.StatusBadRequest, "Invalid address")
+			return
+		}
+
+		// retrieve the address's suppression
+		suppression, err := suppressionRepository.Get(r.Context(), address)
+		if err != nil {
+			switch err.(type) {
+			case *store.NotFoundError:
+				userErrorResponse(w, 404, "Not found")
+			default:
+				logger.Errorf("Unable to retrieve suppression from datastore: %v", err)
+				serverErrorResponse(w)
+			}
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), keySuppression, suppression)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// IdempotencyRepositoryCtx adds a hepler function to the context to generate an instance of the IdempotencyRepository
+func IdempotencyRepositoryCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getIdempotencyRepository := func() *IdempotencyRepository {
+			return NewIdempotencyRepository(newIdempotencyDatastore(), idempotencyTTL(), processingLease())
+		}
+		ctx := context.WithValue(r.Context(), keyIdempotencyRepository, getIdempotencyRepository)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"carrier.microservices.go/src/lib/datetime"
+	"carrier.microservices.go/src/lib/pagination"
 	"carrier.microservices.go/src/lib/store"
 	"github.com/google/uuid"
 )
@@ -24,10 +31,20 @@ const (
 	EmailStatusFailed = 4
 )
 
+const (
+
+	// EmailPriorityNow is the priority of emails sent as soon as they're created; they're only queued for retries
+	EmailPriorityNow = 0
+
+	// EmailPriorityLowest is the priority of the least urgent queued emails
+	EmailPriorityLowest = 3
+)
+
 // Email is an email entity
 type Email struct {
 	ID             uuid.UUID         `json:"id"`
 	ServiceID      string            `json:"service_id"`
+	Provider       string            `json:"provider"`
 	Recipients     []string          `json:"recipients"`
 	Template       string            `json:"template"`
 	Substitutions  map[string]string `json:"substitutions"`
@@ -39,13 +56,126 @@ type Email struct {
 	Accepted       int               `json:"accepted"`
 	Rejected       int               `json:"rejected"`
 	LastAttemptAt  time.Time         `json:"last_attempt_at"`
+	FailureReason  string            `json:"failure_reason"`
+	FailureClass   string            `json:"failure_class"`
+	Version        int               `json:"version"`
+	Events         []DeliveryEvent   `json:"events"`
+	Suppressed     []string          `json:"suppressed"`
+	CallbackURL    string            `json:"callback_url"`
+	AttemptHistory []SendAttempt     `json:"attempt_history"`
+	AuditLog       []AuditEntry      `json:"audit_log"`
 	CreatedAt      time.Time         `json:"created_at"`
 	UpdatedAt      time.Time         `json:"updated_at"`
 }
 
+// DeliveryEvent is an event reported by the email service after an email was sent, e.g. a delivery or bounce
+type DeliveryEvent struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Recipient   string    `json:"recipient"`
+	Timestamp   time.Time `json:"timestamp"`
+	Reason      string    `json:"reason"`
+	BounceClass string    `json:"bounce_class"`
+	URL         string    `json:"url"`
+}
+
+const (
+
+	// AttemptOutcomeSent is an outcome constant for attempts the email service accepted
+	AttemptOutcomeSent = "sent"
+
+	// AttemptOutcomeFailed is an outcome constant for attempts that failed permanently
+	AttemptOutcomeFailed = "failed"
+
+	// AttemptOutcomeRateLimited is an outcome constant for attempts refused because the sending rate was exceeded
+	AttemptOutcomeRateLimited = "rate_limited"
+
+	// AttemptOutcomeError is an outcome constant for attempts that failed and may be retried
+	AttemptOutcomeError = "error"
+
+	// AttemptOutcomeInterrupted is an outcome constant for attempts that never finished, e.g. the Lambda timed out
+	AttemptOutcomeInterrupted = "interrupted"
+)
+
+// SendAttempt is the record of one attempt to send an email
+type SendAttempt struct {
+	Number    int       `json:"number"`
+	At        time.Time `json:"at"`
+	Provider  string    `json:"provider"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error"`
+	ServiceID string    `json:"service_id"`
+	Accepted  int       `json:"accepted"`
+	Rejected  int       `json:"rejected"`
+	Duration  int64     `json:"duration"`
+}
+
+// maxSendAttempts is the number of most recent send attempts kept on an email
+const maxSendAttempts = 25
+
+// withAttempt appends an attempt to an email's attempt history, dropping the oldest attempts to keep the email
+// item well under DynamoDB's size limit
+func withAttempt(history []SendAttempt, attempt SendAttempt) []SendAttempt {
+	history = append(append([]SendAttempt{}, history...), attempt)
+	if len(history) > maxSendAttempts {
+		history = history[len(history)-maxSendAttempts:]
+	}
+	return history
+}
+
+const (
+
+	// FailureClassPermanent is a failure class constant for emails the email service rejected
+	FailureClassPermanent = "permanent"
+
+	// FailureClassRetriesExhausted is a failure class constant for emails that failed RETRY_LIMIT times
+	FailureClassRetriesExhausted = "retries_exhausted"
+
+	// FailureClassExpired is a failure class constant for emails their retry policy gave up on
+	FailureClassExpired = "expired"
+
+	// FailureClassSuppressed is a failure class constant for emails whose recipients are all suppressed
+	FailureClassSuppressed = "suppressed"
+)
+
+// AuditActionRetry is an audit action constant for failed emails that were put back in the queue
+const AuditActionRetry = "retry"
+
+// AuditEntry is the record of a manual action on an email, with the state it changed
+type AuditEntry struct {
+	At            time.Time `json:"at"`
+	Action        string    `json:"action"`
+	Note          string    `json:"note"`
+	SendStatus    int       `json:"send_status"`
+	Attempts      int       `json:"attempts"`
+	FailureReason string    `json:"failure_reason"`
+}
+
+// maxAuditEntries is the number of most recent audit entries kept on an email
+const maxAuditEntries = 25
+
+// withAuditEntry appends an entry to an email's audit log, dropping the oldest entries
+func withAuditEntry(log []AuditEntry, entry AuditEntry) []AuditEntry {
+	log = append(append([]AuditEntry{}, log...), entry)
+	if len(log) > maxAuditEntries {
+		log = log[len(log)-maxAuditEntries:]
+	}
+	return log
+}
+
+// maxDeliveryEvents is the number of most recent delivery events kept on an email
+const maxDeliveryEvents = 100
+
+// ETag returns the entity tag identifying the current version of an email
+func (e *Email) ETag() string {
+	return fmt.Sprintf("\"%d\"", e.Version)
+}
+
 // EmailRepository stores and fetches items
 type EmailRepository struct {
-	datastore store.Datastore
+	datastore  store.Datastore
+	callbacks  *CallbackRepository
+	recipients *RecipientRepository
 }
 
 // NewEmailRepository instance
@@ -53,50 +183,875 @@ func NewEmailRepository(ds store.Datastore) *EmailRepository {
 	return &EmailRepository{datastore: ds}
 }
 
-// List all emails
-func (r *EmailRepository) List(page, limit int64, options ...interface{}) ([]*Email, error) {
+// WithCallbacks makes the repository queue a status-change callback whenever an email's send status changes
+func (r *EmailRepository) WithCallbacks(callbacks *CallbackRepository) *EmailRepository {
+	r.callbacks = callbacks
+	return r
+}
+
+// WithRecipients makes the repository keep each recipient's mapping to the emails sent to them up to date
+func (r *EmailRepository) WithRecipients(recipients *RecipientRepository) *EmailRepository {
+	r.recipients = recipients
+	return r
+}
+
+// List emails, starting after the position encoded in cursor; returns the cursor for the next page, or an
+// empty string if there are no more results
+func (r *EmailRepository) List(ctx context.Context, limit int64, cursor string, query *store.Query) ([]*Email, string, error) {
 	var emails []*Email
-	if err := r.datastore.List(&emails, page, limit, options...); err != nil {
-		return nil, err
+
+	scope, err := cursorScope(r.datastore, "emails", query)
+	if err != nil {
+		return nil, "", err
+	}
+	startKey, err := pagination.DecodeCursor(cursor, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	nextKey, err := r.datastore.List(ctx, &emails, limit, startKey, query)
+	if err != nil {
+		return nil, "", err
+	}
+	nextCursor, err := pagination.EncodeCursor(nextKey, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	return emails, nextCursor, nil
+}
+
+// ErrUnsorted is returned when emails are to be sorted but their filter can't use an index ordered by creation time
+var ErrUnsorted = errors.New("emails can only be sorted when filtered by send status or template")
+
+// EmailFilter selects the emails returned by Find; zero values match any email
+type EmailFilter struct {
+	SendStatus    int
+	Template      string
+	Priority      *int
+	Recipient     string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	FailureClass  string
+	Sort          string
+}
+
+// Email filter sort orders, by creation time
+const (
+	SortAscending  = "asc"
+	SortDescending = "desc"
+)
+
+// query maps the filter to a datastore query ordered by creation time; created_after is inclusive and
+// created_before exclusive
+func (f EmailFilter) query() *store.Query {
+	query := store.NewQuery().OrderBy("created_at", f.Sort == SortDescending)
+	if f.SendStatus != 0 {
+		query.Where("send_status", store.Equal, f.SendStatus)
+	}
+	if f.Template != "" {
+		query.Where("template", store.Equal, f.Template)
+	}
+	if f.Priority != nil {
+		query.Where("priority", store.Equal, *f.Priority)
+	}
+	if f.Recipient != "" {
+		query.Where("recipients", store.Contains, f.Recipient)
+	}
+	if f.FailureClass != "" {
+		query.Where("failure_class", store.Equal, f.FailureClass)
+	}
+	if !f.CreatedAfter.IsZero() {
+		query.Where("created_at", store.GreaterEqual, f.CreatedAfter.UTC())
+	}
+	if !f.CreatedBefore.IsZero() {
+		query.Where("created_at", store.Less, f.CreatedBefore.UTC())
 	}
-	return emails, nil
+	return query
+}
+
+// Find lists the emails matching a filter, starting after the position encoded in cursor; returns the cursor for
+// the next page, and the plan the datastore used, which tells an indexed query from a filtered scan
+func (r *EmailRepository) Find(ctx context.Context, filter EmailFilter, limit int64, cursor string) ([]*Email, string, store.ListPlan, error) {
+	query := filter.query()
+	plan, err := r.datastore.Plan(query)
+	if err != nil {
+		return nil, "", plan, err
+	}
+	if filter.Sort != "" && !plan.Sorted {
+		return nil, "", plan, ErrUnsorted
+	}
+
+	emails, nextCursor, err := r.List(ctx, limit, cursor, query)
+	return emails, nextCursor, plan, err
 }
 
 // Store a new email
-func (r *EmailRepository) Store(email *Email) error {
+func (r *EmailRepository) Store(ctx context.Context, email *Email) error {
+	r.prepare(email)
+	if err := r.datastore.Store(ctx, email); err != nil {
+		return err
+	}
+	r.statusChanged(ctx, email, 0)
+	r.recipientsChanged(ctx, email, nil)
+	return nil
+}
+
+// StoreAll stores new emails in a single transaction: either every email is stored or none are
+func (r *EmailRepository) StoreAll(ctx context.Context, emails []*Email) error {
+	items := []interface{}{}
+	for _, email := range emails {
+		r.prepare(email)
+		items = append(items, email)
+	}
+	if err := r.datastore.InsertAll(ctx, items...); err != nil {
+		return err
+	}
+	for _, email := range emails {
+		r.statusChanged(ctx, email, 0)
+		r.recipientsChanged(ctx, email, nil)
+	}
+	return nil
+}
+
+// prepare sets the generated attributes of a new email
+func (r *EmailRepository) prepare(email *Email) {
 	email.ID = uuid.New()
+	email.Version = 1
 	email.CreatedAt = time.Now()
 	email.UpdatedAt = time.Now()
 	if !email.Queued.IsZero() {
-		email.PriorityQueued = fmt.Sprintf("%d#%s", email.Priority, email.Queued.Format(datetime.ISO8601Datetime))
+		email.PriorityQueued = priorityQueued(email.Priority, email.Queued)
 	} else {
 		email.PriorityQueued = ""
 	}
-	return r.datastore.Store(email)
+}
+
+// priorityQueued formats the queue index sort key of an email; times are in UTC so keys compare in time order
+func priorityQueued(priority int, queued time.Time) string {
+	return fmt.Sprintf("%d#%s", priority, queued.UTC().Format(datetime.ISO8601Datetime))
 }
 
 // Get a single email
-func (r *EmailRepository) Get(id uuid.UUID) (*Email, error) {
+func (r *EmailRepository) Get(ctx context.Context, id uuid.UUID) (*Email, error) {
 	var email *Email
-	if err := r.datastore.Get(id, &email); err != nil {
+	if err := r.datastore.Get(ctx, id, &email); err != nil {
 		return nil, err
 	}
 	return email, nil
 }
 
+// GetByServiceID gets the email sent with the email service's ID for the send event
+func (r *EmailRepository) GetByServiceID(ctx context.Context, serviceID string) (*Email, error) {
+	var emails []*Email
+
+	// service IDs are unique, but the index may hold more than one item per page
+	startKey := ""
+	for {
+		query := store.NewQuery().UseIndex(os.Getenv("EMAIL_SERVICE_INDEX")).Where("service_id", store.Equal, serviceID)
+		nextKey, err := r.datastore.List(ctx, &emails, 10, startKey, query)
+		if err != nil {
+			return nil, err
+		}
+		if len(emails) > 0 {
+			return emails[0], nil
+		}
+		if nextKey == "" {
+			return nil, &store.NotFoundError{}
+		}
+		startKey = nextKey
+	}
+}
+
+// AddEvents records delivery events on an email, skipping events it already has; retries if the email is
+// changed concurrently
+func (r *EmailRepository) AddEvents(ctx context.Context, email *Email, events []DeliveryEvent) (int, error) {
+	for retries := 3; ; retries-- {
+
+		// merge new events, keeping the most recent
+		known := map[string]bool{}
+		for _, event := range email.Events {
+			known[event.ID] = true
+		}
+		merged := append([]DeliveryEvent{}, email.Events...)
+		for _, event := range events {
+			if event.ID == "" || !known[event.ID] {
+				known[event.ID] = true
+				merged = append(merged, event)
+			}
+		}
+		added := len(merged) - len(email.Events)
+		if added == 0 {
+			return 0, nil
+		}
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].Timestamp.Before(merged[j].Timestamp)
+		})
+		if len(merged) > maxDeliveryEvents {
+			merged = merged[len(merged)-maxDeliveryEvents:]
+		}
+
+		// save, re-reading the email if someone else updated it first
+		err := r.Update(ctx, email, store.ChangeSet{"events": merged})
+		if err == nil {
+			return added, nil
+		}
+		if _, conflict := err.(*store.ConflictError); !conflict || retries == 0 {
+			return 0, err
+		}
+		if email, err = r.Get(ctx, email.ID); err != nil {
+			return 0, err
+		}
+	}
+}
+
 // Update an existing email
-func (r *EmailRepository) Update(email *Email, changeSet store.ChangeSet) error {
+func (r *EmailRepository) Update(ctx context.Context, email *Email, changeSet store.ChangeSet) error {
+	return r.UpdateWhere(ctx, email, changeSet, nil)
+}
+
+// UpdateWhere updates an existing email only if it still matches the conditions, otherwise returns a
+// store.ConflictError; every update also requires the stored version to match the email's version
+func (r *EmailRepository) UpdateWhere(ctx context.Context, email *Email, changeSet store.ChangeSet, conditions store.ConditionSet) error {
 	changeSet["updated_at"] = time.Now()
+
+	// optimistic concurrency: bump the version, but only if no one else has since the email was read
+	expected := store.ConditionSet{"version": email.Version}
+	if email.Version == 0 {
+		expected["version"] = nil // records created before versioning
+	}
+	for k, v := range conditions {
+		expected[k] = v
+	}
+	changeSet["version"] = email.Version + 1
+
+	// derive the queue sort key from the values being written, falling back to current values, so ListDue finds
+	// requeued and rescheduled emails at their new position
+	if priority, ok := changeSet["priority"].(int); ok {
+		email.Priority = priority
+	}
+	if queued, ok := changeSet["queued"].(time.Time); ok {
+		email.Queued = queued
+	}
 	if !email.Queued.IsZero() {
-		email.PriorityQueued = fmt.Sprintf("%d#%s", email.Priority, email.Queued.Format(datetime.ISO8601Datetime))
+		email.PriorityQueued = priorityQueued(email.Priority, email.Queued)
 	} else {
 		email.PriorityQueued = ""
 	}
 	changeSet["priority_queued"] = email.PriorityQueued
-	return r.datastore.Update(email.ID, email, changeSet)
+
+	previousStatus := email.SendStatus
+	previousRecipients := append([]string{}, email.Recipients...)
+	if err := r.datastore.UpdateWhere(ctx, email.ID, email, changeSet, expected); err != nil {
+		return err
+	}
+	r.statusChanged(ctx, email, previousStatus)
+	r.recipientsChanged(ctx, email, previousRecipients)
+	return nil
+}
+
+// statusChanged queues a callback if the email's send status changed and a callback URL is registered; the
+// email has already been saved, so failures are logged rather than returned
+func (r *EmailRepository) statusChanged(ctx context.Context, email *Email, previousStatus int) {
+	if r.callbacks == nil || email.SendStatus == previousStatus {
+		return
+	}
+	url := email.CallbackURL
+	if url == "" {
+		url = os.Getenv("CALLBACK_URL")
+	}
+	if url == "" {
+		return
+	}
+	if err := r.callbacks.Queue(ctx, url, email, previousStatus); err != nil {
+		logger.Errorf("Unable to queue callback: %v", err)
+	}
+}
+
+// recipientsChanged maps an email's new recipients to it and removes the mappings of recipients it no longer
+// has; the email has already been saved, so failures are logged rather than returned
+func (r *EmailRepository) recipientsChanged(ctx context.Context, email *Email, previousRecipients []string) {
+	if r.recipients == nil {
+		return
+	}
+	if err := r.recipients.Remove(ctx, email.ID, addressesExcept(previousRecipients, email.Recipients)); err != nil {
+		logger.Errorf("Unable to remove recipients: %v", err)
+	}
+	if err := r.recipients.Add(ctx, email, addressesExcept(email.Recipients, previousRecipients)); err != nil {
+		logger.Errorf("Unable to save recipients: %v", err)
+	}
+}
+
+// FindByRecipient lists the emails sent to an address, newest first, starting after the position encoded in
+// cursor; returns the cursor for the next page, or an empty string if there are no more results
+func (r *EmailRepository) FindByRecipient(ctx context.Context, address string, limit int64, cursor string) ([]*Email, string, error) {
+	if r.recipients == nil {
+		return nil, "", errors.New("recipients are not tracked")
+	}
+	recipientEmails, nextCursor, err := r.recipients.List(ctx, address, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// emails may have been deleted since the page of mappings was read
+	emails := []*Email{}
+	for _, recipientEmail := range recipientEmails {
+		email, err := r.Get(ctx, recipientEmail.EmailID)
+		if err != nil {
+			if _, ok := err.(*store.NotFoundError); ok {
+				continue
+			}
+			return nil, "", err
+		}
+		emails = append(emails, email)
+	}
+	return emails, nextCursor, nil
+}
+
+// ListDue lists the queued emails of one priority that are due by now, the longest due first; emails scheduled
+// for later are never returned, so they can't hold up due emails
+func (r *EmailRepository) ListDue(ctx context.Context, priority int, now time.Time, limit int64, cursor string) ([]*Email, string, error) {
+	query := store.NewQuery().UseIndex(os.Getenv("EMAIL_QUEUE_INDEX")).
+		Where("send_status", store.Equal, EmailStatusQueued).
+		Where("priority_queued", store.Between, store.Range{From: fmt.Sprintf("%d#", priority), To: priorityQueued(priority, now)})
+	return r.List(ctx, limit, cursor, query)
+}
+
+// Claim atomically moves a queued email to processing so only one worker sends it; returns a
+// store.ConflictError if another worker changed the email first
+func (r *EmailRepository) Claim(ctx context.Context, email *Email) error {
+	return r.UpdateWhere(ctx,
+		email,
+		store.ChangeSet{"send_status": EmailStatusProcessing},
+		store.ConditionSet{"send_status": EmailStatusQueued, "attempts": email.Attempts},
+	)
 }
 
 // Delete an existing email
-func (r *EmailRepository) Delete(id uuid.UUID) error {
-	return r.datastore.Delete(id)
+func (r *EmailRepository) Delete(ctx context.Context, email *Email) error {
+	if err := r.datastore.Delete(ctx, email.ID); err != nil {
+		return err
+	}
+	r.recipientsChanged(ctx, &Email{ID: email.ID}, email.Recipients)
+	return nil
+}
+
+// RecipientEmail maps a recipient's address to an email sent to them, so their emails can be found without a scan
+type RecipientEmail struct {
+	ID        uuid.UUID `json:"id"`
+	Address   string    `json:"address"`
+	EmailID   uuid.UUID `json:"email_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recipientEmailID derives the ID of an address's mapping to an email, so it can be removed without a lookup
+func recipientEmailID(address string, emailID uuid.UUID) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("recipient:"+address+":"+emailID.String()))
+}
+
+// addressesExcept returns the normalized addresses that are not in the excluded list, without duplicates
+func addressesExcept(addresses, excluded []string) []string {
+	seen := map[string]bool{}
+	for _, address := range excluded {
+		seen[normalizeAddress(address)] = true
+	}
+	result := []string{}
+	for _, address := range addresses {
+		address = normalizeAddress(address)
+		if !seen[address] {
+			seen[address] = true
+			result = append(result, address)
+		}
+	}
+	return result
+}
+
+// RecipientRepository stores and fetches the mappings of recipients to their emails
+type RecipientRepository struct {
+	datastore store.Datastore
+}
+
+// NewRecipientRepository instance
+func NewRecipientRepository(ds store.Datastore) *RecipientRepository {
+	return &RecipientRepository{datastore: ds}
+}
+
+// Add maps addresses to an email; mappings are ordered by the email's creation time
+func (r *RecipientRepository) Add(ctx context.Context, email *Email, addresses []string) error {
+	for _, address := range addresses {
+		address = normalizeAddress(address)
+		err := r.datastore.Store(ctx, &RecipientEmail{
+			ID:        recipientEmailID(address, email.ID),
+			Address:   address,
+			EmailID:   email.ID,
+			CreatedAt: email.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the mappings of addresses to an email
+func (r *RecipientRepository) Remove(ctx context.Context, emailID uuid.UUID, addresses []string) error {
+	for _, address := range addresses {
+		if err := r.datastore.Delete(ctx, recipientEmailID(normalizeAddress(address), emailID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List an address's mappings, newest first, starting after the position encoded in cursor; returns the cursor
+// for the next page, or an empty string if there are no more results
+func (r *RecipientRepository) List(ctx context.Context, address string, limit int64, cursor string) ([]*RecipientEmail, string, error) {
+	var recipientEmails []*RecipientEmail
+
+	query := store.NewQuery().Where("address", store.Equal, normalizeAddress(address)).OrderBy("created_at", true)
+	scope, err := cursorScope(r.datastore, "recipients", query)
+	if err != nil {
+		return nil, "", err
+	}
+	startKey, err := pagination.DecodeCursor(cursor, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	nextKey, err := r.datastore.List(ctx, &recipientEmails, limit, startKey, query)
+	if err != nil {
+		return nil, "", err
+	}
+	nextCursor, err := pagination.EncodeCursor(nextKey, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	return recipientEmails, nextCursor, nil
+}
+
+const (
+
+	// SuppressionReasonHardBounce is a reason constant for addresses that permanently bounced
+	SuppressionReasonHardBounce = "hard_bounce"
+
+	// SuppressionReasonSpamComplaint is a reason constant for recipients that marked an email as spam
+	SuppressionReasonSpamComplaint = "spam_complaint"
+
+	// SuppressionReasonUnsubscribe is a reason constant for recipients that unsubscribed
+	SuppressionReasonUnsubscribe = "unsubscribe"
+
+	// SuppressionReasonManual is a reason constant for addresses suppressed through the API
+	SuppressionReasonManual = "manual"
+)
+
+// Suppression is an email address that must not be sent to
+type Suppression struct {
+	ID          uuid.UUID `json:"id"`
+	Address     string    `json:"address"`
+	Reason      string    `json:"reason"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// suppressionID derives the key of an address's suppression, so suppressions can be looked up by address
+func suppressionID(address string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("mailto:"+normalizeAddress(address)))
+}
+
+// normalizeAddress returns the form of an address used for comparisons
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// SuppressionRepository stores and fetches suppressions
+type SuppressionRepository struct {
+	datastore store.Datastore
+}
+
+// NewSuppressionRepository instance
+func NewSuppressionRepository(ds store.Datastore) *SuppressionRepository {
+	return &SuppressionRepository{datastore: ds}
+}
+
+// List suppressions, starting after the position encoded in cursor; returns the cursor for the next page, or an
+// empty string if there are no more results
+func (r *SuppressionRepository) List(ctx context.Context, limit int64, cursor string) ([]*Suppression, string, error) {
+	var suppressions []*Suppression
+
+	scope, err := cursorScope(r.datastore, "suppressions", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	startKey, err := pagination.DecodeCursor(cursor, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	nextKey, err := r.datastore.List(ctx, &suppressions, limit, startKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	nextCursor, err := pagination.EncodeCursor(nextKey, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	return suppressions, nextCursor, nil
+}
+
+// Store a suppression, replacing any existing suppression of the address
+func (r *SuppressionRepository) Store(ctx context.Context, suppression *Suppression) error {
+	suppression.Address = normalizeAddress(suppression.Address)
+	suppression.ID = suppressionID(suppression.Address)
+	suppression.CreatedAt = time.Now()
+	suppression.UpdatedAt = time.Now()
+	return r.datastore.Store(ctx, suppression)
+}
+
+// Insert a suppression, unless the address is already suppressed, in which case a store.ConflictError is returned
+// and the existing suppression is kept
+func (r *SuppressionRepository) Insert(ctx context.Context, suppression *Suppression) error {
+	suppression.Address = normalizeAddress(suppression.Address)
+	suppression.ID = suppressionID(suppression.Address)
+	suppression.CreatedAt = time.Now()
+	suppression.UpdatedAt = time.Now()
+	return r.datastore.Insert(ctx, suppression)
+}
+
+// Get the suppression of an address
+func (r *SuppressionRepository) Get(ctx context.Context, address string) (*Suppression, error) {
+	var suppression *Suppression
+	if err := r.datastore.Get(ctx, suppressionID(address), &suppression); err != nil {
+		return nil, err
+	}
+	return suppression, nil
+}
+
+// Update an existing suppression
+func (r *SuppressionRepository) Update(ctx context.Context, suppression *Suppression, changeSet store.ChangeSet) error {
+	changeSet["updated_at"] = time.Now()
+	return r.datastore.Update(ctx, suppression.ID, suppression, changeSet)
+}
+
+// Delete the suppression of an address
+func (r *SuppressionRepository) Delete(ctx context.Context, address string) error {
+	return r.datastore.Delete(ctx, suppressionID(address))
+}
+
+// Suppressed returns the addresses that are suppressed
+func (r *SuppressionRepository) Suppressed(ctx context.Context, addresses []string) ([]string, error) {
+	suppressed := []string{}
+	for _, address := range addresses {
+		_, err := r.Get(ctx, address)
+		switch err.(type) {
+		case nil:
+			suppressed = append(suppressed, address)
+		case *store.NotFoundError:
+		default:
+			return nil, err
+		}
+	}
+	return suppressed, nil
+}
+
+const (
+
+	// CallbackStatusPending is a status constant for callbacks waiting to be delivered
+	CallbackStatusPending = 1
+
+	// CallbackStatusDelivered is a status constant for callbacks the receiver accepted
+	CallbackStatusDelivered = 2
+
+	// CallbackStatusFailed is a status constant for callbacks that will not be tried again
+	CallbackStatusFailed = 3
+)
+
+// Callback is a status-change event waiting to be, or already, posted to a calling service
+type Callback struct {
+	ID             uuid.UUID         `json:"id"`
+	EmailID        uuid.UUID         `json:"email_id"`
+	URL            string            `json:"url"`
+	EventType      string            `json:"event_type"`
+	Payload        string            `json:"payload"`
+	DeliveryStatus int               `json:"delivery_status"`
+	Due            string            `json:"due"`
+	Attempts       int               `json:"attempts"`
+	LastAttemptAt  time.Time         `json:"last_attempt_at"`
+	FailureReason  string            `json:"failure_reason"`
+	History        []CallbackAttempt `json:"history"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// CallbackAttempt is the outcome of one attempt to deliver a callback
+type CallbackAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code"`
+	Duration   int64     `json:"duration"`
+	Error      string    `json:"error"`
+}
+
+// maxCallbackAttempts is the number of most recent delivery attempts kept on a callback
+const maxCallbackAttempts = 25
+
+// withCallbackAttempt appends an attempt to a callback's history, dropping the oldest attempts to keep the callback
+// item well under DynamoDB's size limit
+func withCallbackAttempt(history []CallbackAttempt, attempt CallbackAttempt) []CallbackAttempt {
+	history = append(append([]CallbackAttempt{}, history...), attempt)
+	if len(history) > maxCallbackAttempts {
+		history = history[len(history)-maxCallbackAttempts:]
+	}
+	return history
+}
+
+// callbackEventTypes maps email send statuses to callback event types
+var callbackEventTypes = map[int]string{
+	EmailStatusQueued:     "email.queued",
+	EmailStatusProcessing: "email.processing",
+	EmailStatusComplete:   "email.complete",
+	EmailStatusFailed:     "email.failed",
+}
+
+// callbackDue formats the time a callback should next be attempted as the queue index sort key
+func callbackDue(t time.Time) string {
+	return t.UTC().Format(datetime.ISO8601Datetime)
+}
+
+// CallbackRepository stores and fetches callbacks
+type CallbackRepository struct {
+	datastore store.Datastore
+}
+
+// NewCallbackRepository instance
+func NewCallbackRepository(ds store.Datastore) *CallbackRepository {
+	return &CallbackRepository{datastore: ds}
+}
+
+// Queue stores a pending callback describing an email's change of send status; the payload is fixed now so the
+// receiver sees the email as it was at the time of the change
+func (r *CallbackRepository) Queue(ctx context.Context, url string, email *Email, previousStatus int) error {
+	callback := &Callback{
+		ID:             uuid.New(),
+		EmailID:        email.ID,
+		URL:            url,
+		EventType:      callbackEventTypes[email.SendStatus],
+		DeliveryStatus: CallbackStatusPending,
+		CreatedAt:      time.Now(),
+	}
+
+	eventPayload := CallbackEventSchema{}
+	eventPayload.load(callback, email, previousStatus)
+	payload, err := json.Marshal(eventPayload)
+	if err != nil {
+		return err
+	}
+	callback.Payload = string(payload)
+
+	return r.Store(ctx, callback)
+}
+
+// List callbacks, starting after the position encoded in cursor; returns the cursor for the next page, or an
+// empty string if there are no more results
+func (r *CallbackRepository) List(ctx context.Context, limit int64, cursor string, query *store.Query) ([]*Callback, string, error) {
+	var callbacks []*Callback
+
+	scope, err := cursorScope(r.datastore, "callbacks", query)
+	if err != nil {
+		return nil, "", err
+	}
+	startKey, err := pagination.DecodeCursor(cursor, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	nextKey, err := r.datastore.List(ctx, &callbacks, limit, startKey, query)
+	if err != nil {
+		return nil, "", err
+	}
+	nextCursor, err := pagination.EncodeCursor(nextKey, scope, cursorSecret())
+	if err != nil {
+		return nil, "", err
+	}
+	return callbacks, nextCursor, nil
+}
+
+// Store a new callback, due now
+func (r *CallbackRepository) Store(ctx context.Context, callback *Callback) error {
+	if callback.ID == uuid.Nil {
+		callback.ID = uuid.New()
+	}
+	if callback.CreatedAt.IsZero() {
+		callback.CreatedAt = time.Now()
+	}
+	callback.UpdatedAt = time.Now()
+	callback.Due = callbackDue(callback.CreatedAt)
+	return r.datastore.Store(ctx, callback)
+}
+
+// Get a single callback
+func (r *CallbackRepository) Get(ctx context.Context, id uuid.UUID) (*Callback, error) {
+	var callback *Callback
+	if err := r.datastore.Get(ctx, id, &callback); err != nil {
+		return nil, err
+	}
+	return callback, nil
+}
+
+// Update an existing callback
+func (r *CallbackRepository) Update(ctx context.Context, callback *Callback, changeSet store.ChangeSet) error {
+	return r.UpdateWhere(ctx, callback, changeSet, nil)
+}
+
+// UpdateWhere updates an existing callback only if it still matches the conditions, otherwise returns a
+// store.ConflictError
+func (r *CallbackRepository) UpdateWhere(ctx context.Context, callback *Callback, changeSet store.ChangeSet, conditions store.ConditionSet) error {
+	changeSet["updated_at"] = time.Now()
+	return r.datastore.UpdateWhere(ctx, callback.ID, callback, changeSet, conditions)
+}
+
+// Claim atomically takes a pending callback for one delivery attempt, hiding it from the queue for the lease so
+// only one worker posts it; if the worker dies mid-attempt the callback becomes due again when the lease ends.
+// Returns a store.ConflictError if another worker claimed the callback first
+func (r *CallbackRepository) Claim(ctx context.Context, callback *Callback, lease time.Duration) error {
+	return r.UpdateWhere(ctx,
+		callback,
+		store.ChangeSet{
+			"attempts":        callback.Attempts + 1,
+			"due":             callbackDue(time.Now().Add(lease)),
+			"last_attempt_at": time.Now(),
+		},
+		store.ConditionSet{"delivery_status": CallbackStatusPending, "attempts": callback.Attempts},
+	)
+}
+
+// Delete an existing callback
+func (r *CallbackRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	return r.datastore.Delete(ctx, id)
+}
+
+const (
+
+	// IdempotencyScopeRequest is a scope constant for keys sent in the Idempotency-Key header, covering a request
+	IdempotencyScopeRequest = "request"
+
+	// IdempotencyScopeEmail is a scope constant for keys sent with a single email in a batch
+	IdempotencyScopeEmail = "email"
+)
+
+// IdempotencyRecord remembers the outcome of a request or email created with an idempotency key, so retries
+// return the original result instead of creating duplicates; records expire at ExpiresAt (Unix seconds)
+type IdempotencyRecord struct {
+	ID          uuid.UUID `json:"id"`
+	Scope       string    `json:"scope"`
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash"`
+	StatusCode  int       `json:"status_code"`
+	Response    string    `json:"response"`
+	EmailID     uuid.UUID `json:"email_id"`
+	LockedUntil int64     `json:"locked_until"`
+	ExpiresAt   int64     `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Completed reports whether the original request or email has finished, i.e. there is a result to return
+func (r *IdempotencyRecord) Completed() bool {
+	return r.StatusCode != 0 || r.EmailID != uuid.Nil
+}
+
+// Expired reports whether the record is past its expiry but hasn't been removed by the datastore yet
+func (r *IdempotencyRecord) Expired() bool {
+	return r.ExpiresAt < time.Now().Unix()
+}
+
+// Abandoned reports whether the original request never finished, e.g. the function was stopped, and its lock ran out
+func (r *IdempotencyRecord) Abandoned() bool {
+	return !r.Completed() && r.LockedUntil < time.Now().Unix()
+}
+
+// idempotencyID derives the key of an idempotency record, so records can be looked up by scope and key
+func idempotencyID(scope, key string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("idempotency:"+scope+":"+key))
+}
+
+// IdempotencyRepository stores and fetches idempotency records
+type IdempotencyRepository struct {
+	datastore store.Datastore
+	ttl       time.Duration
+	lease     time.Duration
+}
+
+// NewIdempotencyRepository instance; records are kept for the ttl, and keys of requests that haven't finished are
+// locked for the lease
+func NewIdempotencyRepository(ds store.Datastore, ttl, lease time.Duration) *IdempotencyRepository {
+	return &IdempotencyRepository{datastore: ds, ttl: ttl, lease: lease}
+}
+
+// Reserve claims a key for a new request; if the key is already taken, the existing record is returned instead
+// with reserved set to false
+func (r *IdempotencyRepository) Reserve(ctx context.Context, scope, key, requestHash string) (record *IdempotencyRecord, reserved bool, err error) {
+	now := time.Now()
+	record = &IdempotencyRecord{
+		ID:          idempotencyID(scope, key),
+		Scope:       scope,
+		Key:         key,
+		RequestHash: requestHash,
+		LockedUntil: now.Add(r.lease).Unix(),
+		ExpiresAt:   now.Add(r.ttl).Unix(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	err = r.datastore.Insert(ctx, record)
+	if _, conflict := err.(*store.ConflictError); !conflict {
+		return record, err == nil, err
+	}
+
+	// the key is taken, unless its record has expired but not yet been removed by the datastore, or its request
+	// was abandoned
+	existing, err := r.Get(ctx, scope, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !existing.Expired() && !existing.Abandoned() {
+		return existing, false, nil
+	}
+
+	// take the record over only if it's still the one that was read, so concurrent retries can't both reserve it
+	conditions := store.ConditionSet{
+		"request_hash": existing.RequestHash,
+		"expires_at":   existing.ExpiresAt,
+		"locked_until": existing.LockedUntil,
+	}
+	if existing.LockedUntil == 0 {
+		conditions["locked_until"] = nil // records created before locking
+	}
+	err = r.datastore.UpdateWhere(ctx, record.ID, record, store.ChangeSet{
+		"request_hash": record.RequestHash,
+		"status_code":  0,
+		"response":     "",
+		"email_id":     uuid.Nil,
+		"locked_until": record.LockedUntil,
+		"expires_at":   record.ExpiresAt,
+		"created_at":   record.CreatedAt,
+		"updated_at":   record.UpdatedAt,
+	}, conditions)
+	if _, conflict := err.(*store.ConflictError); conflict {
+		return existing, false, nil
+	}
+	return record, err == nil, err
+}
+
+// Get the record of a key
+func (r *IdempotencyRepository) Get(ctx context.Context, scope, key string) (*IdempotencyRecord, error) {
+	var record *IdempotencyRecord
+	if err := r.datastore.Get(ctx, idempotencyID(scope, key), &record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Update an existing record, e.g. to save the result of the request
+func (r *IdempotencyRepository) Update(ctx context.Context, record *IdempotencyRecord, changeSet store.ChangeSet) error {
+	changeSet["updated_at"] = time.Now()
+	return r.datastore.Update(ctx, record.ID, record, changeSet)
+}
+
+// Release deletes a reserved key so the request can be retried
+func (r *IdempotencyRepository) Release(ctx context.Context, record *IdempotencyRecord) error {
+	return r.datastore.Delete(ctx, record.ID)
 }
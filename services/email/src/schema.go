@@ -2,6 +2,7 @@ package main
 
 import (
 	"carrier.microservices.go/src/lib/datetime"
+	"carrier.microservices.go/src/lib/validation"
 	"github.com/google/uuid"
 )
 
@@ -14,35 +15,98 @@ type EmailRequestSchema struct {
 	Queued        datetime.JSONTime `json:"queued"`
 	Priority      int               `json:"priority" validate:"required,numeric,gte=0,lte=3"`
 	ServiceID     string            `json:"service_id"`
+	CallbackURL   string            `json:"callback_url" validate:"omitempty,url,max=2048"`
 }
 
-//BatchEmailRequestSchema defines the input shape and validation schema for
+// NewEmailRequestSchema defines the input validation schema for an email in a batch JSON request; priority 0
+// sends the email immediately.
+type NewEmailRequestSchema struct {
+	Recipients     []string          `json:"recipients" validate:"required,min=1,dive,required,email"`
+	Template       string            `json:"template" validate:"required,min=2,max=255"`
+	Substitutions  map[string]string `json:"substitutions"`
+	Priority       int               `json:"priority" validate:"numeric,gte=0,lte=3"`
+	CallbackURL    string            `json:"callback_url" validate:"omitempty,url,max=2048"`
+	IdempotencyKey string            `json:"idempotency_key" validate:"max=255"`
+}
+
+// SuppressionRequestSchema defines the input validation schema for Suppression JSON requests.
+type SuppressionRequestSchema struct {
+	Address     string `json:"address" validate:"required,email"`
+	Reason      string `json:"reason" validate:"required,oneof=hard_bounce spam_complaint unsubscribe manual"`
+	Description string `json:"description" validate:"max=1000"`
+}
+
+// SuppressionUpdateRequestSchema defines the input validation schema for Suppression JSON update requests.
+type SuppressionUpdateRequestSchema struct {
+	Reason      string `json:"reason" validate:"required,oneof=hard_bounce spam_complaint unsubscribe manual"`
+	Description string `json:"description" validate:"max=1000"`
+}
+
+// BatchEmailRequestSchema defines the input shape and validation schema for a batch of Email JSON requests; each
+// email is validated separately.
 type BatchEmailRequestSchema struct {
-	Emails []EmailRequestSchema `json:"emails" validate:"required,min=1"`
+	Emails []NewEmailRequestSchema `json:"emails" validate:"required,min=1"`
+	Atomic bool                    `json:"atomic"`
+}
+
+// RetryEmailRequestSchema defines the input validation schema for retrying a failed Email; attempts are reset, or
+// set so a single one is left, and the priority is kept unless one is given.
+type RetryEmailRequestSchema struct {
+	Attempts string `json:"attempts" validate:"omitempty,oneof=reset single"`
+	Priority *int   `json:"priority" validate:"omitempty,gte=0,lte=3"`
+	Note     string `json:"note" validate:"max=1000"`
+}
+
+// RetryEmailsRequestSchema defines the input validation schema for retrying the failed Emails that match a filter.
+type RetryEmailsRequestSchema struct {
+	Template      string            `json:"template" validate:"max=255"`
+	FailureClass  string            `json:"failure_class" validate:"omitempty,oneof=permanent retries_exhausted expired suppressed"`
+	CreatedAfter  datetime.JSONTime `json:"created_after"`
+	CreatedBefore datetime.JSONTime `json:"created_before"`
+	Limit         int64             `json:"limit" validate:"omitempty,gte=1,lte=200"`
+	Attempts      string            `json:"attempts" validate:"omitempty,oneof=reset single"`
+	Priority      *int              `json:"priority" validate:"omitempty,gte=0,lte=3"`
+	Note          string            `json:"note" validate:"max=1000"`
 }
 
+// Retry attempt policies
+const (
+	RetryAttemptsReset  = "reset"
+	RetryAttemptsSingle = "single"
+)
+
 // EmailSchema defines the JSON schema for the Email model.
 type EmailSchema struct {
-	ID            uuid.UUID         `json:"id"`
-	ServiceID     string            `json:"service_id"`
-	Recipients    []string          `json:"recipients"`
-	Template      string            `json:"template"`
-	Substitutions map[string]string `json:"substitutions"`
-	SendStatus    int               `json:"send_status"`
-	Queued        datetime.JSONTime `json:"queued"`
-	Priority      int               `json:"priority"`
-	Attempts      int               `json:"attempts"`
-	Accepted      int               `json:"accepted"`
-	Rejected      int               `json:"rejected"`
-	LastAttemptAt datetime.JSONTime `json:"last_attempt_at"`
-	CreatedAt     datetime.JSONTime `json:"created_at"`
-	UpdatedAt     datetime.JSONTime `json:"updated_at"`
+	ID            uuid.UUID          `json:"id"`
+	ServiceID     string             `json:"service_id"`
+	Provider      string             `json:"provider"`
+	Recipients    []string           `json:"recipients"`
+	Template      string             `json:"template"`
+	Substitutions map[string]string  `json:"substitutions"`
+	SendStatus    int                `json:"send_status"`
+	Queued        datetime.JSONTime  `json:"queued"`
+	Priority      int                `json:"priority"`
+	Attempts      int                `json:"attempts"`
+	Accepted      int                `json:"accepted"`
+	Rejected      int                `json:"rejected"`
+	LastAttemptAt datetime.JSONTime  `json:"last_attempt_at"`
+	NextAttemptAt datetime.JSONTime  `json:"next_attempt_at"`
+	FailureReason string             `json:"failure_reason"`
+	FailureClass  string             `json:"failure_class"`
+	Version       int                `json:"version"`
+	Events        []EventSchema      `json:"events"`
+	Suppressed    []string           `json:"suppressed"`
+	CallbackURL   string             `json:"callback_url"`
+	AuditLog      []AuditEntrySchema `json:"audit_log"`
+	CreatedAt     datetime.JSONTime  `json:"created_at"`
+	UpdatedAt     datetime.JSONTime  `json:"updated_at"`
 }
 
 // Loads an Email record into EmailSchema.
 func (s *EmailSchema) load(m *Email) {
 	s.ID = m.ID
 	s.ServiceID = m.ServiceID
+	s.Provider = m.Provider
 	s.Recipients = m.Recipients
 	s.Template = m.Template
 	s.Substitutions = m.Substitutions
@@ -53,10 +117,107 @@ func (s *EmailSchema) load(m *Email) {
 	s.Accepted = m.Accepted
 	s.Rejected = m.Rejected
 	s.LastAttemptAt = datetime.JSONTime(m.LastAttemptAt)
+	if m.SendStatus == EmailStatusQueued {
+		s.NextAttemptAt = datetime.JSONTime(m.Queued) // scheduled by the retry policy after a failed attempt
+	}
+	s.FailureReason = m.FailureReason
+	s.FailureClass = m.FailureClass
+	s.Version = m.Version
+	s.Events = []EventSchema{}
+	for _, event := range m.Events {
+		eventPayload := EventSchema{}
+		eventPayload.load(&event)
+		s.Events = append(s.Events, eventPayload)
+	}
+	s.Suppressed = m.Suppressed
+	if s.Suppressed == nil {
+		s.Suppressed = []string{}
+	}
+	s.CallbackURL = m.CallbackURL
+	s.AuditLog = []AuditEntrySchema{}
+	for _, entry := range m.AuditLog {
+		entryPayload := AuditEntrySchema{}
+		entryPayload.load(&entry)
+		s.AuditLog = append(s.AuditLog, entryPayload)
+	}
 	s.CreatedAt = datetime.JSONTime(m.CreatedAt)
 	s.UpdatedAt = datetime.JSONTime(m.UpdatedAt)
 }
 
+// EventSchema defines the JSON schema for the DeliveryEvent model.
+type EventSchema struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Recipient   string            `json:"recipient"`
+	Timestamp   datetime.JSONTime `json:"timestamp"`
+	Reason      string            `json:"reason"`
+	BounceClass string            `json:"bounce_class"`
+	URL         string            `json:"url"`
+}
+
+// Loads a DeliveryEvent record into EventSchema.
+func (s *EventSchema) load(m *DeliveryEvent) {
+	s.ID = m.ID
+	s.Type = m.Type
+	s.Recipient = m.Recipient
+	s.Timestamp = datetime.JSONTime(m.Timestamp)
+	s.Reason = m.Reason
+	s.BounceClass = m.BounceClass
+	s.URL = m.URL
+}
+
+// AttemptSchema defines the JSON schema for the SendAttempt model.
+type AttemptSchema struct {
+	Number    int               `json:"number"`
+	At        datetime.JSONTime `json:"at"`
+	Provider  string            `json:"provider"`
+	Outcome   string            `json:"outcome"`
+	Error     string            `json:"error"`
+	ServiceID string            `json:"service_id"`
+	Accepted  int               `json:"accepted"`
+	Rejected  int               `json:"rejected"`
+	Duration  int64             `json:"duration"`
+}
+
+// Loads a SendAttempt record into AttemptSchema.
+func (s *AttemptSchema) load(m *SendAttempt) {
+	s.Number = m.Number
+	s.At = datetime.JSONTime(m.At)
+	s.Provider = m.Provider
+	s.Outcome = m.Outcome
+	s.Error = m.Error
+	s.ServiceID = m.ServiceID
+	s.Accepted = m.Accepted
+	s.Rejected = m.Rejected
+	s.Duration = m.Duration
+}
+
+// AuditEntrySchema defines the JSON schema for the AuditEntry model.
+type AuditEntrySchema struct {
+	At            datetime.JSONTime `json:"at"`
+	Action        string            `json:"action"`
+	Note          string            `json:"note"`
+	SendStatus    int               `json:"send_status"`
+	Attempts      int               `json:"attempts"`
+	FailureReason string            `json:"failure_reason"`
+}
+
+// Loads an AuditEntry record into AuditEntrySchema.
+func (s *AuditEntrySchema) load(m *AuditEntry) {
+	s.At = datetime.JSONTime(m.At)
+	s.Action = m.Action
+	s.Note = m.Note
+	s.SendStatus = m.SendStatus
+	s.Attempts = m.Attempts
+	s.FailureReason = m.FailureReason
+}
+
+// AttemptListResponseSchema defines the response schema for the send attempts of an Email record.
+type AttemptListResponseSchema struct {
+	Attempts []AttemptSchema `json:"attempts"`
+	Total    int             `json:"total"`
+}
+
 // EmailResponseSchema defines the response schema for a single Email record.
 type EmailResponseSchema struct {
 	Email EmailSchema `json:"email"`
@@ -64,14 +225,163 @@ type EmailResponseSchema struct {
 
 // EmailListResponseSchema defines the response schema for a list of Email records.
 type EmailListResponseSchema struct {
-	Emails []EmailSchema `json:"emails"`
-	Page   int64         `json:"page"`
-	Limit  int64         `json:"limit"`
+	Emails     []EmailSchema `json:"emails"`
+	Limit      int64         `json:"limit"`
+	NextCursor string        `json:"next_cursor"`
+	HasMore    bool          `json:"has_more"`
+	Source     string        `json:"source"`
+}
+
+// RecipientEmailListResponseSchema defines the response schema for the emails sent to one address.
+type RecipientEmailListResponseSchema struct {
+	Address    string        `json:"address"`
+	Emails     []EmailSchema `json:"emails"`
+	Limit      int64         `json:"limit"`
+	NextCursor string        `json:"next_cursor"`
+	HasMore    bool          `json:"has_more"`
 }
 
+// Email list sources: an indexed query, or a scan of the whole table
+const (
+	ListSourceQuery = "query"
+	ListSourceScan  = "scan"
+)
+
 // BatchEmailResponseSchema defines the response schema for a batch of Email records.
 type BatchEmailResponseSchema struct {
-	Emails []EmailSchema `json:"emails"`
-	Sent   int64         `json:"sent"`
-	Queued int64         `json:"queued"`
+	Results     []BatchEmailResultSchema     `json:"results"`
+	Emails      []EmailSchema                `json:"emails"`
+	Sent        int64                        `json:"sent"`
+	Queued      int64                        `json:"queued"`
+	Failed      int64                        `json:"failed"`
+	Replayed    int64                        `json:"replayed"`
+	Unprocessed int64                        `json:"unprocessed"`
+	Errors      map[string]map[string]string `json:"errors,omitempty"`
+	Details     validation.Errors            `json:"details,omitempty"`
+}
+
+// Batch email result statuses
+const (
+	BatchStatusSent     = "sent"
+	BatchStatusQueued   = "queued"
+	BatchStatusFailed   = "failed"
+	BatchStatusReplayed = "replayed"
+	BatchStatusInvalid  = "invalid"
+	BatchStatusConflict = "conflict"
+	BatchStatusAborted  = "aborted"
+	BatchStatusError    = "error"
+)
+
+// BatchEmailResultSchema defines the response schema for the outcome of one email in a batch.
+type BatchEmailResultSchema struct {
+	Index   int                          `json:"index"`
+	Code    int                          `json:"code"`
+	Status  string                       `json:"status"`
+	Email   *EmailSchema                 `json:"email"`
+	Error   string                       `json:"error"`
+	Errors  map[string]map[string]string `json:"errors"`
+	Details validation.Errors            `json:"details"`
+}
+
+// RetryEmailResponseSchema defines the response schema for a retried Email record.
+type RetryEmailResponseSchema struct {
+	Status string      `json:"status"`
+	Email  EmailSchema `json:"email"`
+}
+
+// RetryEmailsResponseSchema defines the response schema for retrying the failed Email records that match a filter;
+// emails that changed while being retried are skipped.
+type RetryEmailsResponseSchema struct {
+	Emails  []EmailSchema `json:"emails"`
+	Queued  int64         `json:"queued"`
+	Skipped int64         `json:"skipped"`
+	HasMore bool          `json:"has_more"`
+}
+
+// WebhookResponseSchema defines the response schema for a batch of webhook events.
+type WebhookResponseSchema struct {
+	Received int `json:"received"`
+	Recorded int `json:"recorded"`
+}
+
+// SuppressionSchema defines the JSON schema for the Suppression model.
+type SuppressionSchema struct {
+	Address     string            `json:"address"`
+	Reason      string            `json:"reason"`
+	Description string            `json:"description"`
+	CreatedAt   datetime.JSONTime `json:"created_at"`
+	UpdatedAt   datetime.JSONTime `json:"updated_at"`
+}
+
+// Loads a Suppression record into SuppressionSchema.
+func (s *SuppressionSchema) load(m *Suppression) {
+	s.Address = m.Address
+	s.Reason = m.Reason
+	s.Description = m.Description
+	s.CreatedAt = datetime.JSONTime(m.CreatedAt)
+	s.UpdatedAt = datetime.JSONTime(m.UpdatedAt)
+}
+
+// SuppressionResponseSchema defines the response schema for a single Suppression record.
+type SuppressionResponseSchema struct {
+	Suppression SuppressionSchema `json:"suppression"`
+}
+
+// SuppressionListResponseSchema defines the response schema for a list of Suppression records.
+type SuppressionListResponseSchema struct {
+	Suppressions []SuppressionSchema `json:"suppressions"`
+	Limit        int64               `json:"limit"`
+	NextCursor   string              `json:"next_cursor"`
+	HasMore      bool                `json:"has_more"`
+}
+
+// CallbackEventSchema defines the JSON schema of the status-change event posted to callback URLs.
+type CallbackEventSchema struct {
+	ID        uuid.UUID               `json:"id"`
+	Type      string                  `json:"type"`
+	CreatedAt datetime.JSONTime       `json:"created_at"`
+	Data      CallbackEventDataSchema `json:"data"`
+}
+
+// CallbackEventDataSchema defines the JSON schema of the email described by a status-change event; substitutions
+// are left out as they may hold secrets such as password reset tokens.
+type CallbackEventDataSchema struct {
+	ID                 uuid.UUID         `json:"id"`
+	ServiceID          string            `json:"service_id"`
+	Provider           string            `json:"provider"`
+	Recipients         []string          `json:"recipients"`
+	Template           string            `json:"template"`
+	PreviousSendStatus int               `json:"previous_send_status"`
+	SendStatus         int               `json:"send_status"`
+	Attempts           int               `json:"attempts"`
+	Accepted           int               `json:"accepted"`
+	Rejected           int               `json:"rejected"`
+	Suppressed         []string          `json:"suppressed"`
+	FailureReason      string            `json:"failure_reason"`
+	Version            int               `json:"version"`
+	UpdatedAt          datetime.JSONTime `json:"updated_at"`
+}
+
+// Loads a Callback record and the Email it describes into CallbackEventSchema.
+func (s *CallbackEventSchema) load(m *Callback, e *Email, previousStatus int) {
+	s.ID = m.ID
+	s.Type = m.EventType
+	s.CreatedAt = datetime.JSONTime(m.CreatedAt)
+	s.Data.ID = e.ID
+	s.Data.ServiceID = e.ServiceID
+	s.Data.Provider = e.Provider
+	s.Data.Recipients = e.Recipients
+	s.Data.Template = e.Template
+	s.Data.PreviousSendStatus = previousStatus
+	s.Data.SendStatus = e.SendStatus
+	s.Data.Attempts = e.Attempts
+	s.Data.Accepted = e.Accepted
+	s.Data.Rejected = e.Rejected
+	s.Data.Suppressed = e.Suppressed
+	if s.Data.Suppressed == nil {
+		s.Data.Suppressed = []string{}
+	}
+	s.Data.FailureReason = e.FailureReason
+	s.Data.Version = e.Version
+	s.Data.UpdatedAt = datetime.JSONTime(e.UpdatedAt)
 }